@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+const (
+	defaultFullKbps     = 3000
+	layerInputFrames    = 30   // frames buffered ahead of a layer's encoder before some are dropped
+	lossDowngrade       = 0.10 // fraction lost in receiver reports that steps a viewer down
+	lossUpgrade         = 0.02 // and the most that still lets it step back up
+	estimateHeadroom    = 1.25 // how far an estimate has to clear a layer's bitrate to go up to it
+	layerDowngradeHold  = 2 * time.Second
+	layerUpgradeHold    = 10 * time.Second
+	lossSmoothingFactor = 0.3
+)
+
+// qualityLayer is one rung of the bitrate ladder. The full layer is the
+// capture pipeline itself; the lower ones re-encode its frames smaller, so a
+// viewer on a poor network can be moved down without touching the device.
+type qualityLayer struct {
+	Name   string // empty for full quality
+	Height int    // scaled to, keeping the aspect ratio; 0 keeps the capture size
+	Kbps   uint64
+}
+
+// qualityLadder is the layers on offer, best first. The lower layers are only
+// offered when they really are lower than the configured bitrate.
+func qualityLadder(encoder encoderSettings) []qualityLayer {
+	full := parseKbps(encoder.Bitrate)
+	if full == 0 {
+		full = defaultFullKbps
+	}
+
+	ladder := []qualityLayer{{Kbps: full}}
+	for _, layer := range []qualityLayer{
+		{Name: "medium", Height: 720, Kbps: 1200},
+		{Name: "low", Height: 360, Kbps: 400},
+	} {
+		if layer.Kbps < full {
+			ladder = append(ladder, layer)
+		}
+	}
+
+	return ladder
+}
+
+// parseKbps reads an ffmpeg bitrate such as 3000k or 2M as kbit/s, 0 if it
+// can't be read
+func parseKbps(bitrate string) uint64 {
+	multiplier := 0.001
+	switch {
+	case strings.HasSuffix(bitrate, "k"):
+		multiplier, bitrate = 1, strings.TrimSuffix(bitrate, "k")
+	case strings.HasSuffix(bitrate, "M"):
+		multiplier, bitrate = 1000, strings.TrimSuffix(bitrate, "M")
+	}
+
+	value, err := strconv.ParseFloat(bitrate, 64)
+	if err != nil || value < 0 {
+		return 0
+	}
+
+	return uint64(value * multiplier)
+}
+
+// bitrateEstimator decides which layer a viewer should get from the RTCP its
+// browser sends back: REMB for the bandwidth it estimates, and receiver
+// reports for how much is being lost. It steps down quickly, but only steps
+// back up once things have been good for a while, so a viewer doesn't flip
+// between layers.
+type bitrateEstimator struct {
+	ladder     []qualityLayer
+	current    int
+	estimate   uint64  // bits/s from the latest REMB, 0 until one arrives
+	loss       float64 // smoothed fraction lost
+	lastChange time.Time
+	goodSince  time.Time
+}
+
+// newBitrateEstimator starts at full quality. The first step down isn't held
+// back, since a viewer struggling from the start has nothing to lose.
+func newBitrateEstimator(ladder []qualityLayer) *bitrateEstimator {
+	return &bitrateEstimator{ladder: ladder}
+}
+
+func (e *bitrateEstimator) onREMB(bitrate uint64) {
+	e.estimate = bitrate
+}
+
+// onLoss takes a receiver report's fraction lost, out of 256
+func (e *bitrateEstimator) onLoss(fractionLost uint8) {
+	e.loss += (float64(fractionLost)/256 - e.loss) * lossSmoothingFactor
+}
+
+// fits reports whether layer i fits in the estimated bandwidth with room to
+// spare
+func (e *bitrateEstimator) fits(i int, headroom float64) bool {
+	return e.estimate == 0 || float64(e.ladder[i].Kbps*1000)*headroom <= float64(e.estimate)
+}
+
+// choose returns the layer the viewer should be on now
+func (e *bitrateEstimator) choose(now time.Time) int {
+	switch {
+	case e.current < len(e.ladder)-1 && (e.loss > lossDowngrade || !e.fits(e.current, 1)):
+		e.goodSince = time.Time{}
+		if now.Sub(e.lastChange) < layerDowngradeHold {
+			break
+		}
+
+		next := e.current + 1
+		for next < len(e.ladder)-1 && !e.fits(next, 1) {
+			next++
+		}
+		e.change(next, now)
+	case e.current > 0 && e.loss < lossUpgrade && e.fits(e.current-1, estimateHeadroom):
+		if e.goodSince.IsZero() {
+			e.goodSince = now
+		}
+
+		if now.Sub(e.goodSince) >= layerUpgradeHold {
+			e.change(e.current-1, now)
+		}
+	default:
+		e.goodSince = time.Time{}
+	}
+
+	return e.current
+}
+
+func (e *bitrateEstimator) change(layer int, now time.Time) {
+	e.current = layer
+	e.lastChange = now
+	e.goodSince = time.Time{}
+}
+
+// setLayer moves feed index to layer of the source it is watching
+func (s *viewerSession) setLayer(index int, layer qualityLayer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.feeds) {
+		return notFoundError{what: fmt.Sprintf("feed %d", index)}
+	}
+
+	feed := s.feeds[index]
+	if feed.replay != nil {
+		feed.layer = layer // for going back to live; replays are always full quality
+	} else if feed.layer.Name != layer.Name {
+		s.moveFeed(feed, feed.source, layer)
+	}
+
+	return nil
+}
+
+// layerInput is a lower layer's view of its full quality pipeline. Frames
+// are queued rather than written straight to the encoder, so a slow encoder
+// can't hold up the full quality viewers; when the queue is full frames are
+// dropped until the next keyframe.
+type layerInput struct {
+	codec  string
+	frames chan []byte
+
+	mu          sync.Mutex
+	sawKeyframe bool
+	closed      bool
+}
+
+func newLayerInput(codec string) *layerInput {
+	return &layerInput{codec: codec, frames: make(chan []byte, layerInputFrames)}
+}
+
+func (in *layerInput) WriteSample(s media.Sample) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.closed {
+		return io.ErrClosedPipe
+	}
+
+	// the encoder can't decode anything before a keyframe
+	if !in.sawKeyframe && !isKeyframe(in.codec, s.Data) {
+		return nil
+	}
+
+	select {
+	case in.frames <- s.Data:
+		in.sawKeyframe = true
+	default:
+		in.sawKeyframe = false
+	}
+
+	return nil
+}
+
+func (in *layerInput) Close() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if !in.closed {
+		in.closed = true
+		close(in.frames)
+	}
+
+	return nil
+}
+
+// copyTo writes the queued frames to an encoder's stdin, as IVF for VP8 and
+// as the Annex B stream itself for H.264
+func (in *layerInput) copyTo(out io.WriteCloser) error {
+	defer out.Close()
+
+	write := func(frame []byte, timestamp uint64) error {
+		_, err := out.Write(frame)
+		return err
+	}
+
+	if in.codec != webrtc.H264 {
+		w, err := newIvfWriter(out, ivfFourCC(in.codec), 0, 0, recordingTimebase, 1)
+		if err != nil {
+			return err
+		}
+		write = w.writeFrame
+	}
+
+	started := time.Now()
+	for frame := range in.frames {
+		if err := write(frame, uint64(time.Since(started)/time.Millisecond)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// layerTranscoder runs a lower layer's encoder, reading in and writing to b
+type layerTranscoder func(b *videoBroadcaster, in *layerInput, uArgs userArguments, stop <-chan struct{}) error
+
+// composeLayerCommand re-encodes the full quality stream on stdin to layer
+func composeLayerCommand(platform, codec string, layer qualityLayer, encoder encoderSettings) (*exec.Cmd, error) {
+	inputFormat := "ivf"
+	if codec == webrtc.H264 {
+		inputFormat = "h264"
+	}
+
+	encoder.Bitrate = fmt.Sprintf("%dk", layer.Kbps)
+	output, err := encoderArgs(platform, codec, encoder)
+	if err != nil {
+		return nil, err
+	}
+
+	if layer.Height > 0 {
+		output = insertBeforeOutput(output, "-vf", fmt.Sprintf("scale=-2:%d", layer.Height))
+	}
+
+	input := []string{"-y", "-f", inputFormat, "-i", "pipe:0"}
+	if encoder.Threads > 0 {
+		input = append([]string{"-threads", strconv.Itoa(encoder.Threads)}, input...)
+	}
+
+	return exec.Command("ffmpeg", append(input, output...)...), nil
+}
+
+// transcodeLayer is the layerTranscoder that runs ffmpeg
+func transcodeLayer(b *videoBroadcaster, in *layerInput, uArgs userArguments, stop <-chan struct{}) error {
+	execStream, err := composeLayerCommand(uArgs.operatingSys, uArgs.videoCodec, uArgs.qualityLayer, uArgs.encoder)
+	if err != nil {
+		return err
+	}
+	execStream.Stderr = uArgs.ffmpegStderr
+
+	stdin, err := execStream.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("ffmpeg stdin error: %s", err)
+	}
+
+	ivf, header, stdout, err := startVideoPipe(execStream, uArgs.videoCodec)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	defer closeOnStop(stop, stdout)()
+
+	go func() {
+		if err := in.copyTo(stdin); err != nil && !isClosed(stop) {
+			fmt.Printf("%s layer input error: %s\n", uArgs.qualityLayer.Name, err)
+		}
+	}()
+
+	streamVideo(ivf, b, float32(header.TimebaseNumerator), float32(header.TimebaseDenominator), stdout, uArgs)
+
+	if err = stdout.Close(); err != nil && !isClosed(stop) {
+		return fmt.Errorf("ffmpeg exited: %s", err)
+	}
+
+	return nil
+}
+
+// run makes one attempt at b's pipeline. A lower layer watches its full
+// quality pipeline like any viewer would, rather than opening the device a
+// second time.
+func (r *broadcasterRegistry) run(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+	if uArgs.qualityLayer.Name == "" {
+		return r.start(b, uArgs, stop)
+	}
+
+	full := uArgs
+	full.qualityLayer = qualityLayer{}
+	parent := r.join(full)
+
+	in := newLayerInput(b.codec)
+	id := parent.addTrack(in)
+	defer r.leave(parent, id)
+	defer in.Close()
+
+	return r.transcode(b, in, uArgs, stop)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+func TestQualityLadder(t *testing.T) {
+	names := func(ladder []qualityLayer) string {
+		layers := []string{}
+		for _, layer := range ladder {
+			layers = append(layers, layer.Name)
+		}
+		return strings.Join(layers, ",")
+	}
+
+	if ladder := qualityLadder(encoderSettings{}); names(ladder) != ",medium,low" || ladder[0].Kbps != defaultFullKbps {
+		t.Errorf("default ladder is %+v", ladder)
+	}
+
+	if ladder := qualityLadder(encoderSettings{Bitrate: "1M"}); names(ladder) != ",low" || ladder[0].Kbps != 1000 {
+		t.Errorf("a 1M ladder is %+v", ladder)
+	}
+
+	for bitrate, kbps := range map[string]uint64{"3000k": 3000, "2.5M": 2500, "800000": 800, "fast": 0} {
+		if got := parseKbps(bitrate); got != kbps {
+			t.Errorf("parseKbps(%q) = %d, should be %d", bitrate, got, kbps)
+		}
+	}
+}
+
+func TestBitrateEstimator(t *testing.T) {
+	e := newBitrateEstimator(qualityLadder(encoderSettings{}))
+	now := time.Now()
+
+	if e.choose(now) != 0 {
+		t.Error("without any feedback the viewer should stay at full quality")
+	}
+
+	// hospital wifi: the browser estimates 1.5Mbit/s, enough for medium
+	e.onREMB(1500000)
+	if layer := e.choose(now); layer != 1 {
+		t.Fatalf("a 1.5M estimate chose layer %d", layer)
+	}
+
+	// losing a third of the packets steps down again, but not straight away
+	for i := 0; i < 10; i++ {
+		e.onLoss(85)
+	}
+	if layer := e.choose(now.Add(time.Second)); layer != 1 {
+		t.Errorf("stepped down to %d within the hold", layer)
+	}
+	if layer := e.choose(now.Add(layerDowngradeHold)); layer != 2 {
+		t.Errorf("heavy loss chose layer %d", layer)
+	}
+
+	// the network recovers; going back up waits for it to stay good
+	for i := 0; i < 20; i++ {
+		e.onLoss(0)
+	}
+	e.onREMB(10000000)
+	later := now.Add(time.Minute)
+	if layer := e.choose(later); layer != 2 {
+		t.Errorf("stepped up to %d without waiting", layer)
+	}
+	if layer := e.choose(later.Add(layerUpgradeHold)); layer != 1 {
+		t.Errorf("a good network chose layer %d", layer)
+	}
+	e.choose(later.Add(layerUpgradeHold * 2))
+	if layer := e.choose(later.Add(layerUpgradeHold * 3)); layer != 0 {
+		t.Errorf("a good network chose layer %d", layer)
+	}
+}
+
+func TestComposeLayerCommand(t *testing.T) {
+	low := qualityLayer{Name: "low", Height: 360, Kbps: 400}
+
+	vp8, err := composeLayerCommand(osLinux, webrtc.VP8, low, encoderSettings{Bitrate: "3000k"})
+	if err != nil {
+		t.Fatalf("composeLayerCommand failed with %s", err)
+	}
+
+	args := strings.Join(vp8.Args, " ")
+	for _, want := range []string{"-f ivf -i pipe:0", "-b 400k", "-vf scale=-2:360", "-f ivf " + stdoutPipeTarget} {
+		if !strings.Contains(args, want) {
+			t.Errorf("command %q is missing %q", args, want)
+		}
+	}
+
+	h264, err := composeLayerCommand(osMac, webrtc.H264, low, encoderSettings{})
+	if err != nil {
+		t.Fatalf("composeLayerCommand failed with %s", err)
+	}
+
+	if args = strings.Join(h264.Args, " "); !strings.Contains(args, "-f h264 -i pipe:0") || !strings.Contains(args, "-c:v libx264") {
+		t.Errorf("unexpected H.264 command %q", args)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestLayerInput(t *testing.T) {
+	in := newLayerInput(webrtc.VP8)
+
+	in.WriteSample(media.Sample{Data: []byte{0x01, 0xaa}}) // can't be decoded on its own
+	in.WriteSample(media.Sample{Data: []byte{0x00, 0xbb}})
+	in.WriteSample(media.Sample{Data: []byte{0x01, 0xcc}})
+	in.Close()
+
+	if err := in.WriteSample(media.Sample{Data: []byte{0x00}}); err == nil {
+		t.Error("a closed input accepted a frame")
+	}
+
+	var out bytes.Buffer
+	if err := in.copyTo(nopWriteCloser{&out}); err != nil {
+		t.Fatalf("copyTo failed with %s", err)
+	}
+
+	ivf := out.Bytes()
+	if !bytes.HasPrefix(ivf, []byte("DKIF")) || len(ivf) != ivfFileHeaderSize+2*(ivfFrameHeaderSize+2) {
+		t.Fatalf("unexpected IVF of %d bytes", len(ivf))
+	}
+
+	if first := ivf[ivfFileHeaderSize+ivfFrameHeaderSize:]; first[1] != 0xbb {
+		t.Errorf("the encoder should start at the keyframe, got %x", first[:2])
+	}
+}
+
+// atomicCountingTrack counts samples written from a pipeline's goroutine
+type atomicCountingTrack struct {
+	samples *int32
+}
+
+func (ct atomicCountingTrack) WriteSample(s media.Sample) error {
+	atomic.AddInt32(ct.samples, 1)
+	return nil
+}
+
+func TestWatchFeedbackMovesFeedToLowerLayer(t *testing.T) {
+	s, registry := feedTestSession()
+	s.args.adaptiveBitrate = true
+	registry.transcode = func(b *videoBroadcaster, in *layerInput, uArgs userArguments, stop <-chan struct{}) error {
+		for frame := range in.frames {
+			b.WriteSample(media.Sample{Data: frame})
+		}
+		return nil
+	}
+
+	var samples int32
+	s.attachFeed(atomicCountingTrack{samples: &samples}, s.args.sources[0])
+	full := s.feeds[0].broadcaster
+
+	const ssrc = 1234
+	s.watchFeedback(0, &feedbackReader{batches: [][]rtcp.Packet{
+		{&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{SSRC: ssrc, FractionLost: 10}}}},
+		{&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 300000, SSRCs: []uint32{ssrc}}},
+	}}, ssrc)
+
+	s.mu.Lock()
+	feeds := s.feedInfos()
+	low := s.feeds[0].broadcaster
+	s.mu.Unlock()
+
+	if len(feeds) != 1 || feeds[0].Layer != "low" || low == full {
+		t.Fatalf("a 300k estimate left the feed at %+v", feeds)
+	}
+
+	// the low layer is fed from the full quality pipeline, not the device
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&samples) == 0 && time.Now().Before(deadline) {
+		full.WriteSample(media.Sample{Data: []byte{0x00}})
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&samples) == 0 {
+		t.Error("the low layer never passed on the full quality frames")
+	}
+
+	s.detachFeeds()
+}
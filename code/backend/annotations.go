@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	annotationIDLength = 10
+	annotationEvent    = "annotation"
+	clientIDHeader     = "X-Client-ID"
+)
+
+type annotationCoord struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// annotationAction mirrors a UserAction from the canvas in Atn.js
+type annotationAction struct {
+	Enabled    bool              `json:"enabled"`
+	Color      string            `json:"color"`
+	Type       string            `json:"type"`
+	Text       string            `json:"text,omitempty"`
+	Drag       []annotationCoord `json:"drag"`
+	Font       string            `json:"font,omitempty"`
+	FontSize   int               `json:"font_size,omitempty"`
+	LineWeight int               `json:"line_weight,omitempty"`
+}
+
+// annotation is everything drawn on one frozen frame, identified by the
+// frame's timestamp in milliseconds
+type annotation struct {
+	ID             string             `json:"id"`
+	FrameTimestamp int64              `json:"frameTimestamp"`
+	Author         string             `json:"author,omitempty"` // who was signed in, whatever the client says
+	CreatedAt      time.Time          `json:"createdAt"`
+	Actions        []annotationAction `json:"actions"`
+}
+
+// annotationStore appends each annotation to a JSON lines file, so saving one
+// never rewrites the others
+type annotationStore struct {
+	mu          sync.RWMutex
+	path        string
+	annotations []annotation
+}
+
+func loadAnnotationStore(path string) (*annotationStore, error) {
+	s := &annotationStore{path: path, annotations: []annotation{}}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024) // long freehand drags make long lines
+	for line := 1; scanner.Scan(); line++ {
+		var a annotation
+		if err = json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			return nil, fmt.Errorf("annotations file %s line %d error: %s", path, line, err)
+		}
+
+		s.annotations = append(s.annotations, a)
+	}
+
+	return s, scanner.Err()
+}
+
+func (s *annotationStore) add(a annotation) (annotation, error) {
+	if len(a.Actions) == 0 {
+		return annotation{}, badRequestError{err: fmt.Errorf("annotation has no actions")}
+	}
+
+	a.ID = randomID(annotationIDLength)
+	a.CreatedAt = time.Now()
+
+	line, err := json.Marshal(a)
+	if err != nil {
+		return annotation{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return annotation{}, err
+	}
+	defer file.Close()
+
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return annotation{}, err
+	}
+
+	s.annotations = append(s.annotations, a)
+
+	return a, nil
+}
+
+// forFrame returns the annotations on a frame, or all of them when frame is nil
+func (s *annotationStore) forFrame(frame *int64) []annotation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := []annotation{}
+	for _, a := range s.annotations {
+		if frame == nil || a.FrameTimestamp == *frame {
+			found = append(found, a)
+		}
+	}
+
+	return found
+}
+
+// annotationService saves annotations and pushes them to every other viewer
+type annotationService struct {
+	store *annotationStore
+	hub   *eventHub
+}
+
+func (as annotationService) submit(a annotation, from string) (annotation, error) {
+	a, err := as.store.add(a)
+	if err != nil {
+		return annotation{}, err
+	}
+
+	return a, as.hub.publish(annotationEvent, a, from)
+}
+
+func (as annotationService) handleEvent(from *hubClient, data json.RawMessage) error {
+	var a annotation
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+
+	a.Author = from.name
+	_, err := as.submit(a, from.id)
+
+	return err
+}
+
+// annotationsHandler serves GET /api/annotations[?frame=ts] and POST
+// /api/annotations. POSTs should carry the X-Client-ID from the event stream
+// so the author doesn't get their own drawing echoed back.
+func annotationsHandler(as annotationService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			var frame *int64
+			if value := r.URL.Query().Get("frame"); value != "" {
+				ts, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					writeJSONError(w, http.StatusBadRequest, fmt.Errorf("frame %s is not a timestamp", value))
+					return
+				}
+
+				frame = &ts
+			}
+
+			writeJSON(w, http.StatusOK, as.store.forFrame(frame))
+		case http.MethodPost:
+			var a annotation
+			err := readJSON(r, &a)
+			if err == nil {
+				a.Author = identityFrom(r.Context()).Name
+				a, err = as.submit(a, r.Header.Get(clientIDHeader))
+			}
+
+			if err != nil {
+				writeJSONError(w, errorStatus(err), err)
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, a)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		}
+	}
+}
+
+func registerAnnotationHandlers(as annotationService) {
+	as.hub.on(annotationEvent, as.handleEvent)
+	as.hub.restrict(annotationEvent, rolePresenter)
+	http.HandleFunc("/api/annotations", annotationsHandler(as))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const testAnnotation = `{"frameTimestamp": 1234, "actions": [{"enabled": true, "color": "#ff0000", "type": "draw", "drag": [{"x": 1, "y": 2}, {"x": 3, "y": 4}], "line_weight": 4}]}`
+
+func TestAnnotationStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "annotations")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "annotations.jsonl")
+	s, _ := loadAnnotationStore(path)
+
+	var a annotation
+	json.Unmarshal([]byte(testAnnotation), &a)
+	s.add(a)
+	a.FrameTimestamp = 99
+	s.add(a)
+
+	if _, err = s.add(annotation{FrameTimestamp: 1}); err == nil {
+		t.Error("an annotation without actions was accepted")
+	}
+
+	reloaded, err := loadAnnotationStore(path)
+	if err != nil {
+		t.Fatalf("reloading failed with %s", err)
+	}
+
+	frame := int64(1234)
+	found := reloaded.forFrame(&frame)
+	if len(found) != 1 || found[0].Actions[0].LineWeight != 4 || len(found[0].Actions[0].Drag) != 2 {
+		t.Errorf("reloaded annotations are wrong: %+v", found)
+	}
+
+	if len(reloaded.forFrame(nil)) != 2 {
+		t.Errorf("expected 2 annotations in total, got %d", len(reloaded.forFrame(nil)))
+	}
+}
+
+func TestAnnotationBroadcast(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "annotations")
+	defer os.RemoveAll(dir)
+
+	store, _ := loadAnnotationStore(filepath.Join(dir, "annotations.jsonl"))
+	as := annotationService{store: store, hub: newEventHub()}
+	as.hub.on(annotationEvent, as.handleEvent)
+
+	events := httptest.NewServer(websocket.Handler(as.hub.serveWebSocket))
+	defer events.Close()
+
+	attending, attendingID := dialHub(t, events.URL)
+	defer attending.Close()
+	resident, _ := dialHub(t, events.URL)
+	defer resident.Close()
+
+	// drawn over the event stream, claiming to be by someone else
+	spoofed := strings.Replace(testAnnotation, `{`, `{"author": "chief", `, 1)
+	websocket.Message.Send(attending, `{"type": "annotation", "data": `+spoofed+`}`)
+
+	var a annotation
+	msg, err := receiveWithin(resident, time.Second)
+	if err != nil || msg.Type != annotationEvent {
+		t.Fatalf("resident didn't get the annotation: %+v, %s", msg, err)
+	}
+
+	if json.Unmarshal(msg.Data, &a); a.Author != openIdentity.Name {
+		t.Errorf("annotation over the event stream is by %q, should be by who sent it", a.Author)
+	}
+
+	// posted over REST by the attending
+	r := httptest.NewRequest("POST", "/api/annotations", strings.NewReader(spoofed))
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity{Name: "attending", Role: rolePresenter}))
+	r.Header.Set(clientIDHeader, attendingID)
+	w := httptest.NewRecorder()
+	annotationsHandler(as)(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST returned %d: %s", w.Code, w.Body.String())
+	}
+
+	if msg, err = receiveWithin(resident, time.Second); err != nil || msg.Type != annotationEvent {
+		t.Errorf("resident didn't get the posted annotation: %+v, %s", msg, err)
+	}
+
+	if json.Unmarshal(msg.Data, &a); a.Author != "attending" {
+		t.Errorf("posted annotation is by %q, should be by attending", a.Author)
+	}
+
+	if msg, err = receiveWithin(attending, 100*time.Millisecond); err == nil {
+		t.Errorf("attending got their own annotation back: %+v", msg)
+	}
+
+	w = httptest.NewRecorder()
+	annotationsHandler(as)(w, httptest.NewRequest("GET", "/api/annotations?frame=1234", nil))
+
+	var found []annotation
+	json.Unmarshal(w.Body.Bytes(), &found)
+	if len(found) != 2 {
+		t.Errorf("expected 2 saved annotations for the frame, got %d", len(found))
+	}
+
+	w = httptest.NewRecorder()
+	annotationsHandler(as)(w, httptest.NewRequest("GET", "/api/annotations?frame=soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad frame returned %d, should be %d", w.Code, http.StatusBadRequest)
+	}
+}
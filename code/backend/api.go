@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// notFoundError is returned by stores when the thing asked for doesn't exist
+type notFoundError struct {
+	what string
+}
+
+func (e notFoundError) Error() string {
+	return e.what + " not found"
+}
+
+// badRequestError marks errors caused by what the client sent
+type badRequestError struct {
+	err error
+}
+
+func (e badRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e badRequestError) Unwrap() error {
+	return e.err
+}
+
+// errorStatus picks the HTTP status for an error returned by a store
+func errorStatus(err error) int {
+	switch err.(type) {
+	case notFoundError:
+		return http.StatusNotFound
+	case badRequestError:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON replies with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequestError{err: err}
+	}
+
+	return nil
+}
+
+// pathSegments splits what follows prefix in path, so "/api/recordings/x/stop"
+// with prefix "/api/recordings/" gives ["x", "stop"]
+func pathSegments(path, prefix string) []string {
+	var segments []string
+	for _, s := range strings.Split(strings.TrimPrefix(path, prefix), "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+
+	return segments
+}
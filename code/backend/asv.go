@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,23 +11,24 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"time"
 
 	"atn/code/backend/internal/signal"
 
 	"github.com/pion/webrtc/v2"
-	"github.com/pion/webrtc/v2/pkg/media"
 	"github.com/pion/webrtc/v2/pkg/media/ivfreader"
 	"github.com/spf13/pflag"
 )
 
 const (
-	osLinux       = "linux"
-	osMac         = "darwin"
-	osWindows     = "windows"
-	ivfFileHandle = ".output.ivf"
-	saveRawVideo  = "q"
-	doNotTimeOut  = -1
+	osLinux          = "linux"
+	osMac            = "darwin"
+	osWindows        = "windows"
+	ivfFileHandle    = ".output.ivf"
+	stdoutPipeTarget = "pipe:1" // where ffmpeg writes the encoded stream we read
+	saveRawVideo     = "q"
+	doNotTimeOut     = -1
 )
 
 type userArguments struct {
@@ -38,29 +40,61 @@ type userArguments struct {
 	operatingSys       string
 	ivfHandle          string
 	serveOn            string
-	stunServers        string
+	frontendDir        string
+	encoder            encoderSettings
+	tls                tlsSettings
+	auth               authSettings
+	iceServers         []webrtc.ICEServer
+	sources            []videoSource
+	feeds              []string // sources the browser asked for, one per video track
+	recordingDir       string
+	stepsFile          string
+	annotationsFile    string
+	snapshotDir        string
+	audioDevice        string // captured into an Opus track; empty for no audio
+	viewerRole         role   // who asked for the session, for its control channel and talkback
+	viewerName         string
+	talkbackOutput     string // local device viewers' talkback is played on; empty to not play it
+	talkbackForward    bool   // forward talkback to the other viewers
+	trickleICE         bool
+	videoCodec         string
+	adaptiveBitrate    bool          // move viewers between quality layers by their RTCP feedback
+	latencyBudget      time.Duration // how far live video may fall behind before skipping ahead; 0 never skips
+	replayWindow       time.Duration // how much of each full quality pipeline is kept for replay; 0 keeps none
+	qualityLayer       qualityLayer  // the layer a pipeline encodes; full quality when empty
+	ffmpegStderr       io.Writer     // the supervisor's log for the capture ffmpeg
 }
 
 func parseArgs() userArguments {
-	var inputVideo = pflag.String("video-device", "", "path to the video device or it's name (probably \"FHD Capture\" or /dev/video2)")
-	var inputResolutionFlag = pflag.String("input-resolution", "1920x1080", "resolution of camera/input device")
-	var runCleanupFlag = pflag.Bool("run-cleanup", true, "clean up leftover output files")
-	var stunServer = pflag.String("stun-server", "stun:stun.l.google.com:19302", "stun server to use")
-	var serveOnStr = pflag.String("serve-on", ":3000", "port to serve on")
-
+	defineConfigFlags(pflag.CommandLine)
 	pflag.Parse()
 
-	return userArguments{
-		sessionDescription: "",
-		inputVideoPath:     *inputVideo,
-		inputResolution:    *inputResolutionFlag,
-		runCleanup:         *runCleanupFlag,
-		videoIsLive:        true,
-		operatingSys:       runtime.GOOS,
-		ivfHandle:          ivfFileHandle,
-		stunServers:        *stunServer,
-		serveOn:            *serveOnStr,
+	cfg, err := loadConfig(pflag.CommandLine, os.Getenv)
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if printConfig, _ := pflag.CommandLine.GetBool("print-config"); printConfig {
+		cfg.print(os.Stdout)
+		os.Exit(0)
+	}
+
+	if hash, _ := pflag.CommandLine.GetBool("hash-password"); hash {
+		if err = printPasswordHash(os.Stdin, os.Stdout); err != nil {
+			fmt.Printf("error: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	args, err := cfg.arguments()
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
 	}
+
+	return args
 }
 
 func videoDriver(platform string) (string, error) {
@@ -77,30 +111,34 @@ func videoDriver(platform string) (string, error) {
 	}
 }
 
-func composeStreamCommand(inputDevice, platform, resolution string) (*exec.Cmd, error) {
+func composeStreamCommand(inputDevice, platform, resolution, codec string, encoder encoderSettings) (*exec.Cmd, error) {
 	driver, _ := videoDriver(platform) // error handled by default case
 
+	var input []string
 	switch platform {
 	case osWindows:
 		fallthrough
 	case osLinux:
-		return exec.Command("ffmpeg", "-threads", "4", "-y", "-f",
-			driver, "-s", resolution, "-i", inputDevice, "-g",
-			"30", "-deadline", "realtime", ivfFileHandle), nil
+		input = []string{"-threads", "4", "-y", "-f", driver, "-s",
+			resolution, "-i", inputDevice}
 	case osMac:
-		return exec.Command("ffmpeg", "-threads", "6", "-probesize",
-			"100000000", "-f", driver, "-s", resolution, "-r", "30",
-			"-i", inputDevice, "-pix_fmt", "yuv420p", "-g", "1",
-			"-deadline", "realtime", "-speed", "16", "-b", "3000k",
-			"-an", ivfFileHandle), nil
+		input = []string{"-threads", "6", "-probesize", "100000000",
+			"-f", driver, "-s", resolution, "-r", "30", "-i", inputDevice}
 
 	default:
 		return nil, fmt.Errorf("%s not supported", platform)
 	}
-}
 
-func cleanUpIvfFile() {
-	os.Remove(ivfFileHandle)
+	if encoder.Threads > 0 {
+		input[1] = strconv.Itoa(encoder.Threads)
+	}
+
+	output, err := encoderArgs(platform, codec, encoder)
+	if err != nil {
+		return nil, err
+	}
+
+	return exec.Command("ffmpeg", append(input, output...)...), nil
 }
 
 func retrieveIvfFile(handle string, maxTries int) (*os.File, error) {
@@ -144,30 +182,44 @@ func retrieveIvfReader(file *os.File, maxTries int) (*ivfreader.IVFReader, *ivfr
 	return ivf, header, nil
 }
 
-func streamVideo(ivf ivfReader, videoTrack videoMediaTrack, timebaseNum, timebaseDenom float32, ivfFile *os.File, uArgs userArguments) {
-	// send video spaced out -- this makes sending less lossy
+func streamVideo(ivf ivfReader, videoTrack videoMediaTrack, timebaseNum, timebaseDenom float32, source io.Reader, uArgs userArguments) {
+	// send video spaced out by its timestamps -- this makes sending less lossy
 	defer fmt.Println("")
-	sleepTime := time.Millisecond * time.Duration((timebaseNum/timebaseDenom)*1000)
+	pacer := newFramePacer(timebaseNum, timebaseDenom, uArgs.videoIsLive)
+	pacer.setBudget(uArgs.latencyBudget)
+
+	queue := newFrameQueue()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		sendFrames(queue, videoTrack, pacer, uArgs.latencyBudget)
+	}()
+	defer func() {
+		queue.close()
+		<-sent
+	}()
+
+	ivfFile, canSeek := source.(io.Seeker)
 	for {
-		frame, _, ivfErr := ivf.ParseNextFrame()
-		if ivfErr != nil && uArgs.videoIsLive {
+		frame, header, ivfErr := ivf.ParseNextFrame()
+		if ivfErr != nil && uArgs.videoIsLive && canSeek { // a file still being written
 			ivf.ResetReader(func(bytesRead int64) io.Reader {
 				ivfFile.Seek(bytesRead, io.SeekStart)
-				return ivfFile
+				return source
 			})
 
 			continue
-		} else if ivfErr != nil && !uArgs.videoIsLive {
+		} else if ivfErr != nil {
 			fmt.Println("")
 			return
 		}
 
-		time.Sleep(sleepTime)
-		if ivfErr = videoTrack.WriteSample(media.Sample{Data: frame, Samples: 90000}); ivfErr != nil {
-			continue
-		}
-
-		fmt.Print("=")
+		queue.push(queuedFrame{
+			data:      frame,
+			timestamp: header.Timestamp,
+			keyframe:  isKeyframe(uArgs.videoCodec, frame),
+			received:  time.Now(),
+		})
 	}
 }
 
@@ -195,42 +247,53 @@ func grabIvfUtilsWithDelay(uArgs userArguments, maxTries int, sleepFor time.Dura
 	return ivf, header, file, nil
 }
 
-func videoControl(videoTrack videoMediaTrack, ivfFilePath string, uArgs userArguments) error {
-	// Open a IVF file and start reading using our IVFReader
-	execStream, err := composeStreamCommand(uArgs.inputVideoPath, uArgs.operatingSys, uArgs.inputResolution)
+// videoControl streams into videoTrack until the source ends or stop is closed
+func videoControl(videoTrack videoMediaTrack, ivfFilePath string, uArgs userArguments, stop <-chan struct{}) error {
+	execStream, err := composeStreamCommand(uArgs.inputVideoPath, uArgs.operatingSys, uArgs.inputResolution, uArgs.videoCodec, uArgs.encoder)
 	if err != nil {
 		return err
 	}
+	execStream.Stderr = uArgs.ffmpegStderr
 
-	execStream.Start()
-	defer func() {
-		if execStream.Process != nil {
-			execStream.Process.Kill()
+	if !uArgs.videoIsLive { // replaying an IVF file, so there is nothing to capture
+		ivf, header, file, err := grabIvfUtilsWithDelay(uArgs, 1, 0)
+		if err != nil {
+			return err
 		}
-	}()
+		defer file.Close()
+		defer closeOnStop(stop, file)()
 
-	defer cleanUpIvfFile()
+		streamVideo(ivf, videoTrack, float32(header.TimebaseNumerator), float32(header.TimebaseDenominator), file, uArgs)
 
-	const sleepDuration = 2
-	ivf, header, file, _ := grabIvfUtilsWithDelay(uArgs, doNotTimeOut, sleepDuration)
-
-	// Send our video file one frame at a time
-	streamVideo(ivf, videoTrack, float32(header.TimebaseNumerator), float32(header.TimebaseDenominator), file, uArgs)
+		return nil
+	}
 
-	return nil
-}
+	// ffmpeg writes the encoded video to its stdout, which we read directly
+	ivf, header, stdout, err := startVideoPipe(execStream, uArgs.videoCodec)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	defer closeOnStop(stop, stdout)() // closing the pipe kills ffmpeg
 
-func run(args userArguments) (string, error) {
+	// Send our video stream one frame at a time
+	streamVideo(ivf, videoTrack, float32(header.TimebaseNumerator), float32(header.TimebaseDenominator), stdout, uArgs)
 
-	if args.runCleanup {
-		cleanUpIvfFile()
+	// the stream only ends early when ffmpeg exits, usually because the
+	// capture device went away
+	if err = stdout.Close(); err != nil && !isClosed(stop) {
+		return fmt.Errorf("ffmpeg exited: %s", err)
 	}
 
+	return nil
+}
+
+func run(args userArguments) (ssdp, error) {
 	offer := webrtc.SessionDescription{}
 	err := signal.Decode(args.sessionDescription, &offer)
 
 	if err != nil {
-		return "", fmt.Errorf("decode error: %s", err)
+		return ssdp{}, sdpError{category: sdpDecodeError, err: fmt.Errorf("decode error: %s", err)}
 	}
 
 	// We make our own mediaEngine so we can place the sender's codecs in it.  This because we must use the
@@ -238,77 +301,196 @@ func run(args userArguments) (string, error) {
 	mediaEngine := webrtc.MediaEngine{}
 	err = mediaEngine.PopulateFromSDP(offer)
 	if err != nil {
-		return "", fmt.Errorf("start media engine error: %s", err)
+		return ssdp{}, sdpError{category: sdpDecodeError, err: fmt.Errorf("start media engine error: %s", err)}
 	}
 
-	// Search for VP8 Payload type. If the offer doesn't support VP8 exit since
-	// since they won't be able to decode anything we send them
-	var payloadType uint8
-	for _, videoCodec := range mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeVideo) {
-		if videoCodec.Name == "VP8" {
-			payloadType = videoCodec.PayloadType
-			break
-		}
+	// Pick the codec we'll encode in. If the offer has nothing we can send
+	// there's no point connecting, since the browser can't decode anything.
+	videoCodec, err := negotiateVideoCodec(mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeVideo))
+	if err != nil {
+		return ssdp{}, err
+	}
+	args.videoCodec = videoCodec.Name
+	if args.adaptiveBitrate {
+		acceptREMB(videoCodec)
 	}
 
+	// With trickle on, candidates are gathered after the answer is sent and
+	// the browser collects them from /api/sessions/{id}/candidates
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetTrickle(args.trickleICE)
+
 	// Create a new RTCPeerConnection
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine))
 	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{args.stunServers},
-			},
-		},
+		ICEServers: args.iceServers,
 	})
 	if err != nil {
-		return "", err
+		return ssdp{}, err
 	}
 
-	// Create a video track
-	videoTrack, err := peerConnection.NewTrack(payloadType, rand.Uint32(), "video", "pion")
+	// One video track per feed asked for, each in its own section of the offer
+	feeds, err := requestedSources(args, offer.SDP)
 	if err != nil {
-		return "", err
+		return ssdp{}, err
 	}
-	if _, err = peerConnection.AddTrack(videoTrack); err != nil {
-		return "", err
+
+	session := newViewerSession(peerConnection)
+	session.codec = args.videoCodec
+	session.args = args
+	session.owner = identity{Name: args.viewerName, Role: args.viewerRole}
+	session.release = func() {
+		session.detachFeeds()
+		session.detachAudio()
+		talkbacks.leave(session.id)
 	}
+	defer func() {
+		if err != nil { // negotiation failed, so this viewer will never connect
+			session.close()
+		}
+	}()
 
-	go videoControl(videoTrack, ivfFileHandle, args)
+	senders := []*webrtc.RTPSender{}
+	tracks := []*webrtc.Track{}
+	for _, src := range feeds {
+		var videoTrack *webrtc.Track
+		videoTrack, err = peerConnection.NewTrack(videoCodec.PayloadType, rand.Uint32(), src.Name, "pion")
+		if err != nil {
+			return ssdp{}, err
+		}
+
+		var sender *webrtc.RTPSender
+		if sender, err = peerConnection.AddTrack(videoTrack); err != nil {
+			return ssdp{}, err
+		}
+		senders = append(senders, sender)
+		tracks = append(tracks, videoTrack)
+
+		// Every viewer of a device in the same codec shares one capture pipeline
+		session.attachFeed(videoTrack, src)
+	}
+
+	// Narration goes in one audio track, shared like the video
+	if err = session.addAudioTrack(mediaEngine); err != nil {
+		return ssdp{}, err
+	}
+
+	// Viewers allowed to can talk back, and hear each other
+	if err = session.addTalkback(mediaEngine, talkbacks); err != nil {
+		return ssdp{}, err
+	}
+
+	// RTCP only flows once connected, and a sender that never sent can't be
+	// read from without blocking forever
+	if args.adaptiveBitrate {
+		session.connected = func() {
+			for i, sender := range senders {
+				go session.watchFeedback(i, sender, tracks[i].SSRC())
+			}
+		}
+	}
+
+	// Control messages go over a data channel when the page opened one
+	if offersDataChannel(offer.SDP) {
+		if err = session.openControlChannel(events); err != nil {
+			return ssdp{}, err
+		}
+	}
+
+	peerConnection.OnICECandidate(session.onLocalCandidate)
 
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		fmt.Printf("\nConnection State has changed %s \n", connectionState.String())
+
+		sessions.onStateChange(session, connectionState)
 	})
 
 	// Set the remote SessionDescription
 	if err = peerConnection.SetRemoteDescription(offer); err != nil {
-		return "", err
+		return ssdp{}, err
 	}
 
 	// Create answer
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
-		return "", err
+		return ssdp{}, err
 	}
 
 	// Sets the LocalDescription, and starts our UDP listeners
 	if err = peerConnection.SetLocalDescription(answer); err != nil {
-		return "", err
+		return ssdp{}, err
 	}
 
+	sessions.add(session)
+
 	// Output the answer in base64 so we can paste it in browser
 	localSdp := signal.Encode(answer)
 
-	return localSdp, nil
+	return ssdp{ServerSdp: localSdp, SessionID: session.id}, nil
+}
+
+type sdpErrorCategory string
+
+const (
+	sdpDecodeError   sdpErrorCategory = "decode"
+	sdpCodecError    sdpErrorCategory = "codec"
+	sdpInternalError sdpErrorCategory = "internal"
+)
+
+// sdpError says which part of the SDP exchange failed, so the browser can
+// tell a bad request from a codec mismatch from our own fault
+type sdpError struct {
+	category sdpErrorCategory
+	err      error
+}
+
+func (e sdpError) Error() string {
+	return e.err.Error()
+}
+
+func (e sdpError) status() int {
+	switch e.category {
+	case sdpDecodeError:
+		return http.StatusBadRequest
+	case sdpCodecError:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type sdpErrorBody struct {
+	Error    string
+	Category sdpErrorCategory
+}
+
+// asSdpError leaves categorised errors alone and files the rest under category
+func asSdpError(err error, category sdpErrorCategory) sdpError {
+	var e sdpError
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return sdpError{category: category, err: err}
+}
+
+func writeSdpError(w http.ResponseWriter, err error) {
+	e := asSdpError(err, sdpInternalError)
+	writeJSON(w, e.status(), sdpErrorBody{Error: e.Error(), Category: e.category})
 }
 
 type bsdp struct {
 	BrowserSdp string
+	Trickle    bool     // the browser will exchange candidates separately
+	Feeds      []string // source names, one per video section; the first source if empty
+	NoAudio    bool     // leave the audio out of this session
 }
 
 type ssdp struct {
 	ServerSdp string
+	SessionID string
 }
 
 func getBrowserSdp(w http.ResponseWriter, r *http.Request, args userArguments) error {
@@ -316,37 +498,103 @@ func getBrowserSdp(w http.ResponseWriter, r *http.Request, args userArguments) e
 	b, _ := ioutil.ReadAll(r.Body)
 	err := json.Unmarshal(b, &s)
 	if err != nil {
-		return fmt.Errorf("unmarhsal POST error: %s\n", err)
+		return sdpError{category: sdpDecodeError, err: fmt.Errorf("unmarshal POST error: %s", err)}
 	}
 
 	args.sessionDescription = s.BrowserSdp
-	localSdp, err := run(args)
+	args.trickleICE = s.Trickle
+	args.feeds = s.Feeds
+	if s.NoAudio {
+		args.audioDevice = ""
+	}
+	args.viewerRole = identityFrom(r.Context()).Role
+	args.viewerName = identityFrom(r.Context()).Name
+	answer, err := run(args)
 	if err != nil {
-		return fmt.Errorf("run setup error: %s\n", err)
+		e := asSdpError(err, sdpInternalError)
+		e.err = fmt.Errorf("run setup error: %s", e.err)
+		return e
 	}
 
-	json.NewEncoder(w).Encode(&ssdp{ServerSdp: localSdp})
+	json.NewEncoder(w).Encode(&answer)
 
 	return nil
 }
 
-func registerFrontEndHandlers(uArgs userArguments) {
-	http.Handle("/", http.FileServer(http.Dir("../frontend/build")))
-	http.HandleFunc("/browsersdp", func(w http.ResponseWriter, r *http.Request) {
-		err := getBrowserSdp(w, r, uArgs)
-		if err != nil {
+// browserSdpHandler answers a browser's offer. A bad offer only fails that
+// request; everyone already watching keeps their stream.
+func browserSdpHandler(uArgs userArguments) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := getBrowserSdp(w, r, uArgs); err != nil {
 			fmt.Printf("error: %s\n", err)
-			os.Exit(1)
+			writeSdpError(w, err)
 		}
+	}
+}
+
+// registerFrontEndHandlers sets up every route and returns the handler to
+// serve, which checks each request's role first
+func registerFrontEndHandlers(uArgs userArguments) http.Handler {
+	http.Handle("/", http.FileServer(http.Dir(uArgs.frontendDir)))
+	http.HandleFunc("/browsersdp", browserSdpHandler(uArgs))
+
+	registerRecordingHandlers(newRecordingManager(uArgs.recordingDir), uArgs)
+
+	steps, err := loadStepStore(uArgs.stepsFile)
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
+	hub := events
+	registerEventHandlers(hub)
+	registerStepHandlers(steps, hub)
+
+	annotations, err := loadAnnotationStore(uArgs.annotationsFile)
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
+	registerAnnotationHandlers(annotationService{store: annotations, hub: hub})
+	snapshots := newSnapshotStore(uArgs.snapshotDir)
+	registerSnapshotHandlers(snapshotService{
+		store:     snapshots,
+		steps:     steps,
+		hub:       hub,
+		pipelines: broadcasters,
+		uArgs:     uArgs,
 	})
+	registerPresentationHandlers(newPresentation(hub, snapshots))
+	registerPipelineHandlers(broadcasters, hub)
 
+	registerSessionHandlers(sessions)
+	registerControlHandlers(sessions, hub)
+	registerTalkbackHandlers(talkbacks)
+	registerICEHandlers(uArgs)
+	registerSourceHandlers(uArgs)
+	registerDeviceHandlers(uArgs)
+
+	users, err := loadAuthStore(uArgs.auth.UsersFile)
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
+	auth := newAuthenticator(uArgs.auth, users, uArgs.tls.enabled())
+	registerAuthHandlers(auth)
+
+	return auth.wrap(http.DefaultServeMux)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "list-devices" {
+		os.Exit(listDevicesCommand(runtime.GOOS, os.Stdout))
+	}
 
 	args := parseArgs()
 
-	registerFrontEndHandlers(args)
+	handler := registerFrontEndHandlers(args)
 
-	http.ListenAndServe(args.serveOn, nil)
+	if err := serve(args, handler); err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
 }
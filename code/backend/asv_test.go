@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,9 @@ import (
 	"strings"
 	"testing"
 
+	"atn/code/backend/internal/signal"
+
+	"github.com/pion/webrtc/v2"
 	"github.com/pion/webrtc/v2/pkg/media"
 	"github.com/pion/webrtc/v2/pkg/media/ivfreader"
 )
@@ -17,17 +21,10 @@ import (
 const (
 	testIvfFile = "test_data.ivf"
 	brokenData  = "broken_data.ivf"
-)
-
-func TestCleanUpIvfFile(t *testing.T) {
-	os.Create(ivfFileHandle)
 
-	cleanUpIvfFile()
-
-	if os.Remove(ivfFileHandle) == nil {
-		t.Error("os.Remove(ivfFileHandle) didn't return an error; cleanup failed")
-	}
-}
+	// a Firefox offer for one sendrecv VP8/VP9 video transceiver
+	testOffer = "eyJ0eXBlIjoib2ZmZXIiLCJzZHAiOiJ2PTBcclxubz1tb3ppbGxhLi4uVEhJU19JU19TRFBBUlRBLTcyLjAuMSA0MzU3NzU1ODA1NzczMjE3MTAgMCBJTiBJUDQgMC4wLjAuMFxyXG5zPS1cclxudD0wIDBcclxuYT1zZW5kcmVjdlxyXG5hPWZpbmdlcnByaW50OnNoYS0yNTYgMTI6NUE6RkI6Qjc6N0U6ODY6QkM6RjA6RTI6OTU6QjQ6Q0Y6QTA6QUM6RDY6QzQ6QkM6REY6MUE6NDQ6NEE6OEY6RkY6RDE6NDA6MEY6RTI6RDA6Mjg6NjU6Rjk6QTlcclxuYT1ncm91cDpCVU5ETEUgMFxyXG5hPWljZS1vcHRpb25zOnRyaWNrbGVcclxuYT1tc2lkLXNlbWFudGljOldNUyAqXHJcbm09dmlkZW8gNTQ0NDEgVURQL1RMUy9SVFAvU0FWUEYgMTIwIDEyMVxyXG5jPUlOIElQNCA5OC4yMDAuMjQzLjE1MVxyXG5hPWNhbmRpZGF0ZTowIDEgVURQIDIxMjIyNTI1NDMgMTkyLjE2OC4wLjExMiA1NDQ0MSB0eXAgaG9zdFxyXG5hPWNhbmRpZGF0ZToyIDEgVENQIDIxMDU1MjQ0NzkgMTkyLjE2OC4wLjExMiA5IHR5cCBob3N0IHRjcHR5cGUgYWN0aXZlXHJcbmE9Y2FuZGlkYXRlOjAgMiBVRFAgMjEyMjI1MjU0MiAxOTIuMTY4LjAuMTEyIDQ4MjU4IHR5cCBob3N0XHJcbmE9Y2FuZGlkYXRlOjIgMiBUQ1AgMjEwNTUyNDQ3OCAxOTIuMTY4LjAuMTEyIDkgdHlwIGhvc3QgdGNwdHlwZSBhY3RpdmVcclxuYT1jYW5kaWRhdGU6MSAxIFVEUCAxNjg2MDUyODYzIDk4LjIwMC4yNDMuMTUxIDU0NDQxIHR5cCBzcmZseCByYWRkciAxOTIuMTY4LjAuMTEyIHJwb3J0IDU0NDQxXHJcbmE9Y2FuZGlkYXRlOjEgMiBVRFAgMTY4NjA1Mjg2MiA5OC4yMDAuMjQzLjE1MSA0ODI1OCB0eXAgc3JmbHggcmFkZHIgMTkyLjE2OC4wLjExMiBycG9ydCA0ODI1OFxyXG5hPXNlbmRyZWN2XHJcbmE9ZW5kLW9mLWNhbmRpZGF0ZXNcclxuYT1leHRtYXA6MyB1cm46aWV0ZjpwYXJhbXM6cnRwLWhkcmV4dDpzZGVzOm1pZFxyXG5hPWV4dG1hcDo0IGh0dHA6Ly93d3cud2VicnRjLm9yZy9leHBlcmltZW50cy9ydHAtaGRyZXh0L2Ficy1zZW5kLXRpbWVcclxuYT1leHRtYXA6NSB1cm46aWV0ZjpwYXJhbXM6cnRwLWhkcmV4dDp0b2Zmc2V0XHJcbmE9ZXh0bWFwOjYvcmVjdm9ubHkgaHR0cDovL3d3dy53ZWJydGMub3JnL2V4cGVyaW1lbnRzL3J0cC1oZHJleHQvcGxheW91dC1kZWxheVxyXG5hPWZtdHA6MTIwIG1heC1mcz0xMjI4ODttYXgtZnI9NjBcclxuYT1mbXRwOjEyMSBtYXgtZnM9MTIyODg7bWF4LWZyPTYwXHJcbmE9aWNlLXB3ZDozMmE5NDcyZWVlMTllMmRiM2QwNmI0ODA5NWFmYTk1ZFxyXG5hPWljZS11ZnJhZzo3NGRjMDdiNVxyXG5hPW1pZDowXHJcbmE9bXNpZDotIHtkZTMwMmU5Yi1mYTE2LTQ2NzYtOGNjMy1hMDg2ZjljOWExYWJ9XHJcbmE9cnRjcDo0ODI1OCBJTiBJUDQgOTguMjAwLjI0My4xNTFcclxuYT1ydGNwLWZiOjEyMCBuYWNrXHJcbmE9cnRjcC1mYjoxMjAgbmFjayBwbGlcclxuYT1ydGNwLWZiOjEyMCBjY20gZmlyXHJcbmE9cnRjcC1mYjoxMjAgZ29vZy1yZW1iXHJcbmE9cnRjcC1mYjoxMjEgbmFja1xyXG5hPXJ0Y3AtZmI6MTIxIG5hY2sgcGxpXHJcbmE9cnRjcC1mYjoxMjEgY2NtIGZpclxyXG5hPXJ0Y3AtZmI6MTIxIGdvb2ctcmVtYlxyXG5hPXJ0Y3AtbXV4XHJcbmE9cnRwbWFwOjEyMCBWUDgvOTAwMDBcclxuYT1ydHBtYXA6MTIxIFZQOS85MDAwMFxyXG5hPXNldHVwOmFjdHBhc3NcclxuYT1zc3JjOjQ1NjIyNTg3NiBjbmFtZTp7YjdlNjVmZDYtYjA1OC00NDcwLTg5ZDItYjU4ODBlODUwMGE4fVxyXG4ifQ=="
+)
 
 func TestRetrieveIvfFile(t *testing.T) {
 	_, err := retrieveIvfFile("not_a_real_file", 2)
@@ -77,7 +74,7 @@ func checkEq(one, two []string) error {
 }
 
 func TestComposeStreamCommandMac(t *testing.T) {
-	mac, err := composeStreamCommand("device", osMac, "1920x1080")
+	mac, err := composeStreamCommand("device", osMac, "1920x1080", webrtc.VP8, encoderSettings{})
 	if err != nil {
 		t.Errorf("%s", err)
 	}
@@ -93,7 +90,8 @@ func TestComposeStreamCommandMac(t *testing.T) {
 		"1920x1080", "-r", "30", "-i", "device",
 		"-pix_fmt", "yuv420p", "-g", "1", "-deadline",
 		"realtime", "-speed", "16", "-b", "3000k",
-		"-an", ivfFileHandle}
+		"-an", "-force_key_frames", "expr:gte(t,n_forced*2)",
+		"-f", "ivf", stdoutPipeTarget}
 
 	if err = checkEq(mac.Args, expectedCommand); err != nil {
 		t.Errorf("command for %s is wrong; %s", osMac, err)
@@ -102,7 +100,7 @@ func TestComposeStreamCommandMac(t *testing.T) {
 }
 
 func TestComposeStreamCommandWindows(t *testing.T) {
-	windows, err := composeStreamCommand("device", osWindows, "1920x1080")
+	windows, err := composeStreamCommand("device", osWindows, "1920x1080", webrtc.VP8, encoderSettings{})
 	if err != nil {
 		t.Errorf("%s", err)
 	}
@@ -116,7 +114,8 @@ func TestComposeStreamCommandWindows(t *testing.T) {
 	expectedCommand := []string{"ffmpeg", "-threads", "4", "-y",
 		"-f", driver, "-s", "1920x1080", "-i",
 		"device", "-g", "30", "-deadline",
-		"realtime", ivfFileHandle}
+		"realtime", "-force_key_frames", "expr:gte(t,n_forced*2)",
+		"-f", "ivf", stdoutPipeTarget}
 
 	if err = checkEq(windows.Args, expectedCommand); err != nil {
 		t.Errorf("command for %s is wrong; %s", osWindows, err)
@@ -125,7 +124,7 @@ func TestComposeStreamCommandWindows(t *testing.T) {
 }
 
 func TestComposeStreamCommandLinux(t *testing.T) {
-	linux, err := composeStreamCommand("device", osLinux, "1920x1080")
+	linux, err := composeStreamCommand("device", osLinux, "1920x1080", webrtc.VP8, encoderSettings{})
 	if err != nil {
 		t.Errorf("%s", err)
 	}
@@ -139,7 +138,8 @@ func TestComposeStreamCommandLinux(t *testing.T) {
 	expectedCommand := []string{"ffmpeg", "-threads", "4", "-y",
 		"-f", driver, "-s", "1920x1080", "-i",
 		"device", "-g", "30", "-deadline",
-		"realtime", ivfFileHandle}
+		"realtime", "-force_key_frames", "expr:gte(t,n_forced*2)",
+		"-f", "ivf", stdoutPipeTarget}
 
 	if err = checkEq(linux.Args, expectedCommand); err != nil {
 		t.Errorf("command for %s is wrong; %s", osLinux, err)
@@ -147,7 +147,7 @@ func TestComposeStreamCommandLinux(t *testing.T) {
 }
 
 func TestComposeStreamCommandFailure(t *testing.T) {
-	badCommand, err := composeStreamCommand("device", "not a platform", "1920x1080")
+	badCommand, err := composeStreamCommand("device", "not a platform", "1920x1080", webrtc.VP8, encoderSettings{})
 	if err == nil {
 		t.Errorf("invalid platform allowed in command: %s", badCommand.Args)
 	}
@@ -173,19 +173,20 @@ func TestVideoControl(t *testing.T) {
 	madeUpArgs.inputResolution = "1920x1080"
 	madeUpArgs.ivfHandle = testIvfFile
 	madeUpArgs.videoIsLive = false
+	madeUpArgs.videoCodec = webrtc.VP8
 
-	err := videoControl(mockVideoTrackReturningNil{}, testIvfFile, madeUpArgs)
+	err := videoControl(mockVideoTrackReturningNil{}, testIvfFile, madeUpArgs, nil)
 	if err != nil {
 		t.Errorf("videoControl failed with %s", err)
 	}
 
-	err = videoControl(mockVideoTrackReturningError{}, testIvfFile, madeUpArgs)
+	err = videoControl(mockVideoTrackReturningError{}, testIvfFile, madeUpArgs, nil)
 	if err != nil {
 		t.Errorf("videoControl failed with %s", err)
 	}
 
 	madeUpArgs.operatingSys = "not a real device"
-	err = videoControl(mockVideoTrackReturningError{}, testIvfFile, madeUpArgs)
+	err = videoControl(mockVideoTrackReturningError{}, testIvfFile, madeUpArgs, nil)
 	if err == nil {
 		t.Errorf("videoControl passed with fake device named: %s", madeUpArgs.operatingSys)
 	}
@@ -251,7 +252,7 @@ func TestRun(t *testing.T) {
 		videoIsLive:        true,
 		operatingSys:       osLinux,
 		ivfHandle:          testIvfFile,
-		stunServers:        "stun:stun.l.google.com:19302",
+		iceServers:         []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
 	}
 
 	_, err := run(mockArgs)
@@ -266,7 +267,7 @@ func TestRun(t *testing.T) {
 	}
 
 	mockArgs.sessionDescription = validSessionDescription
-	mockArgs.stunServers = ""
+	mockArgs.iceServers = []webrtc.ICEServer{{URLs: []string{""}}}
 	_, err = run(mockArgs)
 	if err == nil {
 		t.Errorf("run passed but should have failed, stunServer")
@@ -306,7 +307,7 @@ func TestRegisterFrontEndHandlers(t *testing.T) {
 		videoIsLive:        true,
 		operatingSys:       osLinux,
 		ivfHandle:          testIvfFile,
-		stunServers:        "stun:stun.l.google.com:19302",
+		iceServers:         []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
 	}
 
 	registerFrontEndHandlers(mockArgs)
@@ -321,7 +322,7 @@ func TestGetBrowserSdp(t *testing.T) {
 		videoIsLive:        true,
 		operatingSys:       osLinux,
 		ivfHandle:          testIvfFile,
-		stunServers:        "stun:stun.l.google.com:19302",
+		iceServers:         []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
 	}
 
 	validSessionDescription := "{\"BrowserSdp\": \"eyJ0eXBlIjoib2ZmZXIiLCJzZHAiOiJ2PTBcclxubz1tb3ppbGxhLi4uVEhJU19JU19TRFBBUlRBLTcyLjAuMSA0MzU3NzU1ODA1NzczMjE3MTAgMCBJTiBJUDQgMC4wLjAuMFxyXG5zPS1cclxudD0wIDBcclxuYT1zZW5kcmVjdlxyXG5hPWZpbmdlcnByaW50OnNoYS0yNTYgMTI6NUE6RkI6Qjc6N0U6ODY6QkM6RjA6RTI6OTU6QjQ6Q0Y6QTA6QUM6RDY6QzQ6QkM6REY6MUE6NDQ6NEE6OEY6RkY6RDE6NDA6MEY6RTI6RDA6Mjg6NjU6Rjk6QTlcclxuYT1ncm91cDpCVU5ETEUgMFxyXG5hPWljZS1vcHRpb25zOnRyaWNrbGVcclxuYT1tc2lkLXNlbWFudGljOldNUyAqXHJcbm09dmlkZW8gNTQ0NDEgVURQL1RMUy9SVFAvU0FWUEYgMTIwIDEyMVxyXG5jPUlOIElQNCA5OC4yMDAuMjQzLjE1MVxyXG5hPWNhbmRpZGF0ZTowIDEgVURQIDIxMjIyNTI1NDMgMTkyLjE2OC4wLjExMiA1NDQ0MSB0eXAgaG9zdFxyXG5hPWNhbmRpZGF0ZToyIDEgVENQIDIxMDU1MjQ0NzkgMTkyLjE2OC4wLjExMiA5IHR5cCBob3N0IHRjcHR5cGUgYWN0aXZlXHJcbmE9Y2FuZGlkYXRlOjAgMiBVRFAgMjEyMjI1MjU0MiAxOTIuMTY4LjAuMTEyIDQ4MjU4IHR5cCBob3N0XHJcbmE9Y2FuZGlkYXRlOjIgMiBUQ1AgMjEwNTUyNDQ3OCAxOTIuMTY4LjAuMTEyIDkgdHlwIGhvc3QgdGNwdHlwZSBhY3RpdmVcclxuYT1jYW5kaWRhdGU6MSAxIFVEUCAxNjg2MDUyODYzIDk4LjIwMC4yNDMuMTUxIDU0NDQxIHR5cCBzcmZseCByYWRkciAxOTIuMTY4LjAuMTEyIHJwb3J0IDU0NDQxXHJcbmE9Y2FuZGlkYXRlOjEgMiBVRFAgMTY4NjA1Mjg2MiA5OC4yMDAuMjQzLjE1MSA0ODI1OCB0eXAgc3JmbHggcmFkZHIgMTkyLjE2OC4wLjExMiBycG9ydCA0ODI1OFxyXG5hPXNlbmRyZWN2XHJcbmE9ZW5kLW9mLWNhbmRpZGF0ZXNcclxuYT1leHRtYXA6MyB1cm46aWV0ZjpwYXJhbXM6cnRwLWhkcmV4dDpzZGVzOm1pZFxyXG5hPWV4dG1hcDo0IGh0dHA6Ly93d3cud2VicnRjLm9yZy9leHBlcmltZW50cy9ydHAtaGRyZXh0L2Ficy1zZW5kLXRpbWVcclxuYT1leHRtYXA6NSB1cm46aWV0ZjpwYXJhbXM6cnRwLWhkcmV4dDp0b2Zmc2V0XHJcbmE9ZXh0bWFwOjYvcmVjdm9ubHkgaHR0cDovL3d3dy53ZWJydGMub3JnL2V4cGVyaW1lbnRzL3J0cC1oZHJleHQvcGxheW91dC1kZWxheVxyXG5hPWZtdHA6MTIwIG1heC1mcz0xMjI4ODttYXgtZnI9NjBcclxuYT1mbXRwOjEyMSBtYXgtZnM9MTIyODg7bWF4LWZyPTYwXHJcbmE9aWNlLXB3ZDozMmE5NDcyZWVlMTllMmRiM2QwNmI0ODA5NWFmYTk1ZFxyXG5hPWljZS11ZnJhZzo3NGRjMDdiNVxyXG5hPW1pZDowXHJcbmE9bXNpZDotIHtkZTMwMmU5Yi1mYTE2LTQ2NzYtOGNjMy1hMDg2ZjljOWExYWJ9XHJcbmE9cnRjcDo0ODI1OCBJTiBJUDQgOTguMjAwLjI0My4xNTFcclxuYT1ydGNwLWZiOjEyMCBuYWNrXHJcbmE9cnRjcC1mYjoxMjAgbmFjayBwbGlcclxuYT1ydGNwLWZiOjEyMCBjY20gZmlyXHJcbmE9cnRjcC1mYjoxMjAgZ29vZy1yZW1iXHJcbmE9cnRjcC1mYjoxMjEgbmFja1xyXG5hPXJ0Y3AtZmI6MTIxIG5hY2sgcGxpXHJcbmE9cnRjcC1mYjoxMjEgY2NtIGZpclxyXG5hPXJ0Y3AtZmI6MTIxIGdvb2ctcmVtYlxyXG5hPXJ0Y3AtbXV4XHJcbmE9cnRwbWFwOjEyMCBWUDgvOTAwMDBcclxuYT1ydHBtYXA6MTIxIFZQOS85MDAwMFxyXG5hPXNldHVwOmFjdHBhc3NcclxuYT1zc3JjOjQ1NjIyNTg3NiBjbmFtZTp7YjdlNjVmZDYtYjA1OC00NDcwLTg5ZDItYjU4ODBlODUwMGE4fVxyXG4ifQ==\"}"
@@ -353,7 +354,7 @@ func TestGetBrowserSdpInvalidInputs(t *testing.T) {
 		videoIsLive:        true,
 		operatingSys:       osLinux,
 		ivfHandle:          testIvfFile,
-		stunServers:        "stun:stun.l.google.com:19302",
+		iceServers:         []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
 	}
 
 	validSessionDescription := "{\"BrowserSdp\": \"eyJ0eXBlIjoib2ZmZXIiLCJzZHAiOiJ2PTBcclxubz1tb3ppbGxhLi4uVEhJU19JU19TRFBBUlRBLTcyLjAuMSA0MzU3NzU1ODA1NzczMjE3MTAgMCBJTiBJUDQgMC4wLjAuMFxyXG5zPS1cclxudD0wIDBcclxuYT1zZW5kcmVjdlxyXG5hPWZpbmdlcnByaW50OnNoYS0yNTYgMTI6NUE6RkI6Qjc6N0U6ODY6QkM6RjA6RTI6OTU6QjQ6Q0Y6QTA6QUM6RDY6QzQ6QkM6REY6MUE6NDQ6NEE6OEY6RkY6RDE6NDA6MEY6RTI6RDA6Mjg6NjU6Rjk6QTlcclxuYT1ncm91cDpCVU5ETEUgMFxyXG5hPWljZS1vcHRpb25zOnRyaWNrbGVcclxuYT1tc2lkLXNlbWFudGljOldNUyAqXHJcbm09dmlkZW8gNTQ0NDEgVURQL1RMUy9SVFAvU0FWUEYgMTIwIDEyMVxyXG5jPUlOIElQNCA5OC4yMDAuMjQzLjE1MVxyXG5hPWNhbmRpZGF0ZTowIDEgVURQIDIxMjIyNTI1NDMgMTkyLjE2OC4wLjExMiA1NDQ0MSB0eXAgaG9zdFxyXG5hPWNhbmRpZGF0ZToyIDEgVENQIDIxMDU1MjQ0NzkgMTkyLjE2OC4wLjExMiA5IHR5cCBob3N0IHRjcHR5cGUgYWN0aXZlXHJcbmE9Y2FuZGlkYXRlOjAgMiBVRFAgMjEyMjI1MjU0MiAxOTIuMTY4LjAuMTEyIDQ4MjU4IHR5cCBob3N0XHJcbmE9Y2FuZGlkYXRlOjIgMiBUQ1AgMjEwNTUyNDQ3OCAxOTIuMTY4LjAuMTEyIDkgdHlwIGhvc3QgdGNwdHlwZSBhY3RpdmVcclxuYT1jYW5kaWRhdGU6MSAxIFVEUCAxNjg2MDUyODYzIDk4LjIwMC4yNDMuMTUxIDU0NDQxIHR5cCBzcmZseCByYWRkciAxOTIuMTY4LjAuMTEyIHJwb3J0IDU0NDQxXHJcbmE9Y2FuZGlkYXRlOjEgMiBVRFAgMTY4NjA1Mjg2MiA5OC4yMDAuMjQzLjE1MSA0ODI1OCB0eXAgc3JmbHggcmFkZHIgMTkyLjE2OC4wLjExMiBycG9ydCA0ODI1OFxyXG5hPXNlbmRyZWN2XHJcbmE9ZW5kLW9mLWNhbmRpZGF0ZXNcclxuYT1leHRtYXA6MyB1cm46aWV0ZjpwYXJhbXM6cnRwLWhkcmV4dDpzZGVzOm1pZFxyXG5hPWV4dG1hcDo0IGh0dHA6Ly93d3cud2VicnRjLm9yZy9leHBlcmltZW50cy9ydHAtaGRyZXh0L2Ficy1zZW5kLXRpbWVcclxuYT1leHRtYXA6NSB1cm46aWV0ZjpwYXJhbXM6cnRwLWhkcmV4dDp0b2Zmc2V0XHJcbmE9ZXh0bWFwOjYvcmVjdm9ubHkgaHR0cDovL3d3dy53ZWJydGMub3JnL2V4cGVyaW1lbnRzL3J0cC1oZHJleHQvcGxheW91dC1kZWxheVxyXG5hPWZtdHA6MTIwIG1heC1mcz0xMjI4ODttYXgtZnI9NjBcclxuYT1mbXRwOjEyMSBtYXgtZnM9MTIyODg7bWF4LWZyPTYwXHJcbmE9aWNlLXB3ZDozMmE5NDcyZWVlMTllMmRiM2QwNmI0ODA5NWFmYTk1ZFxyXG5hPWljZS11ZnJhZzo3NGRjMDdiNVxyXG5hPW1pZDowXHJcbmE9bXNpZDotIHtkZTMwMmU5Yi1mYTE2LTQ2NzYtOGNjMy1hMDg2ZjljOWExYWJ9XHJcbmE9cnRjcDo0ODI1OCBJTiBJUDQgOTguMjAwLjI0My4xNTFcclxuYT1ydGNwLWZiOjEyMCBuYWNrXHJcbmE9cnRjcC1mYjoxMjAgbmFjayBwbGlcclxuYT1ydGNwLWZiOjEyMCBjY20gZmlyXHJcbmE9cnRjcC1mYjoxMjAgZ29vZy1yZW1iXHJcbmE9cnRjcC1mYjoxMjEgbmFja1xyXG5hPXJ0Y3AtZmI6MTIxIG5hY2sgcGxpXHJcbmE9cnRjcC1mYjoxMjEgY2NtIGZpclxyXG5hPXJ0Y3AtZmI6MTIxIGdvb2ctcmVtYlxyXG5hPXJ0Y3AtbXV4XHJcbmE9cnRwbWFwOjEyMCBWUDgvOTAwMDBcclxuYT1ydHBtYXA6MTIxIFZQOS85MDAwMFxyXG5hPXNldHVwOmFjdHBhc3NcclxuYT1zc3JjOjQ1NjIyNTg3NiBjbmFtZTp7YjdlNjVmZDYtYjA1OC00NDcwLTg5ZDItYjU4ODBlODUwMGE4fVxyXG4ifQ=="
@@ -385,7 +386,7 @@ func TestGetBrowserSdpInvalidSdp(t *testing.T) {
 		videoIsLive:        true,
 		operatingSys:       osLinux,
 		ivfHandle:          testIvfFile,
-		stunServers:        "stun:stun.l.google.com:19302",
+		iceServers:         []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
 	}
 
 	validSessionDescription := "{\"BrowserSdp\": \"eyJ0eXBlIjoib2ZmZXIiLCJzZHAiOiJ2PTBcclxubz1tb3ppbGxhLi4uVEhJU19JU19TRFBBUlRBLTcyLjAuMSA0MzU3NzU1ODA1NzczMjE3MTAgMCBJTiBJUDQgMC4wLjAuMFxyXG5zPS1cclxudD0wIDBcclxuYT1zZW5kcmVjdlxyXG5hPWZpbmdlcnByaW50OnNoYS0yNTYgMTI6NUE6RkI6Qjc6N0U6ODY6QkM6RjA6RTI6OTU6QjQ6Q0Y6QTA6QUM6RDY6QzQ6QkM6REY6MUE6NDQ6NEE6OEY6RkY6RDE6NDA6MEY6RTI6RDA6Mjg6NjU6Rjk6QTlcclxuYT1ncm91cDpCVU5ETEUgMFxyXG5hPWljZS1vcHRpb25zOnRyaWNrbGVcclxuYT1tc2lkLXNlbWFudGljOldNUyAqXHJcbm09dmlkZW8gNTQ0NDEgVURQL1RMUy9SVFAvU0FWUEYgMTIwIDEyMVxyXG5jPUlOIElQNCA5OC4yMDAuMjQzLjE1MVxyXG5hPWNhbmRpZGF0ZTowIDEgVURQIDIxMjIyNTI1NDMgMTkyLjE2OC4wLjExMiA1NDQ0MSB0eXAgaG9zdFxyXG5hPWNhbmRpZGF0ZToyIDEgVENQIDIxMDU1MjQ0NzkgMTkyLjE2OC4wLjExMiA5IHR5cCBob3N0IHRjcHR5cGUgYWN0aXZlXHJcbmE9Y2FuZGlkYXRlOjAgMiBVRFAgMjEyMjI1MjU0MiAxOTIuMTY4LjAuMTEyIDQ4MjU4IHR5cCBob3N0XHJcbmE9Y2FuZGlkYXRlOjIgMiBUQ1AgMjEwNTUyNDQ3OCAxOTIuMTY4LjAuMTEyIDkgdHlwIGhvc3QgdGNwdHlwZSBhY3RpdmVcclxuYT1jYW5kaWRhdGU6MSAxIFVEUCAxNjg2MDUyODYzIDk4LjIwMC4yNDMuMTUxIDU0NDQxIHR5cCBzcmZseCByYWRkciAxOTIuMTY4LjAuMTEyIHJwb3J0IDU0NDQxXHJcbmE9Y2FuZGlkYXRlOjEgMiBVRFAgMTY4NjA1Mjg2MiA5OC4yMDAuMjQzLjE1MSA0ODI1OCB0eXAgc3JmbHggcmFkZHIgMTkyLjE2OC4wLjExMiBycG9ydCA0ODI1OFxyXG5hPXNlbmRyZWN2XHJcbmE9ZW5kLW9mLWNhbmRpZGF0ZXNcclxuYT1leHRtYXA6MyB1cm46aWV0ZjpwYXJhbXM6cnRwLWhkcmV4dDpzZGVzOm1pZFxyXG5hPWV4dG1hcDo0IGh0dHA6Ly93d3cud2VicnRjLm9yZy9leHBlcmltZW50cy9ydHAtaGRyZXh0L2Ficy1zZW5kLXRpbWVcclxuYT1leHRtYXA6NSB1cm46aWV0ZjpwYXJhbXM6cnRwLWhkcmV4dDp0b2Zmc2V0XHJcbmE9ZXh0bWFwOjYvcmVjdm9ubHkgaHR0cDovL3d3dy53ZWJydGMub3JnL2V4cGVyaW1lbnRzL3J0cC1oZHJleHQvcGxheW91dC1kZWxheVxyXG5hPWZtdHA6MTIwIG1heC1mcz0xMjI4ODttYXgtZnI9NjBcclxuYT1mbXRwOjEyMSBtYXgtZnM9MTIyODg7bWF4LWZyPTYwXHJcbmE9aWNlLXB3ZDozMmE5NDcyZWVlMTllMmRiM2QwNmI0ODA5NWFmYTk1ZFxyXG5hPWljZS11ZnJhZzo3NGRjMDdiNVxyXG5hPW1pZDowXHJcbmE9bXNpZDotIHtkZTMwMmU5Yi1mYTE2LTQ2NzYtOGNjMy1hMDg2ZjljOWExYWJ9XHJcbmE9cnRjcDo0ODI1OCBJTiBJUDQgOTguMjAwLjI0My4xNTFcclxuYT1ydGNwLWZiOjEyMCBuYWNrXHJcbmE9cnRjcC1mYjoxMjAgbmFjayBwbGlcclxuYT1ydGNwLWZiOjEyMCBjY20gZmlyXHJcbmE9cnRjcC1mYjoxMjAgZ29vZy1yZW1iXHJcbmE9cnRjcC1mYjoxMjEgbmFja1xyXG5hPXJ0Y3AtZmI6MTIxIG5hY2sgcGxpXHJcbmE9cnRjcC1mYjoxMjEgY2NtIGZpclxyXG5hPXJ0Y3AtZmI6MTIxIGdvb2ctcmVtYlxyXG5hPXJ0Y3AtbXV4XHJcbmE9cnRwbWFwOjEyMCBWUDgvOTAwMDBcclxuYT1ydHBtYXA6MTIxIFZQOS85MDAwMFxyXG5hPXNldHVwOmFjdHBhc3NcclxuYT1zc3JjOjQ1NjIyNTg3NiBjbmFtZTp7YjdlNjVmZDYtYjA1OC00NDcwLTg5ZDItYjU4ODBlODUwMGE4fVxyXG4ifQ\"}"
@@ -407,3 +408,65 @@ func TestGetBrowserSdpInvalidSdp(t *testing.T) {
 		t.Errorf("%s", err)
 	}
 }
+
+// offerWithout drops codec lines from testOffer
+func offerWithout(t *testing.T, lines ...string) string {
+	var offer webrtc.SessionDescription
+	if err := signal.Decode(testOffer, &offer); err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	for _, line := range lines {
+		offer.SDP = strings.Replace(offer.SDP, line+"\r\n", "", 1)
+	}
+
+	return signal.Encode(offer)
+}
+
+func TestBrowserSdpHandlerErrors(t *testing.T) {
+	mockArgs := userArguments{
+		inputResolution: "1920x1080",
+		videoIsLive:     true,
+		operatingSys:    osLinux,
+		ivfHandle:       testIvfFile,
+		iceServers:      []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+	}
+
+	noVP8 := offerWithout(t, "a=rtpmap:120 VP8/90000")
+
+	cases := []struct {
+		name     string
+		body     string
+		stun     string
+		status   int
+		category sdpErrorCategory
+	}{
+		{"malformed json", `{"BrowserSdp": `, "stun:stun.l.google.com:19302", http.StatusBadRequest, sdpDecodeError},
+		{"bad base64", `{"BrowserSdp": "not base64!"}`, "stun:stun.l.google.com:19302", http.StatusBadRequest, sdpDecodeError},
+		{"no vp8", `{"BrowserSdp": "` + noVP8 + `"}`, "stun:stun.l.google.com:19302", http.StatusUnprocessableEntity, sdpCodecError},
+		{"internal", `{"BrowserSdp": "` + testOffer + `"}`, "", http.StatusInternalServerError, sdpInternalError},
+	}
+
+	for _, c := range cases {
+		mockArgs.iceServers = []webrtc.ICEServer{{URLs: []string{c.stun}}}
+		w := httptest.NewRecorder()
+		browserSdpHandler(mockArgs)(w, httptest.NewRequest("POST", "/browsersdp", strings.NewReader(c.body)))
+
+		var body sdpErrorBody
+		json.Unmarshal(w.Body.Bytes(), &body)
+
+		if w.Code != c.status || body.Category != c.category || body.Error == "" {
+			t.Errorf("%s: got %d %+v, should be %d %s", c.name, w.Code, body, c.status, c.category)
+		}
+	}
+
+	mockArgs.iceServers = []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+	w := httptest.NewRecorder()
+	browserSdpHandler(mockArgs)(w, httptest.NewRequest("POST", "/browsersdp", strings.NewReader(`{"BrowserSdp": "`+testOffer+`"}`)))
+
+	var answer ssdp
+	json.Unmarshal(w.Body.Bytes(), &answer)
+	if w.Code != http.StatusOK || answer.ServerSdp == "" {
+		t.Errorf("valid offer got %d: %s", w.Code, w.Body.String())
+	}
+}
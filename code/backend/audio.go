@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+const (
+	opusSampleRate     = 48000
+	opusChannels       = 2
+	audioBitrate       = "64k"
+	audioFrameDuration = 20 // milliseconds, so each Ogg page carries one packet
+	oggPageHeaderSize  = 27
+)
+
+func audioDriver(platform string) (string, error) {
+	switch platform {
+	case osLinux:
+		return "alsa", nil
+	case osMac:
+		return "avfoundation", nil
+	case osWindows:
+		return "dshow", nil
+
+	default:
+		return "", fmt.Errorf("%s not supported", platform)
+	}
+}
+
+// audioInput is how the platform's driver names an audio-only device. On a
+// mac that is ":index" and on Windows "audio=name"; either can be given
+// already in that form.
+func audioInput(inputDevice, platform string) string {
+	switch {
+	case platform == osMac && !strings.HasPrefix(inputDevice, ":"):
+		return ":" + inputDevice
+	case platform == osWindows && !strings.HasPrefix(inputDevice, "audio="):
+		return "audio=" + inputDevice
+	default:
+		return inputDevice
+	}
+}
+
+// composeAudioCommand captures inputDevice and writes it to stdout as Opus in
+// Ogg, flushing every packet so narration isn't held back behind the video
+func composeAudioCommand(inputDevice, platform string) (*exec.Cmd, error) {
+	driver, err := audioDriver(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	return exec.Command("ffmpeg", "-y", "-fflags", "nobuffer", "-f", driver, "-i", audioInput(inputDevice, platform),
+		"-vn", "-c:a", "libopus", "-b:a", audioBitrate, "-ar", fmt.Sprint(opusSampleRate), "-ac", fmt.Sprint(opusChannels),
+		"-application", "lowdelay", "-frame_duration", fmt.Sprint(audioFrameDuration),
+		"-page_duration", fmt.Sprint(audioFrameDuration*1000), "-flush_packets", "1",
+		"-f", "ogg", stdoutPipeTarget), nil
+}
+
+// forAudio is uArgs capturing the audio device. Audio pipelines are kept in
+// the broadcaster registry like video ones, keyed by device and codec, so
+// they are shared, supervised and stopped when idle the same way.
+func (uArgs userArguments) forAudio() userArguments {
+	uArgs.inputVideoPath = uArgs.audioDevice
+	uArgs.videoCodec = webrtc.Opus
+	uArgs.qualityLayer = qualityLayer{}
+
+	return uArgs
+}
+
+// oggReader reads the packets of an Ogg stream. ffmpeg writes a single
+// logical stream to the pipe, so serial numbers and checksums are ignored.
+type oggReader struct {
+	stream  *bufio.Reader
+	packets [][]byte // complete packets from the last page read
+	partial []byte   // a packet that carries on into the next page
+}
+
+func newOggReader(stream io.Reader) *oggReader {
+	return &oggReader{stream: bufio.NewReader(stream)}
+}
+
+// readPage reads the next page, splitting its body into packets
+func (o *oggReader) readPage() error {
+	header := make([]byte, oggPageHeaderSize)
+	if _, err := io.ReadFull(o.stream, header); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header[:4], []byte("OggS")) {
+		return fmt.Errorf("ogg page header missing")
+	}
+
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(o.stream, segments); err != nil {
+		return err
+	}
+
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(o.stream, body); err != nil {
+		return err
+	}
+
+	// a packet ends on the first segment shorter than 255 bytes
+	start := 0
+	for _, s := range segments {
+		end := start + int(s)
+		o.partial = append(o.partial, body[start:end]...)
+		start = end
+
+		if s < 255 {
+			o.packets = append(o.packets, o.partial)
+			o.partial = nil
+		}
+	}
+
+	return nil
+}
+
+// next returns the next whole packet
+func (o *oggReader) next() ([]byte, error) {
+	for len(o.packets) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+
+	return packet, nil
+}
+
+// isOpusHeader reports whether packet is one of the identification or comment
+// headers that start an Ogg Opus stream rather than audio
+func isOpusHeader(packet []byte) bool {
+	return bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("OpusTags"))
+}
+
+// opusSamples is how many 48kHz samples an Opus packet holds, from its TOC
+// byte (RFC 6716 section 3.1)
+func opusSamples(packet []byte) uint32 {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	config := packet[0] >> 3
+	var tenthsOfMs uint32
+	switch {
+	case config < 12: // SILK
+		tenthsOfMs = []uint32{100, 200, 400, 600}[config&3]
+	case config < 16: // hybrid
+		tenthsOfMs = []uint32{100, 200}[config&1]
+	default: // CELT
+		tenthsOfMs = []uint32{25, 50, 100, 200}[config&3]
+	}
+
+	frames := uint32(1)
+	switch packet[0] & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = uint32(packet[1] & 0x3f)
+	}
+
+	return frames * tenthsOfMs * opusSampleRate / 10000
+}
+
+// streamAudio sends each Opus packet read from ogg to audioTrack as it
+// arrives. Capture runs in real time, so there is nothing to pace.
+func streamAudio(ogg *oggReader, audioTrack videoMediaTrack) error {
+	for {
+		packet, err := ogg.next()
+		if err != nil {
+			return err
+		}
+
+		if isOpusHeader(packet) {
+			continue
+		}
+
+		_ = audioTrack.WriteSample(media.Sample{Data: packet, Samples: opusSamples(packet)})
+	}
+}
+
+// audioControl streams the audio device into audioTrack until ffmpeg exits or
+// stop is closed
+func audioControl(audioTrack videoMediaTrack, uArgs userArguments, stop <-chan struct{}) error {
+	execStream, err := composeAudioCommand(uArgs.audioDevice, uArgs.operatingSys)
+	if err != nil {
+		return err
+	}
+	execStream.Stderr = uArgs.ffmpegStderr
+
+	stdout, err := startPipe(execStream)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	defer closeOnStop(stop, stdout)() // closing the pipe kills ffmpeg
+
+	streamAudio(newOggReader(stdout), audioTrack)
+
+	if err = stdout.Close(); err != nil && !isClosed(stop) {
+		return fmt.Errorf("ffmpeg exited: %s", err)
+	}
+
+	return nil
+}
+
+// sessionAudio is a session's audio track and, while it is on, the
+// broadcaster feeding it
+type sessionAudio struct {
+	track       videoMediaTrack
+	broadcaster *videoBroadcaster // nil while off
+	trackID     uint64
+}
+
+// opusCodec is the offer's Opus codec, or nil if it has none
+func opusCodec(mediaEngine webrtc.MediaEngine) *webrtc.RTPCodec {
+	for _, codec := range mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeAudio) {
+		if codec.Name == webrtc.Opus {
+			return codec
+		}
+	}
+
+	return nil
+}
+
+// addAudioTrack adds an Opus track for the configured audio device, if there
+// is one and the browser's offer can take it
+func (s *viewerSession) addAudioTrack(mediaEngine webrtc.MediaEngine) error {
+	if s.args.audioDevice == "" {
+		return nil
+	}
+
+	opus := opusCodec(mediaEngine)
+	if opus == nil {
+		return nil // an older page that only asks for video
+	}
+
+	// the same stream id as the video, so the browser plays them together
+	audioTrack, err := s.pc.NewTrack(opus.PayloadType, rand.Uint32(), "audio", "pion")
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.pc.AddTrack(audioTrack); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.audio = &sessionAudio{track: audioTrack}
+	s.mu.Unlock()
+
+	return s.setAudio(true)
+}
+
+// setAudio starts or stops sending audio on the session's track. Stopping
+// leaves the track in place, so turning it back on needs no renegotiation.
+func (s *viewerSession) setAudio(on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.audio == nil {
+		return errNoAudio
+	}
+
+	switch {
+	case on && s.audio.broadcaster == nil:
+		s.audio.broadcaster = s.pipelines.join(s.args.forAudio())
+		s.audio.trackID = s.audio.broadcaster.addTrack(s.audio.track)
+	case !on && s.audio.broadcaster != nil:
+		s.pipelines.leave(s.audio.broadcaster, s.audio.trackID)
+		s.audio.broadcaster = nil
+	}
+
+	return nil
+}
+
+// audioOn reports whether the session is being sent audio; s.mu must be held
+func (s *viewerSession) audioOn() bool {
+	return s.audio != nil && s.audio.broadcaster != nil
+}
+
+// detachAudio stops the session's audio, when it closes
+func (s *viewerSession) detachAudio() {
+	if err := s.setAudio(false); err != nil && err != errNoAudio {
+		fmt.Printf("session %s audio error: %s\n", s.id, err)
+	}
+}
+
+var errNoAudio = errors.New("the session has no audio track, because none is configured or the browser didn't ask for one")
+
+type audioRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// serveAudio handles /api/sessions/{id}/audio. GET says whether the session
+// is being sent audio and PUT turns it on or off.
+func serveAudio(w http.ResponseWriter, req *http.Request, s *viewerSession, segments []string) {
+	if len(segments) != 0 {
+		writeJSONError(w, http.StatusNotFound, notFoundError{what: req.URL.Path})
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body audioRequest
+		if err := readJSON(req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := s.setAudio(body.Enabled); err == errNoAudio {
+			writeJSONError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			writeJSONError(w, errorStatus(err), err)
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+		return
+	}
+
+	s.mu.Lock()
+	on := s.audioOn()
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, audioRequest{Enabled: on})
+}
+
+// oggCRC is the Ogg page checksum table: CRC-32 with polynomial 0x04c11db7,
+// unreflected
+var oggCRC = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+
+	return table
+}()
+
+// oggOpusWriter writes Opus packets to an Ogg file, one page per packet
+type oggOpusWriter struct {
+	out      io.WriteCloser
+	serial   uint32
+	sequence uint32
+	granule  uint64
+}
+
+// newOggOpusWriter writes the identification and comment headers that start
+// an Ogg Opus stream (RFC 7845)
+func newOggOpusWriter(out io.WriteCloser) (*oggOpusWriter, error) {
+	w := &oggOpusWriter{out: out, serial: rand.Uint32()}
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = opusChannels
+	binary.LittleEndian.PutUint32(head[12:], opusSampleRate)
+
+	tags := make([]byte, 16)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], 4)
+	copy(tags[12:], "asv")
+
+	if err := w.writePage(head, 0x02, 0); err != nil { // beginning of stream
+		return nil, err
+	}
+
+	if err := w.writePage(tags, 0, 0); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *oggOpusWriter) writePage(packet []byte, headerType byte, granule uint64) error {
+	segments := len(packet)/255 + 1
+	if packet == nil {
+		segments = 0 // a page only ending the stream
+	}
+	if segments > 255 {
+		return fmt.Errorf("opus packet of %d bytes is too long for a page", len(packet))
+	}
+
+	page := make([]byte, oggPageHeaderSize+segments, oggPageHeaderSize+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.sequence)
+	page[26] = byte(segments)
+	for i := 0; i < segments-1; i++ {
+		page[oggPageHeaderSize+i] = 255
+	}
+	if segments > 0 {
+		page[oggPageHeaderSize+segments-1] = byte(len(packet) % 255) // 0 when the packet fills its last segment exactly
+	}
+	page = append(page, packet...)
+
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRC[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+
+	w.sequence++
+	_, err := w.out.Write(page)
+
+	return err
+}
+
+// writePacket writes packet to end at granule, in 48kHz samples. A granule
+// that would go backwards is moved on past the previous packet.
+func (w *oggOpusWriter) writePacket(packet []byte, granule uint64) error {
+	if min := w.granule + uint64(opusSamples(packet)); granule < min {
+		granule = min
+	}
+	w.granule = granule
+
+	return w.writePage(packet, 0, granule)
+}
+
+// Close ends the stream with an empty end of stream page, so players can
+// tell it is complete rather than cut short
+func (w *oggOpusWriter) Close() error {
+	err := w.writePage(nil, 0x04, w.granule)
+	if closeErr := w.out.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// recordingAudio writes a recording's audio to an Ogg Opus file next to its
+// video while recording. Packets are stamped with the recording's clock, like
+// its frames, so the two line up when mergeAudio puts the audio in the WebM.
+type recordingAudio struct {
+	rec         *recording
+	ogg         *oggOpusWriter
+	broadcaster *videoBroadcaster
+	trackID     uint64
+}
+
+func (a *recordingAudio) WriteSample(s media.Sample) error {
+	a.rec.mu.Lock()
+	defer a.rec.mu.Unlock()
+
+	if !a.rec.sawKeyframe {
+		return nil // nothing to play it against yet
+	}
+
+	granule := uint64(time.Since(a.rec.started) * opusSampleRate / time.Second)
+	if err := a.ogg.writePacket(s.Data, granule); err != nil {
+		fmt.Printf("recording %s audio write error: %s\n", a.rec.manifest.ID, err)
+	}
+
+	return nil
+}
+
+// addAudio records what b broadcasts, the configured audio device, alongside
+// the recording's video
+func (m *recordingManager) addAudio(id string, b *videoBroadcaster) (recordingManifest, error) {
+	rec, err := m.lookup(id)
+	if err != nil {
+		return recordingManifest{}, err
+	}
+
+	rec.mu.Lock()
+	manifest, err := rec.openAudio(b)
+	rec.mu.Unlock()
+
+	if err != nil {
+		return recordingManifest{}, err
+	}
+
+	// outside rec.mu, which WriteSample takes under the broadcaster's lock
+	rec.audio.trackID = b.addTrack(rec.audio)
+
+	return manifest, nil
+}
+
+// openAudio creates the recording's audio file; rec.mu must be held
+func (rec *recording) openAudio(b *videoBroadcaster) (recordingManifest, error) {
+	path := filepath.Join(rec.dir, rec.manifest.ID+".ogg")
+	file, err := os.Create(path)
+	if err != nil {
+		return recordingManifest{}, err
+	}
+
+	ogg, err := newOggOpusWriter(file)
+	if err != nil {
+		file.Close()
+		return recordingManifest{}, err
+	}
+
+	rec.audio = &recordingAudio{rec: rec, ogg: ogg, broadcaster: b}
+	rec.closers = append(rec.closers, ogg)
+	rec.manifest.Files = append(rec.manifest.Files, filepath.Base(path))
+
+	return rec.manifest, rec.saveManifest()
+}
+
+func composeMuxAudioCommand(videoPath, audioPath, outputPath string) *exec.Cmd {
+	return exec.Command("ffmpeg", "-y", "-loglevel", "error", "-i", videoPath, "-i", audioPath,
+		"-map", "0:v", "-map", "1:a", "-c", "copy", outputPath)
+}
+
+// muxAudio copies the audio at audioPath into the video at videoPath,
+// writing both to outputPath
+func muxAudio(videoPath, audioPath, outputPath string) error {
+	execStream := composeMuxAudioCommand(videoPath, audioPath, outputPath)
+
+	var stderr bytes.Buffer
+	execStream.Stderr = &stderr
+
+	if err := execStream.Run(); err != nil {
+		return fmt.Errorf("ffmpeg mux error: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// mergeAudio moves a stopped recording's audio into its WebM file, so the
+// recording plays with its narration. Without a WebM file the Ogg file is
+// kept, since IVF can't carry audio, and it is also kept if muxing fails;
+// rec.mu must be held.
+func (m *recordingManager) mergeAudio(rec *recording) error {
+	audio, video := rec.manifest.ID+".ogg", rec.manifest.ID+"."+recordingFormatWebm
+	files := []string{}
+	hasVideo := false
+	for _, file := range rec.manifest.Files {
+		hasVideo = hasVideo || file == video
+		if file != audio {
+			files = append(files, file)
+		}
+	}
+
+	if !hasVideo {
+		return nil
+	}
+
+	audioPath, videoPath := filepath.Join(rec.dir, audio), filepath.Join(rec.dir, video)
+	muxedPath := filepath.Join(rec.dir, rec.manifest.ID+".muxing."+recordingFormatWebm)
+	if err := m.mux(videoPath, audioPath, muxedPath); err != nil {
+		os.Remove(muxedPath)
+		return err
+	}
+
+	if err := os.Rename(muxedPath, videoPath); err != nil {
+		return err
+	}
+
+	rec.manifest.Files = files
+
+	return os.Remove(audioPath)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+func TestComposeAudioCommand(t *testing.T) {
+	tests := []struct {
+		device, platform, input string
+	}{
+		{"hw:1", osLinux, "hw:1"},
+		{"0", osMac, ":0"},
+		{":1", osMac, ":1"},
+		{"Microphone (USB Audio)", osWindows, "audio=Microphone (USB Audio)"},
+	}
+
+	for _, test := range tests {
+		execStream, err := composeAudioCommand(test.device, test.platform)
+		if err != nil {
+			t.Errorf("%s on %s failed with %s", test.device, test.platform, err)
+			continue
+		}
+
+		args := strings.Join(execStream.Args, " ")
+		if !strings.Contains(args, "-i "+test.input+" ") || !strings.Contains(args, "-c:a libopus") || !strings.HasSuffix(args, "-f ogg pipe:1") {
+			t.Errorf("%s on %s gave %s", test.device, test.platform, args)
+		}
+	}
+
+	if _, err := composeAudioCommand("hw:1", "plan9"); err == nil {
+		t.Error("an unsupported platform should fail")
+	}
+}
+
+type closingBuffer struct {
+	bytes.Buffer
+}
+
+func (closingBuffer) Close() error { return nil }
+
+func TestOggRoundTrip(t *testing.T) {
+	var out closingBuffer
+	w, err := newOggOpusWriter(&out)
+	if err != nil {
+		t.Fatalf("newOggOpusWriter failed with %s", err)
+	}
+
+	packets := [][]byte{bytes.Repeat([]byte{0xf8}, 10), bytes.Repeat([]byte{0xf8}, 255), bytes.Repeat([]byte{0xf8}, 600)}
+	for _, packet := range packets {
+		if err = w.writePacket(packet, 0); err != nil {
+			t.Fatalf("writePacket failed with %s", err)
+		}
+	}
+
+	if w.granule != 3*960 {
+		t.Errorf("granule is %d, should have moved on 960 a packet", w.granule)
+	}
+
+	ogg := newOggReader(&out)
+	for _, want := range []string{"OpusHead", "OpusTags"} {
+		if packet, err := ogg.next(); err != nil || !bytes.HasPrefix(packet, []byte(want)) {
+			t.Fatalf("expected %s, got %q, %v", want, packet, err)
+		}
+	}
+
+	for i, want := range packets {
+		packet, err := ogg.next()
+		if err != nil || !bytes.Equal(packet, want) {
+			t.Errorf("packet %d came back as %d bytes, %v", i, len(packet), err)
+		}
+	}
+
+	if _, err = ogg.next(); err == nil {
+		t.Error("expected the stream to end")
+	}
+
+	written := len(out.Bytes())
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close failed with %s", err)
+	}
+
+	if eos := out.Bytes()[written:]; len(eos) != oggPageHeaderSize || eos[5] != 0x04 {
+		t.Errorf("closing should end the stream with an empty end of stream page, got %x", eos)
+	}
+}
+
+func TestOpusSamples(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		want   uint32
+	}{
+		{[]byte{0xf8}, 960},        // CELT 20ms
+		{[]byte{0xf9}, 1920},       // two of them
+		{[]byte{0x18}, 2880},       // SILK 60ms
+		{[]byte{0x7b, 0x03}, 2880}, // three hybrid 20ms frames
+		{nil, 0},
+	}
+
+	for _, test := range tests {
+		if got := opusSamples(test.packet); got != test.want {
+			t.Errorf("%x has %d samples, should have %d", test.packet, got, test.want)
+		}
+	}
+}
+
+func TestSessionAudio(t *testing.T) {
+	s, registry := feedTestSession()
+	s.args.audioDevice = "hw:1"
+
+	samples := 0
+	s.audio = &sessionAudio{track: countingVideoTrack{samples: &samples}}
+	if err := s.setAudio(true); err != nil {
+		t.Fatalf("setAudio failed with %s", err)
+	}
+
+	audio := registry.join(s.args.forAudio())
+	if audio.codec != webrtc.Opus || audio.viewerCount() != 1 {
+		t.Fatalf("the track isn't on the audio pipeline: %s with %d viewers", audio.codec, audio.viewerCount())
+	}
+
+	audio.WriteSample(media.Sample{Data: []byte{0xf8}})
+	if samples != 1 {
+		t.Errorf("the track got %d samples, every opus packet should be sent", samples)
+	}
+
+	w := httptest.NewRecorder()
+	serveAudio(w, httptest.NewRequest("PUT", "/api/sessions/x/audio", strings.NewReader(`{"enabled":false}`)), s, nil)
+
+	var body audioRequest
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || w.Code != http.StatusOK || body.Enabled {
+		t.Errorf("PUT returned %d %+v, %v", w.Code, body, err)
+	}
+
+	if audio.viewerCount() != 0 {
+		t.Error("turning audio off should leave the audio pipeline")
+	}
+
+	w = httptest.NewRecorder()
+	serveAudio(w, httptest.NewRequest("PUT", "/api/sessions/x/audio", strings.NewReader(`{"enabled":true}`)), newViewerSession(nil), nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("a session without audio returned %d, should be %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestRecordingAudio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newRecordingManager(dir)
+	b := newVideoBroadcaster(webrtc.VP8)
+	audio := newVideoBroadcaster(webrtc.Opus)
+
+	manifest, err := m.start(b, videoSource{Device: "device", Resolution: "1280x720"}, nil)
+	if err != nil {
+		t.Fatalf("start failed with %s", err)
+	}
+
+	if manifest, err = m.addAudio(manifest.ID, audio); err != nil {
+		t.Fatalf("addAudio failed with %s", err)
+	}
+
+	audio.WriteSample(media.Sample{Data: []byte{0xf8, 0x01}}) // before any video
+	b.WriteSample(media.Sample{Data: []byte{0x00, 0xff}})
+	audio.WriteSample(media.Sample{Data: []byte{0xf8, 0x02}})
+
+	if manifest, err = m.stop(manifest.ID); err != nil {
+		t.Fatalf("stop failed with %s", err)
+	}
+
+	if len(manifest.Files) != 2 || audio.viewerCount() != 0 {
+		t.Fatalf("expected video and audio files and no listeners, got %v and %d", manifest.Files, audio.viewerCount())
+	}
+
+	f, err := os.Open(filepath.Join(dir, manifest.Files[1]))
+	if err != nil {
+		t.Fatalf("audio file missing: %s", err)
+	}
+	defer f.Close()
+
+	var packets [][]byte
+	ogg := newOggReader(f)
+	for packet, err := ogg.next(); err == nil; packet, err = ogg.next() {
+		if !isOpusHeader(packet) {
+			packets = append(packets, packet)
+		}
+	}
+
+	if len(packets) != 1 || !bytes.Equal(packets[0], []byte{0xf8, 0x02}) {
+		t.Errorf("expected only the packet after the keyframe, got %x", packets)
+	}
+}
+
+func TestMergeAudio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"x.webm", "x.ogg"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, file), []byte(file), 0644); err != nil {
+			t.Fatalf("error in setup: %s", err)
+		}
+	}
+
+	m := newRecordingManager(dir)
+	m.mux = func(videoPath, audioPath, outputPath string) error {
+		video, _ := ioutil.ReadFile(videoPath)
+		audio, _ := ioutil.ReadFile(audioPath)
+		return ioutil.WriteFile(outputPath, append(video, audio...), 0644)
+	}
+
+	rec := &recording{dir: dir, manifest: recordingManifest{ID: "x", Files: []string{"x.ivf", "x.webm", "x.ogg"}}}
+	if err = m.mergeAudio(rec); err != nil {
+		t.Fatalf("mergeAudio failed with %s", err)
+	}
+
+	if strings.Join(rec.manifest.Files, " ") != "x.ivf x.webm" {
+		t.Errorf("the audio file should be gone from the manifest: %v", rec.manifest.Files)
+	}
+
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "x.webm")); string(b) != "x.webmx.ogg" {
+		t.Errorf("the webm should have the audio muxed in, got %q", b)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "x.ogg")); !os.IsNotExist(err) {
+		t.Error("the ogg file should have been removed")
+	}
+
+	rec.manifest.Files = []string{"x.ivf", "x.ogg"}
+	if err = m.mergeAudio(rec); err != nil || len(rec.manifest.Files) != 2 {
+		t.Errorf("without a webm the ogg file should be kept: %v, %v", rec.manifest.Files, err)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie     = "asv_session"
+	authTokenBytes    = 24
+	defaultSessionTTL = 12 * time.Hour
+	loginPath         = "/login"
+)
+
+// role is what a signed in user may do. Presenters can do everything
+// consultants can, who can do everything viewers can and talk back, so roles
+// compare with >=.
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleConsultant
+	rolePresenter
+)
+
+var roleNames = map[role]string{roleNone: "", roleViewer: "viewer", roleConsultant: "consultant", rolePresenter: "presenter"}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(name string) (role, error) {
+	for r, n := range roleNames {
+		if n == name && r != roleNone {
+			return r, nil
+		}
+	}
+
+	return roleNone, fmt.Errorf("unknown role %q", name)
+}
+
+func (r role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *role) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+
+	parsed, err := parseRole(name)
+	if err != nil {
+		return err
+	}
+
+	*r = parsed
+	return nil
+}
+
+// authSettings turn on login. Without them everyone is a presenter, which is
+// how the server behaved before auth existed.
+type authSettings struct {
+	Enabled   bool   `json:"enabled,omitempty"`
+	UsersFile string `json:"usersFile"`
+}
+
+type authUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"` // bcrypt
+	Role         role   `json:"role"`
+}
+
+// joinToken is a pre-shared link that signs whoever opens it in with a role,
+// for sending to residents without making them accounts
+type joinToken struct {
+	Token   string     `json:"token"`
+	Label   string     `json:"label,omitempty"`
+	Role    role       `json:"role"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type authFile struct {
+	Users  []authUser  `json:"users"`
+	Tokens []joinToken `json:"tokens"`
+}
+
+// authStore holds the users file. Join tokens created at runtime are written
+// back to it, the same way as stepStore.
+type authStore struct {
+	mu   sync.RWMutex
+	path string
+	file authFile
+}
+
+func loadAuthStore(path string) (*authStore, error) {
+	s := &authStore{path: path, file: authFile{Users: []authUser{}, Tokens: []joinToken{}}}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &s.file); err != nil {
+		return nil, fmt.Errorf("users file %s error: %s", path, err)
+	}
+
+	return s, nil
+}
+
+func (s *authStore) save() error {
+	b, err := json.MarshalIndent(s.file, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// login checks a username and password, taking as long for unknown users as
+// for wrong passwords
+func (s *authStore) login(username, password string) (authUser, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := authUser{PasswordHash: unknownUserHash()}
+	for _, u := range s.file.Users {
+		if u.Username == username {
+			found = u
+		}
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(found.PasswordHash), []byte(password)) != nil || found.Username == "" {
+		return authUser{}, false
+	}
+
+	return found, true
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// unknownUserHash is compared against when the username doesn't exist
+func unknownUserHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword(randomToken())
+	})
+
+	return dummyHash
+}
+
+func (s *authStore) redeem(token string) (joinToken, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.file.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			if t.Expires != nil && time.Now().After(*t.Expires) {
+				return joinToken{}, false
+			}
+
+			return t, true
+		}
+	}
+
+	return joinToken{}, false
+}
+
+func (s *authStore) addToken(t joinToken) (joinToken, error) {
+	t.Token = randomToken()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.file.Tokens = append(s.file.Tokens, t)
+	if err := s.save(); err != nil {
+		s.file.Tokens = s.file.Tokens[:len(s.file.Tokens)-1]
+		return joinToken{}, err
+	}
+
+	return t, nil
+}
+
+// randomToken makes session and join tokens, and the ids of viewer sessions,
+// none of which may be guessable
+func randomToken() string {
+	b := make([]byte, authTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %s", err))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+const idLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// randomID makes the ids of steps, annotations, recordings and the like.
+// signal.RandSeq seeds itself from the clock on every call, so two ids made in
+// the same tick of a coarse clock come out the same.
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %s", err))
+	}
+
+	for i := range b {
+		b[i] = idLetters[int(b[i])%len(idLetters)]
+	}
+
+	return string(b)
+}
+
+// identity is who made a request, as worked out by authenticator.wrap
+type identity struct {
+	Name string `json:"name"`
+	Role role   `json:"role"`
+}
+
+type identityKey struct{}
+
+// openIdentity is used when auth is off, and for handlers reached without
+// going through authenticator.wrap (as in tests)
+var openIdentity = identity{Name: "anyone", Role: rolePresenter}
+
+func identityFrom(ctx context.Context) identity {
+	if id, ok := ctx.Value(identityKey{}).(identity); ok {
+		return id
+	}
+
+	return openIdentity
+}
+
+type authSession struct {
+	identity
+	expires time.Time
+}
+
+// authenticator signs users in with cookies and checks every request's role
+type authenticator struct {
+	enabled bool
+	secure  bool // only send the cookie over HTTPS
+	ttl     time.Duration
+	store   *authStore
+
+	mu       sync.Mutex
+	sessions map[string]authSession
+}
+
+func newAuthenticator(settings authSettings, store *authStore, secure bool) *authenticator {
+	return &authenticator{
+		enabled:  settings.Enabled,
+		secure:   secure,
+		ttl:      defaultSessionTTL,
+		store:    store,
+		sessions: map[string]authSession{},
+	}
+}
+
+func (a *authenticator) startSession(w http.ResponseWriter, id identity) {
+	token := randomToken()
+
+	a.mu.Lock()
+	a.sessions[token] = authSession{identity: id, expires: time.Now().Add(a.ttl)}
+	a.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(a.ttl / time.Second),
+		HttpOnly: true,
+		Secure:   a.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *authenticator) session(r *http.Request) (identity, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return identity{}, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[cookie.Value]
+	if !ok || time.Now().After(s.expires) {
+		delete(a.sessions, cookie.Value)
+		return identity{}, false
+	}
+
+	return s.identity, true
+}
+
+func (a *authenticator) endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		a.mu.Lock()
+		delete(a.sessions, cookie.Value)
+		a.mu.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+}
+
+// requiredRole is the role a request needs. Reading needs a viewer and
+// changing anything needs a presenter, except for the calls a viewer makes to
+// connect to the video.
+func requiredRole(r *http.Request) role {
+	path := r.URL.Path
+
+	switch {
+	case path == "/api/auth/tokens" || strings.HasPrefix(path, "/api/admin/"):
+		return rolePresenter
+	case path == loginPath || strings.HasPrefix(path, "/api/auth/"):
+		return roleNone
+	case path == "/browsersdp" || strings.HasPrefix(path, "/api/sessions/"):
+		return roleViewer
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return roleViewer
+	default:
+		return rolePresenter
+	}
+}
+
+// wrap enforces requiredRole on every request to next. Browsers that aren't
+// signed in are sent to the login page; API calls get a 401.
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := openIdentity
+		if a.enabled {
+			var ok bool
+			if id, ok = a.session(r); !ok {
+				id = identity{}
+			}
+		}
+
+		switch need := requiredRole(r); {
+		case id.Role >= need:
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+		case id.Role == roleNone && r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/"):
+			http.Redirect(w, r, loginPath, http.StatusSeeOther)
+		case id.Role == roleNone:
+			writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("sign in required"))
+		default:
+			writeJSONError(w, http.StatusForbidden, fmt.Errorf("%s role required", need))
+		}
+	})
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loginHandler serves the login form and signs users in from it or from a
+// JSON POST
+func (a *authenticator) loginHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, loginPage)
+	case http.MethodPost:
+		var req loginRequest
+		isForm := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+		if isForm {
+			req.Username, req.Password = r.PostFormValue("username"), r.PostFormValue("password")
+		} else if err := readJSON(r, &req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		user, ok := a.store.login(req.Username, req.Password)
+		if !ok && isForm {
+			http.Redirect(w, r, loginPath+"?failed", http.StatusSeeOther)
+			return
+		} else if !ok {
+			writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("wrong username or password"))
+			return
+		}
+
+		id := identity{Name: user.Username, Role: user.Role}
+		a.startSession(w, id)
+
+		if isForm {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, id)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	}
+}
+
+// joinHandler serves GET /api/auth/join?token=..., the link sent to people
+// without accounts
+func (a *authenticator) joinHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := a.store.redeem(r.URL.Query().Get("token"))
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("join link is invalid or has expired"))
+		return
+	}
+
+	name := token.Label
+	if name == "" {
+		name = token.Role.String()
+	}
+
+	a.startSession(w, identity{Name: name, Role: token.Role})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+type tokenRequest struct {
+	Label      string `json:"label"`
+	Role       role   `json:"role"`
+	ValidHours int    `json:"validHours"` // 0 never expires
+}
+
+type tokenResponse struct {
+	joinToken
+	Link string `json:"link"`
+}
+
+// tokensHandler serves POST /api/auth/tokens, which presenters use to make
+// join links
+func (a *authenticator) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+
+	var req tokenRequest
+	if err := readJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Role == roleNone {
+		req.Role = roleViewer
+	}
+
+	t := joinToken{Label: req.Label, Role: req.Role}
+	if req.ValidHours > 0 {
+		expires := time.Now().Add(time.Duration(req.ValidHours) * time.Hour)
+		t.Expires = &expires
+	}
+
+	t, err := a.store.addToken(t)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, tokenResponse{joinToken: t, Link: "/api/auth/join?token=" + t.Token})
+}
+
+func (a *authenticator) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	a.endSession(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// meHandler tells the frontend who is signed in, so it can hide presenter
+// controls from viewers
+func (a *authenticator) meHandler(w http.ResponseWriter, r *http.Request) {
+	id := identityFrom(r.Context())
+	if id.Role == roleNone {
+		writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("sign in required"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, id)
+}
+
+func registerAuthHandlers(a *authenticator) {
+	http.HandleFunc(loginPath, a.loginHandler)
+	http.HandleFunc("/api/auth/join", a.joinHandler)
+	http.HandleFunc("/api/auth/logout", a.logoutHandler)
+	http.HandleFunc("/api/auth/me", a.meHandler)
+	http.HandleFunc("/api/auth/tokens", a.tokensHandler)
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// printPasswordHash is --hash-password, for filling in users files without
+// the password ending up in shell history
+func printPasswordHash(in io.Reader, out io.Writer) error {
+	password, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("no password given")
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(out, hash)
+
+	return err
+}
+
+const loginPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body style="font-family: sans-serif; max-width: 20em; margin: 4em auto">
+<h1>Sign in</h1>
+<form method="post" action="/login">
+<p><label>Username<br><input name="username" autocomplete="username" autofocus></label></p>
+<p><label>Password<br><input name="password" type="password" autocomplete="current-password"></label></p>
+<p><button type="submit">Sign in</button></p>
+</form>
+</body>
+</html>
+`
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testAuthenticator has a presenter "attending" and a viewer "resident", both
+// with the password "secret"
+func testAuthenticator(t *testing.T) (*authenticator, func()) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	users := `{"users": [
+		{"username": "attending", "passwordHash": "` + string(hash) + `", "role": "presenter"},
+		{"username": "resident", "passwordHash": "` + string(hash) + `", "role": "viewer"}
+	]}`
+
+	path := filepath.Join(dir, "users.json")
+	if err = ioutil.WriteFile(path, []byte(users), 0600); err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	store, err := loadAuthStore(path)
+	if err != nil {
+		t.Fatalf("loadAuthStore failed with %s", err)
+	}
+
+	return newAuthenticator(authSettings{Enabled: true, UsersFile: path}, store, false), func() { os.RemoveAll(dir) }
+}
+
+// signIn logs in over JSON and returns the session cookie
+func signIn(t *testing.T, a *authenticator, username, password string) (*http.Cookie, int) {
+	w := httptest.NewRecorder()
+	body := `{"username": "` + username + `", "password": "` + password + `"}`
+	a.loginHandler(w, httptest.NewRequest("POST", loginPath, strings.NewReader(body)))
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			return c, w.Code
+		}
+	}
+
+	return nil, w.Code
+}
+
+func TestLogin(t *testing.T) {
+	a, cleanup := testAuthenticator(t)
+	defer cleanup()
+
+	cookie, code := signIn(t, a, "attending", "secret")
+	if code != http.StatusOK || cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("login returned %d with cookie %+v", code, cookie)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if id, ok := a.session(r); !ok || id.Role != rolePresenter || id.Name != "attending" {
+		t.Errorf("session gave %+v, %v", id, ok)
+	}
+
+	for _, login := range [][2]string{{"attending", "wrong"}, {"nobody", "secret"}} {
+		if cookie, code = signIn(t, a, login[0], login[1]); code != http.StatusUnauthorized || cookie != nil {
+			t.Errorf("%s/%s signed in with %d", login[0], login[1], code)
+		}
+	}
+
+	form := url.Values{"username": {"resident"}, "password": {"wrong"}}
+	r = httptest.NewRequest("POST", loginPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	a.loginHandler(w, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != loginPath+"?failed" {
+		t.Errorf("failed form login returned %d to %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestAuthWrapEnforcesRoles(t *testing.T) {
+	a, cleanup := testAuthenticator(t)
+	defer cleanup()
+
+	handler := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(identityFrom(r.Context()))
+	}))
+
+	viewer, _ := signIn(t, a, "resident", "secret")
+	presenter, _ := signIn(t, a, "attending", "secret")
+
+	tests := []struct {
+		method, path string
+		cookie       *http.Cookie
+		status       int
+	}{
+		{"GET", "/", nil, http.StatusSeeOther},
+		{"GET", "/api/procedures", nil, http.StatusUnauthorized},
+		{"POST", "/browsersdp", nil, http.StatusUnauthorized},
+		{"GET", loginPath, nil, http.StatusOK},
+		{"GET", "/api/procedures", viewer, http.StatusOK},
+		{"POST", "/browsersdp", viewer, http.StatusOK},
+		{"POST", "/api/sessions/abc/candidates", viewer, http.StatusOK},
+		{"POST", "/api/procedures/lap-chole/steps", viewer, http.StatusForbidden},
+		{"GET", "/api/admin/sessions", viewer, http.StatusForbidden},
+		{"POST", "/api/auth/tokens", viewer, http.StatusForbidden},
+		{"POST", "/api/procedures/lap-chole/steps", presenter, http.StatusOK},
+		{"DELETE", "/api/admin/sessions/abc", presenter, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.cookie != nil {
+			r.AddCookie(test.cookie)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s with %v returned %d, should be %d", test.method, test.path, test.cookie != nil, w.Code, test.status)
+		}
+	}
+}
+
+func TestAuthDisabledAllowsEverything(t *testing.T) {
+	a := newAuthenticator(authSettings{}, &authStore{}, false)
+
+	var got identity
+	handler := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = identityFrom(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/admin/sessions/abc", nil))
+	if w.Code != http.StatusOK || got.Role != rolePresenter {
+		t.Errorf("with auth off got %d as %+v", w.Code, got)
+	}
+}
+
+func TestJoinTokens(t *testing.T) {
+	a, cleanup := testAuthenticator(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	a.tokensHandler(w, httptest.NewRequest("POST", "/api/auth/tokens", strings.NewReader(`{"label": "visiting fellow", "validHours": 2}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating a token returned %d: %s", w.Code, w.Body.String())
+	}
+
+	var created tokenResponse
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.Role != roleViewer || created.Expires == nil || !strings.HasSuffix(created.Link, created.Token) {
+		t.Errorf("unexpected token %+v", created)
+	}
+
+	w = httptest.NewRecorder()
+	a.joinHandler(w, httptest.NewRequest("GET", created.Link, nil))
+	if w.Code != http.StatusSeeOther || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("joining returned %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	if id, ok := a.session(r); !ok || id.Role != roleViewer || id.Name != "visiting fellow" {
+		t.Errorf("joined as %+v, %v", id, ok)
+	}
+
+	reloaded, err := loadAuthStore(a.store.path)
+	if err != nil {
+		t.Fatalf("reloading failed with %s", err)
+	}
+
+	if _, ok := reloaded.redeem(created.Token); !ok {
+		t.Error("the token wasn't saved to the users file")
+	}
+
+	expired := time.Now().Add(-time.Minute)
+	reloaded.file.Tokens[0].Expires = &expired
+	if _, ok := reloaded.redeem(created.Token); ok {
+		t.Error("an expired token was accepted")
+	}
+
+	w = httptest.NewRecorder()
+	a.joinHandler(w, httptest.NewRequest("GET", "/api/auth/join?token=guess", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a made up token returned %d", w.Code)
+	}
+}
+
+func TestEventHubRestrict(t *testing.T) {
+	h := newEventHub()
+	h.on("draw", func(from *hubClient, data json.RawMessage) error { return nil })
+	h.restrict("draw", rolePresenter)
+
+	viewer, presenter := h.register(), h.register()
+	viewer.role, presenter.role = roleViewer, rolePresenter
+
+	if err := h.dispatch(viewer, hubMessage{Type: "draw"}); err == nil || !strings.Contains(err.Error(), "presenter") {
+		t.Errorf("a viewer sent a presenter message, error %v", err)
+	}
+
+	if err := h.dispatch(presenter, hubMessage{Type: "draw"}); err != nil {
+		t.Errorf("a presenter was refused with %s", err)
+	}
+}
+
+func TestPrintPasswordHash(t *testing.T) {
+	var out bytes.Buffer
+	if err := printPasswordHash(strings.NewReader("secret\n"), &out); err != nil {
+		t.Fatalf("printPasswordHash failed with %s", err)
+	}
+
+	if bcrypt.CompareHashAndPassword(bytes.TrimSpace(out.Bytes()), []byte("secret")) != nil {
+		t.Errorf("printed hash %q doesn't match", out.String())
+	}
+
+	if err := printPasswordHash(strings.NewReader(""), &out); err == nil {
+		t.Error("an empty password should be refused")
+	}
+}
+
+func TestRandomIDsDoNotRepeat(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := randomID(stepIDLength)
+		if len(id) != stepIDLength || strings.Trim(id, idLetters) != "" {
+			t.Fatalf("bad id %q", id)
+		}
+
+		if seen[id] {
+			t.Fatalf("%q came up twice", id)
+		}
+		seen[id] = true
+	}
+}
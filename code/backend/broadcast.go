@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+// videoBroadcaster fans every frame from a single capture pipeline out to all
+// of the tracks currently watching it. It satisfies videoMediaTrack so it can
+// be handed to videoControl in place of a single track.
+type videoBroadcaster struct {
+	health  pipelineHealth // first, so its atomically updated field is aligned
+	codec   string
+	latency latencyAverage
+	mu      sync.RWMutex
+	tracks  map[uint64]videoMediaTrack
+	waiting map[uint64]bool // tracks that haven't had a keyframe yet
+	nextID  uint64
+
+	sinceKeyframe      [][]byte // the frames a snapshot decodes
+	sinceKeyframeBytes int
+	replay             *replayBuffer // nil unless this is a full quality video pipeline kept for replay
+
+	// guarded by the registry's lock
+	running bool
+	stop    chan struct{} // closed to ask the running pipeline to exit
+	restart bool          // joined while stopping, so start again afterwards
+}
+
+func newVideoBroadcaster(codec string) *videoBroadcaster {
+	b := &videoBroadcaster{
+		codec:   codec,
+		tracks:  map[uint64]videoMediaTrack{},
+		waiting: map[uint64]bool{},
+	}
+	b.health.state = pipelineStopped
+	b.health.log = newPipelineLog(codec)
+
+	return b
+}
+
+// addTrack registers a viewer's track and returns the id used to remove it.
+// The track gets nothing until the next keyframe, since the frames before it
+// can't be decoded; that is at most keyframeMaxGap away.
+func (b *videoBroadcaster) addTrack(track videoMediaTrack) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	id := b.nextID
+	b.tracks[id] = track
+	b.waiting[id] = true
+
+	return id
+}
+
+func (b *videoBroadcaster) removeTrack(id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.tracks, id)
+	delete(b.waiting, id)
+}
+
+func (b *videoBroadcaster) viewerCount() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.tracks)
+}
+
+// WriteSample sends s to every viewer. A viewer whose track errors (usually
+// because its peer connection went away) is skipped so it can't stall the rest.
+func (b *videoBroadcaster) WriteSample(s media.Sample) error {
+	b.health.frameSent()
+
+	keyframe := isKeyframe(b.codec, s.Data)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.keepFrame(s.Data, keyframe)
+	if b.replay != nil {
+		b.replay.add(s.Data, s.Samples, keyframe, time.Now())
+	}
+
+	for id, track := range b.tracks {
+		if b.waiting[id] && !keyframe {
+			continue
+		}
+		delete(b.waiting, id)
+
+		_ = track.WriteSample(s)
+	}
+
+	return nil
+}
+
+// recordLatency adds how long a frame took from ffmpeg to being sent to the average
+func (b *videoBroadcaster) recordLatency(d time.Duration) {
+	b.latency.record(d)
+}
+
+// pipelineStarter runs a capture pipeline into b until it fails or stop is
+// closed
+type pipelineStarter func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error
+
+// pipelineKey identifies a capture pipeline. A device being watched in both
+// VP8 and H.264 needs an encoder for each, as does each quality layer.
+type pipelineKey struct {
+	device string
+	codec  string
+	layer  string // empty for full quality
+}
+
+const pipelineIdleTimeout = 5 * time.Second
+
+// broadcasterRegistry owns one broadcaster (and so one ffmpeg process) per
+// capture device, codec and quality layer. Broadcasters outlive their
+// pipelines, so viewers and recordings stay attached while capture is
+// restarted underneath them. A pipeline nobody has watched for idleTimeout is
+// stopped.
+type broadcasterRegistry struct {
+	mu           sync.Mutex
+	byPipeline   map[pipelineKey]*videoBroadcaster
+	start        pipelineStarter
+	transcode    layerTranscoder
+	idleTimeout  time.Duration
+	stallTimeout time.Duration
+	minBackoff   time.Duration
+	onState      func(pipelineInfo)
+}
+
+func newBroadcasterRegistry(start pipelineStarter) *broadcasterRegistry {
+	return &broadcasterRegistry{
+		byPipeline:   map[pipelineKey]*videoBroadcaster{},
+		start:        start,
+		transcode:    transcodeLayer,
+		idleTimeout:  pipelineIdleTimeout,
+		stallTimeout: pipelineStallTimeout,
+		minBackoff:   pipelineMinBackoff,
+	}
+}
+
+var broadcasters = newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+	if b.codec == webrtc.Opus {
+		return audioControl(b, uArgs, stop)
+	}
+
+	return videoControl(b, uArgs.ivfHandle, uArgs, stop)
+})
+
+func (b *videoBroadcaster) stopping() bool {
+	return isClosed(b.stop)
+}
+
+// join returns the broadcaster for the device, codec and layer in uArgs,
+// starting its capture pipeline if it isn't already running
+func (r *broadcasterRegistry) join(uArgs userArguments) *videoBroadcaster {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := pipelineKey{device: uArgs.inputVideoPath, codec: uArgs.videoCodec, layer: uArgs.qualityLayer.Name}
+	b, ok := r.byPipeline[key]
+	if !ok {
+		b = newVideoBroadcaster(key.codec)
+		b.health.log = newPipelineLog(strings.TrimSpace(fmt.Sprintf("%s %s %s", key.device, key.codec, key.layer)))
+		if key.layer == "" && key.codec != webrtc.Opus && uArgs.replayWindow > 0 {
+			b.replay = newReplayBuffer(uArgs.replayWindow, replayMaxBytes)
+		}
+		r.byPipeline[key] = b
+	}
+
+	if b.running {
+		// the device is still held by the old ffmpeg, so wait for it to exit
+		b.restart = b.restart || b.stopping()
+		return b
+	}
+
+	r.launch(b, key, uArgs)
+
+	return b
+}
+
+// launch starts b's pipeline; the registry lock must be held
+func (r *broadcasterRegistry) launch(b *videoBroadcaster, key pipelineKey, uArgs userArguments) {
+	b.running = true
+	b.stop = make(chan struct{})
+	stop := b.stop
+	go func() {
+		r.supervise(b, key, uArgs, stop)
+		r.stopped(b, key, uArgs) // the next join starts a fresh pipeline
+	}()
+}
+
+func (r *broadcasterRegistry) stopped(b *videoBroadcaster, key pipelineKey, uArgs userArguments) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b.running = false
+	if b.restart {
+		b.restart = false
+		r.launch(b, key, uArgs)
+	}
+}
+
+// leave removes a viewer's track from b and stops b's pipeline if nobody
+// else starts watching within the idle timeout
+func (r *broadcasterRegistry) leave(b *videoBroadcaster, trackID uint64) {
+	b.removeTrack(trackID)
+	if b.viewerCount() > 0 {
+		return
+	}
+
+	time.AfterFunc(r.idleTimeout, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if b.running && !b.stopping() && b.viewerCount() == 0 {
+			close(b.stop)
+			b.restart = false
+		}
+	})
+}
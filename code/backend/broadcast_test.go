@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+type countingVideoTrack struct {
+	samples *int
+}
+
+func (ct countingVideoTrack) WriteSample(s media.Sample) error {
+	*ct.samples++
+	return nil
+}
+
+func TestVideoBroadcasterFanOut(t *testing.T) {
+	b := newVideoBroadcaster(webrtc.VP8)
+
+	first, second := 0, 0
+	firstID := b.addTrack(countingVideoTrack{samples: &first})
+	b.addTrack(countingVideoTrack{samples: &second})
+	b.addTrack(mockVideoTrackReturningError{})
+
+	if err := b.WriteSample(media.Sample{Data: []byte{0}, Samples: 90000}); err != nil {
+		t.Errorf("WriteSample failed with %s", err)
+	}
+
+	if first != 1 || second != 1 {
+		t.Errorf("each viewer should get one sample, got %d and %d", first, second)
+	}
+
+	b.removeTrack(firstID)
+	b.WriteSample(media.Sample{Data: []byte{0}, Samples: 90000})
+
+	if first != 1 || second != 2 {
+		t.Errorf("removed viewer still received samples, got %d and %d", first, second)
+	}
+
+	if b.viewerCount() != 2 {
+		t.Errorf("viewerCount is %d, should be 2", b.viewerCount())
+	}
+}
+
+// stopPipelines stops every pipeline registry is running and waits for them
+// to exit, so none outlive the test
+func stopPipelines(registry *broadcasterRegistry) {
+	registry.mu.Lock()
+	for _, b := range registry.byPipeline {
+		b.restart = false
+		if b.running && !b.stopping() {
+			close(b.stop)
+		}
+	}
+	registry.mu.Unlock()
+
+	for running := true; running; time.Sleep(time.Millisecond) {
+		registry.mu.Lock()
+		running = false
+		for _, b := range registry.byPipeline {
+			running = running || b.running
+		}
+		registry.mu.Unlock()
+	}
+}
+
+func TestBroadcasterRegistryJoin(t *testing.T) {
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	registry := newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+		started <- uArgs.inputVideoPath
+		<-release
+		return nil
+	})
+	registry.minBackoff = time.Millisecond
+	registry.stallTimeout = time.Hour
+	defer stopPipelines(registry)
+
+	one := registry.join(userArguments{inputVideoPath: "device"})
+	two := registry.join(userArguments{inputVideoPath: "device"})
+	if one != two {
+		t.Error("viewers of the same device got different broadcasters")
+	}
+
+	other := registry.join(userArguments{inputVideoPath: "other device"})
+	if other == one {
+		t.Error("different devices share a broadcaster")
+	}
+
+	<-started
+	<-started
+	select {
+	case device := <-started:
+		t.Errorf("a second pipeline was started for %s", device)
+	default:
+	}
+
+	close(release)
+	for running := true; running; time.Sleep(time.Millisecond) {
+		registry.mu.Lock()
+		running = one.running
+		registry.mu.Unlock()
+	}
+
+	if again := registry.join(userArguments{inputVideoPath: "device"}); again != one {
+		t.Error("restarting capture replaced the device's broadcaster")
+	}
+
+	if device := <-started; device != "device" {
+		t.Errorf("restarted pipeline for %s, should be device", device)
+	}
+}
+
+func TestBroadcasterRegistryStopsIdlePipeline(t *testing.T) {
+	started := make(chan (<-chan struct{}), 2)
+	registry := newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+		started <- stop
+		<-stop
+		return nil
+	})
+	registry.idleTimeout = 10 * time.Millisecond
+	registry.stallTimeout = time.Hour
+	defer stopPipelines(registry)
+
+	b := registry.join(userArguments{inputVideoPath: "device"})
+	id := b.addTrack(countingVideoTrack{})
+	stop := <-started
+
+	registry.leave(b, id)
+	select {
+	case <-stop:
+	case <-time.After(time.Second):
+		t.Fatal("pipeline wasn't stopped after its last viewer left")
+	}
+
+	// joining while the old pipeline winds down starts a new one after it
+	if again := registry.join(userArguments{inputVideoPath: "device"}); again != b {
+		t.Error("rejoining replaced the device's broadcaster")
+	}
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("pipeline wasn't restarted for the new viewer")
+	}
+}
+
+func TestBroadcasterRegistryKeepsWatchedPipeline(t *testing.T) {
+	stopped := make(chan struct{})
+	var once sync.Once
+	registry := newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+		<-stop
+		once.Do(func() { close(stopped) })
+		return nil
+	})
+	registry.idleTimeout = 10 * time.Millisecond
+	registry.stallTimeout = time.Hour
+	defer stopPipelines(registry)
+
+	b := registry.join(userArguments{inputVideoPath: "device"})
+	first := b.addTrack(countingVideoTrack{})
+	b.addTrack(countingVideoTrack{})
+
+	registry.leave(b, first)
+
+	// a viewer that comes back within the timeout keeps the pipeline too
+	last := b.addTrack(countingVideoTrack{})
+	registry.leave(b, last)
+	b.addTrack(countingVideoTrack{})
+
+	select {
+	case <-stopped:
+		t.Error("pipeline stopped while it still had viewers")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
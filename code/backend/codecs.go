@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	h264NalAccessUnitDelimiter = 9
+	h264NalIDR                 = 5
+	h264BaselineProfile        = "42"
+)
+
+// parseFmtp splits an SDP fmtp line such as
+// "packetization-mode=1;profile-level-id=42e01f" into its parameters
+func parseFmtp(line string) map[string]string {
+	params := map[string]string{}
+	for _, pair := range strings.Split(line, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = kv[1]
+		}
+	}
+
+	return params
+}
+
+// pion's H.264 payloader fragments large NALs with FU-A, which is only
+// allowed in packetization mode 1
+func h264Usable(codec *webrtc.RTPCodec) bool {
+	return parseFmtp(codec.SDPFmtpLine)["packetization-mode"] == "1"
+}
+
+// preferredH264 picks the offered H.264 variant closest to what ffmpeg
+// encodes, which is constrained baseline
+func preferredH264(codecs []*webrtc.RTPCodec) *webrtc.RTPCodec {
+	var usable *webrtc.RTPCodec
+	for _, codec := range codecs {
+		if codec.Name != webrtc.H264 || !h264Usable(codec) {
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToLower(parseFmtp(codec.SDPFmtpLine)["profile-level-id"]), h264BaselineProfile) {
+			return codec
+		}
+
+		if usable == nil {
+			usable = codec
+		}
+	}
+
+	return usable
+}
+
+// negotiateVideoCodec walks the offer's codecs in the browser's order of
+// preference and takes the first one we can encode. Safari puts H.264 first;
+// Chrome and Firefox put VP8 first.
+func negotiateVideoCodec(codecs []*webrtc.RTPCodec) (*webrtc.RTPCodec, error) {
+	for _, codec := range codecs {
+		switch codec.Name {
+		case webrtc.VP8:
+			return codec, nil
+		case webrtc.H264:
+			if h264 := preferredH264(codecs); h264 != nil {
+				return h264, nil
+			}
+		}
+	}
+
+	return nil, sdpError{category: sdpCodecError, err: fmt.Errorf("offer supports neither VP8 nor H264 in packetization mode 1")}
+}
+
+// encoderArgs are the ffmpeg output arguments that encode for codec and write
+// it to stdout
+func encoderArgs(platform, codec string, encoder encoderSettings) ([]string, error) {
+	var args []string
+	switch {
+	case codec == webrtc.VP8 && platform == osMac:
+		args = []string{"-pix_fmt", "yuv420p", "-g", "1", "-deadline", "realtime",
+			"-speed", "16", "-b", "3000k", "-an", "-f", "ivf", stdoutPipeTarget}
+	case codec == webrtc.VP8:
+		args = []string{"-g", "30", "-deadline", "realtime", "-f", "ivf", stdoutPipeTarget}
+	case codec == webrtc.H264:
+		// access unit delimiters let h264Reader find frame boundaries, and
+		// repeated headers let viewers join at any keyframe
+		args = []string{"-c:v", "libx264", "-profile:v", "baseline", "-pix_fmt", "yuv420p",
+			"-preset", "ultrafast", "-tune", "zerolatency", "-g", "30",
+			"-x264-params", "repeat-headers=1", "-bsf:v", "h264_metadata=aud=insert",
+			"-an", "-f", "h264", stdoutPipeTarget}
+	default:
+		return nil, fmt.Errorf("codec %s not supported", codec)
+	}
+
+	if encoder.KeyframeInterval > 0 {
+		args = withOption(args, "-g", strconv.Itoa(encoder.KeyframeInterval))
+	}
+
+	if encoder.Bitrate != "" {
+		args = withOption(args, "-b", encoder.Bitrate)
+	}
+
+	return insertBeforeOutput(forceKeyframes(args), encoder.ExtraArgs...), nil
+}
+
+// withOption sets ffmpeg option name to value, adding it if args don't
+// already have it
+func withOption(args []string, name, value string) []string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == name {
+			args[i+1] = value
+			return args
+		}
+	}
+
+	return insertBeforeOutput(args, name, value)
+}
+
+// insertBeforeOutput puts extra ahead of the trailing "-f format target"
+func insertBeforeOutput(args []string, extra ...string) []string {
+	output := len(args) - 3
+	withExtra := append(append([]string{}, args[:output]...), extra...)
+
+	return append(withExtra, args[output:]...)
+}
+
+// ivfFourCC is the IVF header tag for frames of codec
+func ivfFourCC(codec string) string {
+	if codec == webrtc.H264 {
+		return "H264"
+	}
+
+	return "VP80"
+}
+
+// isKeyframe reports whether a frame of codec can be decoded on its own
+func isKeyframe(codec string, frame []byte) bool {
+	if codec == webrtc.Opus {
+		return true // every Opus packet decodes on its own
+	}
+
+	if codec != webrtc.H264 {
+		return isVP8Keyframe(frame)
+	}
+
+	zeros := 0
+	for i, b := range frame {
+		if b == 1 && zeros >= 2 && i+1 < len(frame) && frame[i+1]&0x1f == h264NalIDR {
+			return true
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"atn/code/backend/internal/signal"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func h264Codec(payloadType uint8, fmtp string) *webrtc.RTPCodec {
+	codec := webrtc.NewRTPH264Codec(payloadType, 90000)
+	codec.SDPFmtpLine = fmtp
+
+	return codec
+}
+
+func TestNegotiateVideoCodec(t *testing.T) {
+	vp8 := webrtc.NewRTPVP8Codec(96, 90000)
+	vp9 := webrtc.NewRTPVP9Codec(98, 90000)
+	high := h264Codec(100, "packetization-mode=1;profile-level-id=640c1f")
+	baseline := h264Codec(102, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f")
+	singleNal := h264Codec(104, "profile-level-id=42e01f")
+
+	tests := []struct {
+		name   string
+		offer  []*webrtc.RTPCodec
+		chosen *webrtc.RTPCodec
+	}{
+		{"vp8 first", []*webrtc.RTPCodec{vp8, baseline}, vp8},
+		{"h264 first", []*webrtc.RTPCodec{high, vp8, baseline}, baseline},
+		{"only high profile", []*webrtc.RTPCodec{vp9, high}, high},
+		{"skips packetization mode 0", []*webrtc.RTPCodec{singleNal, vp8}, vp8},
+		{"nothing usable", []*webrtc.RTPCodec{vp9, singleNal}, nil},
+	}
+
+	for _, test := range tests {
+		chosen, err := negotiateVideoCodec(test.offer)
+		if test.chosen == nil {
+			if sdpErr, ok := err.(sdpError); !ok || sdpErr.category != sdpCodecError {
+				t.Errorf("%s: expected a codec error, got %v", test.name, err)
+			}
+			continue
+		}
+
+		if err != nil || chosen != test.chosen {
+			t.Errorf("%s: chose %v (%v), should have chosen %s %s", test.name, chosen, err, test.chosen.Name, test.chosen.SDPFmtpLine)
+		}
+	}
+}
+
+func TestComposeStreamCommandH264(t *testing.T) {
+	linux, err := composeStreamCommand("device", osLinux, "1920x1080", webrtc.H264, encoderSettings{})
+	if err != nil {
+		t.Fatalf("composeStreamCommand failed with %s", err)
+	}
+
+	args := strings.Join(linux.Args, " ")
+	for _, want := range []string{"-i device", "-c:v libx264", "h264_metadata=aud=insert", "-f h264 " + stdoutPipeTarget} {
+		if !strings.Contains(args, want) {
+			t.Errorf("command %q is missing %q", args, want)
+		}
+	}
+
+	if _, err = composeStreamCommand("device", osLinux, "1920x1080", webrtc.VP9, encoderSettings{}); err == nil {
+		t.Error("composeStreamCommand accepted VP9")
+	}
+}
+
+func TestIsKeyframe(t *testing.T) {
+	idr := []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x67, 0x42, 0, 0, 1, 0x65, 0x88}
+	nonIDR := []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 1, 0x41, 0x9a}
+
+	if !isKeyframe(webrtc.H264, idr) {
+		t.Error("IDR access unit wasn't a keyframe")
+	}
+
+	if isKeyframe(webrtc.H264, nonIDR) {
+		t.Error("non-IDR access unit was a keyframe")
+	}
+
+	if !isKeyframe(webrtc.VP8, []byte{0x10}) || isKeyframe(webrtc.VP8, []byte{0x11}) {
+		t.Error("isKeyframe disagrees with isVP8Keyframe")
+	}
+}
+
+func TestRunNegotiatesH264(t *testing.T) {
+	var offer webrtc.SessionDescription
+	if err := signal.Decode(testOffer, &offer); err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	// turn the Firefox VP8 offer into an H.264 one, the way Safari sends it
+	offer.SDP = strings.Replace(offer.SDP, "a=rtpmap:120 VP8/90000", "a=rtpmap:120 H264/90000", 1)
+	offer.SDP = strings.Replace(offer.SDP, "a=fmtp:120 max-fs=12288;max-fr=60", "a=fmtp:120 packetization-mode=1;profile-level-id=42e01f", 1)
+
+	mockArgs := userArguments{
+		sessionDescription: signal.Encode(offer),
+		inputVideoPath:     "h264 device",
+		inputResolution:    "1920x1080",
+		videoIsLive:        true,
+		operatingSys:       osLinux,
+		ivfHandle:          testIvfFile,
+		iceServers:         []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+	}
+
+	answer, err := run(mockArgs)
+	if err != nil {
+		t.Fatalf("run failed with %s", err)
+	}
+
+	var description webrtc.SessionDescription
+	if err = signal.Decode(answer.ServerSdp, &description); err != nil {
+		t.Fatalf("bad answer: %s", err)
+	}
+
+	if !strings.Contains(description.SDP, "H264/90000") {
+		t.Errorf("answer doesn't use H264:\n%s", description.SDP)
+	}
+}
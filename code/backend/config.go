@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/spf13/pflag"
+)
+
+const configEnvPrefix = "ASV_"
+
+type serverConfig struct {
+	Listen      string `json:"listen"`
+	FrontendDir string `json:"frontendDir"`
+}
+
+type videoConfig struct {
+	Device     string        `json:"device"`
+	Resolution string        `json:"resolution"`
+	RunCleanup bool          `json:"runCleanup"`        // obsolete: live capture no longer leaves an output file
+	Sources    []videoSource `json:"sources,omitempty"` // named devices, used instead of device
+	Adaptive   bool          `json:"adaptiveBitrate"`   // lower quality layers for viewers on poor networks
+	LatencyMs  int           `json:"latencyBudgetMs"`   // how far behind live video may fall, 0 to never skip
+	ReplaySecs int           `json:"replaySeconds"`     // how much of each source is kept for instant replay, 0 for none
+}
+
+type audioConfig struct {
+	Device          string `json:"device"`          // captured for narration; empty for no audio
+	TalkbackOutput  string `json:"talkbackOutput"`  // where viewers talking back are played; empty to not play them
+	TalkbackForward bool   `json:"talkbackForward"` // send viewers talking back to the other viewers
+}
+
+// encoderSettings tune the ffmpeg encode. Zero values keep the platform's
+// defaults from composeStreamCommand.
+type encoderSettings struct {
+	Threads          int      `json:"threads,omitempty"`
+	KeyframeInterval int      `json:"keyframeInterval,omitempty"`
+	Bitrate          string   `json:"bitrate,omitempty"`
+	ExtraArgs        []string `json:"extraArgs,omitempty"` // added just before the output
+}
+
+type iceSettings struct {
+	Servers []string `json:"servers"` // as given to --ice-server
+}
+
+type storageConfig struct {
+	RecordingDir    string `json:"recordingDir"`
+	StepsFile       string `json:"stepsFile"`
+	AnnotationsFile string `json:"annotationsFile"`
+	SnapshotDir     string `json:"snapshotDir"`
+}
+
+// config is everything that can be set from the config file. Values are
+// layered: defaults, then the file, then ASV_* environment variables, then
+// flags.
+type config struct {
+	Server  serverConfig    `json:"server"`
+	Video   videoConfig     `json:"video"`
+	Audio   audioConfig     `json:"audio"`
+	Encoder encoderSettings `json:"encoder"`
+	ICE     iceSettings     `json:"ice"`
+	Storage storageConfig   `json:"storage"`
+	TLS     tlsSettings     `json:"tls"`
+	Auth    authSettings    `json:"auth"`
+}
+
+func defaultConfig() config {
+	return config{
+		Server: serverConfig{Listen: ":3000", FrontendDir: "../frontend/build"},
+		Video:  videoConfig{Resolution: "1920x1080", RunCleanup: true, Adaptive: true, LatencyMs: int(defaultLatencyBudget / time.Millisecond), ReplaySecs: int(defaultReplayWindow / time.Second)},
+		Audio:  audioConfig{TalkbackForward: true},
+		ICE:    iceSettings{Servers: []string{"stun:stun.l.google.com:19302"}},
+		Storage: storageConfig{
+			RecordingDir:    "recordings",
+			StepsFile:       "steps.json",
+			AnnotationsFile: "annotations.jsonl",
+			SnapshotDir:     "snapshots",
+		},
+		Auth: authSettings{UsersFile: "users.json"},
+	}
+}
+
+// configSetting ties a flag to the config field it overrides. The same value
+// can come from the environment as ASV_ plus the flag name in upper snake
+// case, so --video-device is ASV_VIDEO_DEVICE.
+type configSetting struct {
+	flag string
+	list bool // comma separated in the environment, repeatable as a flag
+	set  func(c *config, values []string) error
+}
+
+func stringSetting(field func(c *config) *string) func(*config, []string) error {
+	return func(c *config, values []string) error {
+		*field(c) = values[0]
+		return nil
+	}
+}
+
+func boolSetting(field func(c *config) *bool) func(*config, []string) error {
+	return func(c *config, values []string) error {
+		b, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return err
+		}
+
+		*field(c) = b
+		return nil
+	}
+}
+
+func intSetting(field func(c *config) *int) func(*config, []string) error {
+	return func(c *config, values []string) error {
+		i, err := strconv.Atoi(values[0])
+		if err != nil {
+			return err
+		}
+
+		*field(c) = i
+		return nil
+	}
+}
+
+// configSettings are applied in order, so --ice-server beats --stun-server
+var configSettings = []configSetting{
+	{flag: "serve-on", set: stringSetting(func(c *config) *string { return &c.Server.Listen })},
+	{flag: "frontend-dir", set: stringSetting(func(c *config) *string { return &c.Server.FrontendDir })},
+	{flag: "video-device", set: stringSetting(func(c *config) *string { return &c.Video.Device })},
+	{flag: "input-resolution", set: stringSetting(func(c *config) *string { return &c.Video.Resolution })},
+	{flag: "run-cleanup", set: boolSetting(func(c *config) *bool { return &c.Video.RunCleanup })},
+	{flag: "source", list: true, set: func(c *config, values []string) error {
+		c.Video.Sources = nil
+		for _, value := range values {
+			src, err := parseSource(value)
+			if err != nil {
+				return err
+			}
+
+			c.Video.Sources = append(c.Video.Sources, src)
+		}
+
+		return nil
+	}},
+	{flag: "audio-device", set: stringSetting(func(c *config) *string { return &c.Audio.Device })},
+	{flag: "talkback-output", set: stringSetting(func(c *config) *string { return &c.Audio.TalkbackOutput })},
+	{flag: "talkback-forward", set: boolSetting(func(c *config) *bool { return &c.Audio.TalkbackForward })},
+	{flag: "adaptive-bitrate", set: boolSetting(func(c *config) *bool { return &c.Video.Adaptive })},
+	{flag: "latency-budget", set: intSetting(func(c *config) *int { return &c.Video.LatencyMs })},
+	{flag: "replay-seconds", set: intSetting(func(c *config) *int { return &c.Video.ReplaySecs })},
+	{flag: "encoder-threads", set: intSetting(func(c *config) *int { return &c.Encoder.Threads })},
+	{flag: "keyframe-interval", set: intSetting(func(c *config) *int { return &c.Encoder.KeyframeInterval })},
+	{flag: "bitrate", set: stringSetting(func(c *config) *string { return &c.Encoder.Bitrate })},
+	{flag: "stun-server", set: func(c *config, values []string) error {
+		c.ICE.Servers = []string{values[0]}
+		return nil
+	}},
+	{flag: "ice-server", list: true, set: func(c *config, values []string) error {
+		c.ICE.Servers = values
+		return nil
+	}},
+	{flag: "recording-dir", set: stringSetting(func(c *config) *string { return &c.Storage.RecordingDir })},
+	{flag: "steps-file", set: stringSetting(func(c *config) *string { return &c.Storage.StepsFile })},
+	{flag: "annotations-file", set: stringSetting(func(c *config) *string { return &c.Storage.AnnotationsFile })},
+	{flag: "snapshot-dir", set: stringSetting(func(c *config) *string { return &c.Storage.SnapshotDir })},
+	{flag: "tls-cert", set: stringSetting(func(c *config) *string { return &c.TLS.CertFile })},
+	{flag: "tls-key", set: stringSetting(func(c *config) *string { return &c.TLS.KeyFile })},
+	{flag: "tls-self-signed", set: boolSetting(func(c *config) *bool { return &c.TLS.SelfSigned })},
+	{flag: "redirect-http", set: stringSetting(func(c *config) *string { return &c.TLS.RedirectHTTP })},
+	{flag: "auth", set: boolSetting(func(c *config) *bool { return &c.Auth.Enabled })},
+	{flag: "users-file", set: stringSetting(func(c *config) *string { return &c.Auth.UsersFile })},
+}
+
+func envName(flag string) string {
+	return configEnvPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// defineConfigFlags adds a flag for every config setting, showing the
+// defaults as their defaults
+func defineConfigFlags(fs *pflag.FlagSet) {
+	d := defaultConfig()
+
+	fs.String("config", "", "JSON config file; "+configEnvPrefix+"* environment variables and flags override it")
+	fs.Bool("print-config", false, "print the effective configuration as JSON and exit")
+	fs.String("serve-on", d.Server.Listen, "port to serve on")
+	fs.String("frontend-dir", d.Server.FrontendDir, "directory of the built frontend")
+	fs.String("video-device", d.Video.Device, "path to the video device or it's name (probably \"FHD Capture\" or /dev/video2)")
+	fs.String("input-resolution", d.Video.Resolution, "resolution of camera/input device")
+	fs.Bool("run-cleanup", d.Video.RunCleanup, "obsolete and ignored; live capture no longer leaves output files to clean up")
+	fs.StringArray("source", nil, "named capture device such as scope=/dev/video2@1280x720, repeatable; replaces --video-device")
+	fs.String("audio-device", d.Audio.Device, "audio device to narrate with, such as hw:1 or a dshow or avfoundation name; empty for no audio")
+	fs.String("talkback-output", d.Audio.TalkbackOutput, "audio output to play consultants talking back on, such as default or an audiotoolbox index; empty to not play them")
+	fs.Bool("talkback-forward", d.Audio.TalkbackForward, "send consultants talking back to the other viewers")
+	fs.Bool("adaptive-bitrate", d.Video.Adaptive, "move viewers to lower quality layers when RTCP shows their network can't keep up")
+	fs.Int("latency-budget", d.Video.LatencyMs, "milliseconds live video may fall behind before skipping ahead to a keyframe, 0 to never skip")
+	fs.Int("replay-seconds", d.Video.ReplaySecs, "seconds of each source kept in memory for viewers to replay, 0 for none")
+	fs.Int("encoder-threads", d.Encoder.Threads, "ffmpeg threads, 0 for the platform default")
+	fs.Int("keyframe-interval", d.Encoder.KeyframeInterval, "frames between keyframes, 0 for the platform default; live video still gets one at least every 2s")
+	fs.String("bitrate", d.Encoder.Bitrate, "target bitrate such as 3000k, empty for the platform default")
+	fs.String("stun-server", d.ICE.Servers[0], "stun server to use when no --ice-server is given")
+	fs.StringArray("ice-server", nil, "STUN or TURN server, repeatable; TURN takes credentials like turn:user:pass@host:3478")
+	fs.String("recording-dir", d.Storage.RecordingDir, "directory session recordings are saved in")
+	fs.String("steps-file", d.Storage.StepsFile, "file surgical step lists are saved in")
+	fs.String("annotations-file", d.Storage.AnnotationsFile, "file frame annotations are saved in")
+	fs.String("snapshot-dir", d.Storage.SnapshotDir, "directory freeze frame snapshots are saved in")
+	fs.String("tls-cert", d.TLS.CertFile, "certificate to serve HTTPS with; reloaded on change or SIGHUP")
+	fs.String("tls-key", d.TLS.KeyFile, "private key for --tls-cert")
+	fs.Bool("tls-self-signed", d.TLS.SelfSigned, "serve HTTPS, generating a self-signed certificate if there isn't one")
+	fs.String("redirect-http", d.TLS.RedirectHTTP, "address such as :80 to redirect plain HTTP to HTTPS from")
+	fs.Bool("auth", d.Auth.Enabled, "require sign in, with presenter and viewer roles from --users-file")
+	fs.String("users-file", d.Auth.UsersFile, "users and join tokens for --auth")
+	fs.Bool("hash-password", false, "read a password from stdin, print its bcrypt hash for --users-file and exit")
+}
+
+// loadConfigFile overlays the file at path onto c. Unknown keys are errors,
+// since a misspelt key would otherwise be silently ignored.
+func loadConfigFile(c *config, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf("config file %s error: %s", path, err)
+	}
+
+	return nil
+}
+
+// loadConfig merges the defaults, the config file, the environment and the
+// flags that were set on the command line
+func loadConfig(fs *pflag.FlagSet, getenv func(string) string) (config, error) {
+	c := defaultConfig()
+
+	path, _ := fs.GetString("config")
+	if !fs.Changed("config") && getenv(envName("config")) != "" {
+		path = getenv(envName("config"))
+	}
+
+	if path != "" {
+		if err := loadConfigFile(&c, path); err != nil {
+			return config{}, err
+		}
+	}
+
+	for _, setting := range configSettings {
+		value := getenv(envName(setting.flag))
+		if value == "" {
+			continue
+		}
+
+		values := []string{value}
+		if setting.list {
+			values = strings.Split(value, ",")
+		}
+
+		if err := setting.set(&c, values); err != nil {
+			return config{}, fmt.Errorf("%s error: %s", envName(setting.flag), err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		f := fs.Lookup(setting.flag)
+		if f == nil || !f.Changed {
+			continue
+		}
+
+		values := []string{f.Value.String()}
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			values = slice.GetSlice()
+		}
+
+		if err := setting.set(&c, values); err != nil {
+			return config{}, fmt.Errorf("--%s error: %s", setting.flag, err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c config) print(out io.Writer) error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "%s\n", b)
+
+	return err
+}
+
+// arguments turns the configuration into what the server runs with
+func (c config) arguments() (userArguments, error) {
+	iceServers, err := parseICEServers(c.ICE.Servers)
+	if err != nil {
+		return userArguments{}, err
+	}
+
+	sources, err := resolveSources(c.Video.Sources, c.Video.Device, c.Video.Resolution)
+	if err != nil {
+		return userArguments{}, err
+	}
+
+	return userArguments{
+		sessionDescription: "",
+		inputVideoPath:     sources[0].Device,
+		inputResolution:    sources[0].Resolution,
+		runCleanup:         c.Video.RunCleanup,
+		adaptiveBitrate:    c.Video.Adaptive,
+		latencyBudget:      time.Duration(c.Video.LatencyMs) * time.Millisecond,
+		replayWindow:       time.Duration(c.Video.ReplaySecs) * time.Second,
+		videoIsLive:        true,
+		operatingSys:       runtime.GOOS,
+		ivfHandle:          ivfFileHandle,
+		iceServers:         iceServers,
+		sources:            sources,
+		serveOn:            c.Server.Listen,
+		frontendDir:        c.Server.FrontendDir,
+		encoder:            c.Encoder,
+		recordingDir:       c.Storage.RecordingDir,
+		stepsFile:          c.Storage.StepsFile,
+		annotationsFile:    c.Storage.AnnotationsFile,
+		snapshotDir:        c.Storage.SnapshotDir,
+		audioDevice:        c.Audio.Device,
+		talkbackOutput:     c.Audio.TalkbackOutput,
+		talkbackForward:    c.Audio.TalkbackForward,
+		tls:                c.TLS,
+		auth:               c.Auth,
+		videoCodec:         webrtc.VP8,
+	}, nil
+}
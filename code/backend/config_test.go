@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/spf13/pflag"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "asv-*.json")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+	defer file.Close()
+
+	if _, err = file.WriteString(contents); err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	return file.Name()
+}
+
+func parseConfigFlags(t *testing.T, args ...string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet("asv", pflag.ContinueOnError)
+	defineConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	return fs
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"video": {"device": "/dev/video2", "resolution": "1280x720"},
+		"encoder": {"bitrate": "2000k", "threads": 2},
+		"storage": {"stepsFile": "file-steps.json"}
+	}`)
+	defer os.Remove(path)
+
+	env := map[string]string{
+		"ASV_INPUT_RESOLUTION": "640x480",
+		"ASV_ICE_SERVER":       "stun:one.example.com:3478,turn:u:p@two.example.com:3478",
+		"ASV_STEPS_FILE":       "env-steps.json",
+	}
+
+	fs := parseConfigFlags(t, "--config", path, "--steps-file", "flag-steps.json", "--keyframe-interval", "15")
+	c, err := loadConfig(fs, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("loadConfig failed with %s", err)
+	}
+
+	expected := defaultConfig()
+	expected.Video.Device = "/dev/video2" // file
+	expected.Video.Resolution = "640x480" // environment beats file
+	expected.Encoder = encoderSettings{Threads: 2, KeyframeInterval: 15, Bitrate: "2000k"}
+	expected.ICE.Servers = []string{"stun:one.example.com:3478", "turn:u:p@two.example.com:3478"}
+	expected.Storage.StepsFile = "flag-steps.json" // flag beats environment
+
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("got %+v, should be %+v", c, expected)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	noEnv := func(string) string { return "" }
+
+	misspelt := writeConfigFile(t, `{"video": {"devise": "/dev/video2"}}`)
+	defer os.Remove(misspelt)
+	if _, err := loadConfig(parseConfigFlags(t, "--config", misspelt), noEnv); err == nil {
+		t.Error("config with an unknown key loaded")
+	}
+
+	if _, err := loadConfig(parseConfigFlags(t, "--config", "does-not-exist.json"), noEnv); err == nil {
+		t.Error("missing config file loaded")
+	}
+
+	badEnv := func(name string) string {
+		if name == "ASV_RUN_CLEANUP" {
+			return "sometimes"
+		}
+		return ""
+	}
+	if _, err := loadConfig(parseConfigFlags(t), badEnv); err == nil {
+		t.Error("non-boolean ASV_RUN_CLEANUP loaded")
+	}
+}
+
+func TestStunServerFlag(t *testing.T) {
+	noEnv := func(string) string { return "" }
+
+	c, _ := loadConfig(parseConfigFlags(t, "--stun-server", "stun:mine.example.com:3478"), noEnv)
+	if !reflect.DeepEqual(c.ICE.Servers, []string{"stun:mine.example.com:3478"}) {
+		t.Errorf("--stun-server gave %v", c.ICE.Servers)
+	}
+
+	c, _ = loadConfig(parseConfigFlags(t, "--stun-server", "stun:mine.example.com:3478", "--ice-server", "stun:a.example.com", "--ice-server", "stun:b.example.com"), noEnv)
+	if !reflect.DeepEqual(c.ICE.Servers, []string{"stun:a.example.com", "stun:b.example.com"}) {
+		t.Errorf("--ice-server should beat --stun-server, gave %v", c.ICE.Servers)
+	}
+}
+
+func TestSourceFlags(t *testing.T) {
+	noEnv := func(string) string { return "" }
+
+	c, err := loadConfig(parseConfigFlags(t, "--source", "scope=/dev/video2@1280x720", "--source", "room=/dev/video4"), noEnv)
+	if err != nil {
+		t.Fatalf("loadConfig failed with %s", err)
+	}
+
+	args, err := c.arguments()
+	if err != nil {
+		t.Fatalf("arguments failed with %s", err)
+	}
+
+	expected := []videoSource{
+		{Name: "scope", Device: "/dev/video2", Resolution: "1280x720"},
+		{Name: "room", Device: "/dev/video4", Resolution: "1920x1080"},
+	}
+	if !reflect.DeepEqual(args.sources, expected) || args.inputVideoPath != "/dev/video2" {
+		t.Errorf("--source gave %+v, device %s", args.sources, args.inputVideoPath)
+	}
+
+	if _, err = loadConfig(parseConfigFlags(t, "--source", "/dev/video2"), noEnv); err == nil {
+		t.Error("a source without a name loaded")
+	}
+}
+
+func TestPrintConfigRoundTrips(t *testing.T) {
+	c := defaultConfig()
+	c.Encoder.ExtraArgs = []string{"-crf", "30"}
+
+	var out bytes.Buffer
+	if err := c.print(&out); err != nil {
+		t.Fatalf("print failed with %s", err)
+	}
+
+	path := writeConfigFile(t, out.String())
+	defer os.Remove(path)
+
+	loaded := defaultConfig()
+	if err := loadConfigFile(&loaded, path); err != nil {
+		t.Fatalf("printed config didn't load: %s", err)
+	}
+
+	if !reflect.DeepEqual(loaded, c) {
+		t.Errorf("round trip gave %+v, should be %+v", loaded, c)
+	}
+
+	var generic map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &generic); err != nil || generic["storage"] == nil {
+		t.Errorf("printed config isn't the expected JSON: %s", out.String())
+	}
+}
+
+func TestEncoderSettingsInCommand(t *testing.T) {
+	encoder := encoderSettings{Threads: 8, KeyframeInterval: 60, Bitrate: "1500k", ExtraArgs: []string{"-cpu-used", "8"}}
+
+	linux, err := composeStreamCommand("device", osLinux, "1920x1080", webrtc.VP8, encoder)
+	if err != nil {
+		t.Fatalf("composeStreamCommand failed with %s", err)
+	}
+
+	expected := []string{"ffmpeg", "-threads", "8", "-y", "-f", "video4linux2", "-s", "1920x1080", "-i", "device",
+		"-g", "60", "-deadline", "realtime", "-b", "1500k", "-force_key_frames", "expr:gte(t,n_forced*2)", "-cpu-used", "8",
+		"-f", "ivf", stdoutPipeTarget}
+	if !reflect.DeepEqual(linux.Args, expected) {
+		t.Errorf("got %v, should be %v", linux.Args, expected)
+	}
+
+	mac, err := composeStreamCommand("device", osMac, "1920x1080", webrtc.VP8, encoderSettings{Bitrate: "1500k"})
+	if err != nil {
+		t.Fatalf("composeStreamCommand failed with %s", err)
+	}
+
+	if args := mac.Args; args[len(args)-7] != "1500k" || args[len(args)-8] != "-b" {
+		t.Errorf("mac bitrate wasn't replaced: %v", args)
+	}
+}
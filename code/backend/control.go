@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	controlChannelLabel    = "control"
+	controlChannelID       = 0 // negotiated, so both ends open it with this id instead of announcing it
+	controlChannelProtocol = "atn-events"
+	controlPingInterval    = 5 * time.Second
+
+	pingEvent   = "ping"
+	pongEvent   = "pong"
+	noticeEvent = "notice"
+)
+
+// controlChannel is the part of a DataChannel the control loop uses
+type controlChannel interface {
+	SendText(s string) error
+	OnMessage(f func(msg webrtc.DataChannelMessage))
+	OnClose(f func())
+}
+
+// pingData is sent with a ping and echoed back unchanged in the pong
+type pingData struct {
+	SentAt int64 `json:"sentAt"` // the sender's clock, in nanoseconds
+}
+
+// noticeData is a message from the server for people to read
+type noticeData struct {
+	Level string `json:"level"` // info or warning
+	Text  string `json:"text"`
+}
+
+// offersDataChannel reports whether the browser's offer has a section for
+// data channels; older pages only ask for video
+func offersDataChannel(sdp string) bool {
+	return strings.Contains(sdp, "m=application")
+}
+
+// openControlChannel adds the session's control channel, a negotiated data
+// channel carrying the same messages as /api/events. It joins the event hub
+// once it opens, so a session gets annotations, presentation changes and
+// notices without a WebSocket, and is pinged to measure its round trip.
+func (s *viewerSession) openControlChannel(hub *eventHub) error {
+	negotiated := true
+	id := uint16(controlChannelID)
+	protocol := controlChannelProtocol
+
+	dc, err := s.pc.CreateDataChannel(controlChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+		Protocol:   &protocol,
+	})
+	if err != nil {
+		return err
+	}
+
+	dc.OnOpen(func() { s.serveControl(hub, dc) })
+
+	return nil
+}
+
+// serveControl joins dc to hub until either is closed
+func (s *viewerSession) serveControl(hub *eventHub, dc controlChannel) {
+	done := make(chan struct{})
+	client := hub.join(identity{Name: s.args.viewerName, Role: s.args.viewerRole}, func(msg []byte) error {
+		return dc.SendText(string(msg))
+	}, func() { close(done) })
+
+	s.mu.Lock()
+	s.control = client
+	s.hub = hub
+	s.mu.Unlock()
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) { hub.receive(client, msg.Data) })
+	dc.OnClose(func() { hub.unregister(client) })
+
+	go s.pingControl(hub, client, done)
+}
+
+// pingControl pings the browser until done is closed; its pongs are timed by
+// onPong
+func (s *viewerSession) pingControl(hub *eventHub, client *hubClient, done <-chan struct{}) {
+	ticker := time.NewTicker(controlPingInterval)
+	defer ticker.Stop()
+
+	for {
+		hub.sendTo(client, pingEvent, pingData{SentAt: time.Now().UnixNano()})
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// notice tells the session's viewer something, if it has a control channel
+func (s *viewerSession) notice(level, text string) {
+	s.mu.Lock()
+	client, hub := s.control, s.hub
+	s.mu.Unlock()
+
+	if client != nil {
+		hub.sendTo(client, noticeEvent, noticeData{Level: level, Text: text})
+	}
+}
+
+// byControlClient finds the session whose control channel is client
+func (r *sessionRegistry) byControlClient(client *hubClient) *viewerSession {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, s := range r.sessions {
+		s.mu.Lock()
+		found := s.control == client
+		s.mu.Unlock()
+
+		if found {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// onPing answers a ping from a browser timing its own round trip
+func onPing(hub *eventHub) hubHandler {
+	return func(from *hubClient, data json.RawMessage) error {
+		var ping pingData
+		if err := json.Unmarshal(data, &ping); err != nil {
+			return err
+		}
+
+		hub.sendTo(from, pongEvent, ping)
+
+		return nil
+	}
+}
+
+// onPong times the answer to one of our pings, for the session's latency
+// estimate when its browser doesn't report one
+func (r *sessionRegistry) onPong(from *hubClient, data json.RawMessage) error {
+	var pong pingData
+	if err := json.Unmarshal(data, &pong); err != nil {
+		return err
+	}
+
+	s := r.byControlClient(from)
+	if s == nil || pong.SentAt == 0 {
+		return nil // a WebSocket client answering a ping it was never sent
+	}
+
+	s.roundTrip.record(time.Since(time.Unix(0, pong.SentAt)))
+
+	return nil
+}
+
+func registerControlHandlers(r *sessionRegistry, hub *eventHub) {
+	hub.on(pingEvent, onPing(hub))
+	hub.on(pongEvent, r.onPong)
+}
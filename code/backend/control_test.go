@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// fakeControlChannel hands what the server sends to a channel and lets the
+// test play the browser
+type fakeControlChannel struct {
+	sent    chan hubMessage
+	receive func(msg webrtc.DataChannelMessage)
+	close   func()
+}
+
+func newFakeControlChannel() *fakeControlChannel {
+	return &fakeControlChannel{sent: make(chan hubMessage, hubSendBuffer)}
+}
+
+func (c *fakeControlChannel) SendText(s string) error {
+	var msg hubMessage
+	if err := json.Unmarshal([]byte(s), &msg); err != nil {
+		return err
+	}
+
+	c.sent <- msg
+
+	return nil
+}
+
+func (c *fakeControlChannel) OnMessage(f func(msg webrtc.DataChannelMessage)) {
+	c.receive = f
+}
+
+func (c *fakeControlChannel) OnClose(f func()) {
+	c.close = f
+}
+
+func (c *fakeControlChannel) browserSends(text string) {
+	c.receive(webrtc.DataChannelMessage{IsString: true, Data: []byte(text)})
+}
+
+// next returns the next message of msgType the server sent
+func (c *fakeControlChannel) next(t *testing.T, msgType string) hubMessage {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg := <-c.sent:
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %s message was sent", msgType)
+		}
+	}
+}
+
+func TestControlChannel(t *testing.T) {
+	hub := newEventHub()
+	registry := newSessionRegistry()
+	registerControlHandlers(registry, hub)
+
+	s := newViewerSession(nil)
+	s.args.viewerRole = roleViewer
+	registry.add(s)
+
+	dc := newFakeControlChannel()
+	s.serveControl(hub, dc)
+
+	if welcome := dc.next(t, hubWelcome); welcome.Version != hubProtocolVersion {
+		t.Errorf("welcome was version %d", welcome.Version)
+	}
+
+	// the server times its pings from the browser's pongs
+	ping := dc.next(t, pingEvent)
+	dc.browserSends(fmt.Sprintf(`{"v": 1, "type": "pong", "data": %s}`, ping.Data))
+	if !s.roundTrip.samples {
+		t.Error("the pong wasn't timed")
+	}
+
+	// and answers the browser's
+	dc.browserSends(`{"v": 1, "type": "ping", "data": {"sentAt": 42}}`)
+	if pong := dc.next(t, pongEvent); !strings.Contains(string(pong.Data), "42") {
+		t.Errorf("pong carried %s", pong.Data)
+	}
+
+	// events for every viewer come over the channel too
+	hub.publish(annotationEvent, "drawn", "")
+	dc.next(t, annotationEvent)
+
+	s.notice("info", "recording started")
+	if notice := dc.next(t, noticeEvent); !strings.Contains(string(notice.Data), "recording started") {
+		t.Errorf("notice carried %s", notice.Data)
+	}
+
+	dc.browserSends(`{"v": 2, "type": "ping", "data": {}}`)
+	if e := dc.next(t, hubError); !strings.Contains(string(e.Data), "version 2") {
+		t.Errorf("a newer protocol got %s", e.Data)
+	}
+
+	dc.close()
+	if _, ok := hub.clients[s.control.id]; ok {
+		t.Error("the closed channel is still a hub client")
+	}
+}
+
+func TestOffersDataChannel(t *testing.T) {
+	if offersDataChannel("v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\n") {
+		t.Error("a video only offer has no data channel")
+	}
+
+	if !offersDataChannel("v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n") {
+		t.Error("the application section wasn't found")
+	}
+}
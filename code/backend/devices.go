@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// deviceMode is one way a device can capture
+type deviceMode struct {
+	Format     string    `json:"format"`     // pixel format or codec, as the driver names it
+	Resolution string    `json:"resolution"` // as given to --input-resolution
+	FrameRates []float64 `json:"frameRates"`
+}
+
+// captureDevice is a camera or capture card found on this machine
+type captureDevice struct {
+	Name   string       `json:"name"`
+	Device string       `json:"device"` // what to pass as --video-device or in --source
+	Modes  []deviceMode `json:"modes"`
+}
+
+// ffmpegOutput runs ffmpeg and returns what it logged. Listing devices
+// always ends in an error, since there's no real input, so only failing to
+// run ffmpeg at all counts.
+var ffmpegOutput = func(args ...string) (string, error) {
+	out, err := exec.Command("ffmpeg", append([]string{"-hide_banner"}, args...)...).CombinedOutput()
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		return "", fmt.Errorf("ffmpeg error: %s", err)
+	}
+
+	return string(out), nil
+}
+
+// listDevices finds the capture devices for platform, the same way
+// videoDriver picks the ffmpeg input for it
+func listDevices(platform string) ([]captureDevice, error) {
+	switch platform {
+	case osLinux:
+		return listV4L2Devices()
+	case osMac:
+		return listAVFoundationDevices()
+	case osWindows:
+		return listDShowDevices()
+
+	default:
+		return nil, fmt.Errorf("%s not supported", platform)
+	}
+}
+
+// ffmpegLogLine strips the "[avfoundation @ 0x7f8b5a404a40] " prefix
+func ffmpegLogLine(line string) string {
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "] "); end >= 0 {
+			return line[end+2:]
+		}
+	}
+
+	return line
+}
+
+var avfoundationDevicePattern = regexp.MustCompile(`^\[(\d+)\] (.+)$`)
+
+// parseAVFoundationDevices reads the video half of
+// ffmpeg -f avfoundation -list_devices true -i ""
+func parseAVFoundationDevices(output io.Reader) []captureDevice {
+	devices := []captureDevice{}
+	inVideo := false
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		line := ffmpegLogLine(scanner.Text())
+
+		switch {
+		case strings.HasSuffix(line, "video devices:"):
+			inVideo = true
+		case strings.HasSuffix(line, "audio devices:"):
+			inVideo = false
+		case inVideo:
+			if m := avfoundationDevicePattern.FindStringSubmatch(line); m != nil {
+				devices = append(devices, captureDevice{Name: m[2], Device: m[2], Modes: []deviceMode{}})
+			}
+		}
+	}
+
+	return devices
+}
+
+var avfoundationModePattern = regexp.MustCompile(`^\s*(\d+x\d+)@\[([\d.]+) ([\d.]+)\]fps`)
+
+// parseAVFoundationModes reads the "Supported modes" avfoundation lists when
+// asked for a size the device doesn't have
+func parseAVFoundationModes(output io.Reader) []deviceMode {
+	modes := []deviceMode{}
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		m := avfoundationModePattern.FindStringSubmatch(ffmpegLogLine(scanner.Text()))
+		if m == nil {
+			continue
+		}
+
+		modes = addMode(modes, deviceMode{Resolution: m[1], FrameRates: parseRates(m[2], m[3])})
+	}
+
+	return modes
+}
+
+func listAVFoundationDevices() ([]captureDevice, error) {
+	output, err := ffmpegOutput("-f", "avfoundation", "-list_devices", "true", "-i", "")
+	if err != nil {
+		return nil, err
+	}
+
+	devices := parseAVFoundationDevices(strings.NewReader(output))
+	for i, device := range devices {
+		// 1x1 is never supported, so ffmpeg answers with the modes that are
+		output, err = ffmpegOutput("-f", "avfoundation", "-video_size", "1x1", "-i", device.Device)
+		if err != nil {
+			return nil, err
+		}
+
+		devices[i].Modes = parseAVFoundationModes(strings.NewReader(output))
+	}
+
+	return devices, nil
+}
+
+var (
+	dshowDevicePattern    = regexp.MustCompile(`^\s*"(.+)"(?: \((video|audio|none)\))?$`)
+	dshowAlternatePattern = regexp.MustCompile(`^\s*Alternative name`)
+)
+
+// parseDShowDevices reads ffmpeg -list_devices true -f dshow -i dummy. Older
+// ffmpeg lists video devices under a heading; newer marks each "(video)".
+func parseDShowDevices(output io.Reader) []captureDevice {
+	devices := []captureDevice{}
+	inVideo := false
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		line := ffmpegLogLine(scanner.Text())
+
+		switch {
+		case strings.Contains(line, "DirectShow video devices"):
+			inVideo = true
+		case strings.Contains(line, "DirectShow audio devices"):
+			inVideo = false
+		case dshowAlternatePattern.MatchString(line):
+		default:
+			m := dshowDevicePattern.FindStringSubmatch(line)
+			if m == nil || (m[2] == "" && !inVideo) || (m[2] != "" && m[2] != "video") {
+				continue
+			}
+
+			devices = append(devices, captureDevice{Name: m[1], Device: "video=" + m[1], Modes: []deviceMode{}})
+		}
+	}
+
+	return devices
+}
+
+var dshowOptionPattern = regexp.MustCompile(`(?:pixel_format|vcodec)=(\S+)\s+min s=(\d+x\d+) fps=([\d.]+) max s=(\d+x\d+) fps=([\d.]+)`)
+
+// parseDShowOptions reads ffmpeg -f dshow -list_options true -i video=NAME
+func parseDShowOptions(output io.Reader) []deviceMode {
+	modes := []deviceMode{}
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		m := dshowOptionPattern.FindStringSubmatch(ffmpegLogLine(scanner.Text()))
+		if m == nil {
+			continue
+		}
+
+		modes = addMode(modes, deviceMode{Format: m[1], Resolution: m[4], FrameRates: parseRates(m[3], m[5])})
+	}
+
+	return modes
+}
+
+func listDShowDevices() ([]captureDevice, error) {
+	output, err := ffmpegOutput("-list_devices", "true", "-f", "dshow", "-i", "dummy")
+	if err != nil {
+		return nil, err
+	}
+
+	devices := parseDShowDevices(strings.NewReader(output))
+	for i, device := range devices {
+		output, err = ffmpegOutput("-f", "dshow", "-list_options", "true", "-i", device.Device)
+		if err != nil {
+			return nil, err
+		}
+
+		devices[i].Modes = parseDShowOptions(strings.NewReader(output))
+	}
+
+	return devices, nil
+}
+
+// parseRates turns a min and max frame rate into the distinct rates
+func parseRates(min, max string) []float64 {
+	rates := []float64{}
+	for _, s := range []string{min, max} {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err == nil && (len(rates) == 0 || rates[0] != rate) {
+			rates = append(rates, rate)
+		}
+	}
+
+	return rates
+}
+
+// addMode merges mode into modes, since drivers often list the same size
+// once per frame rate
+func addMode(modes []deviceMode, mode deviceMode) []deviceMode {
+	for i, m := range modes {
+		if m.Format == mode.Format && m.Resolution == mode.Resolution {
+			for _, rate := range mode.FrameRates {
+				if !containsRate(m.FrameRates, rate) {
+					modes[i].FrameRates = append(modes[i].FrameRates, rate)
+				}
+			}
+
+			sort.Float64s(modes[i].FrameRates)
+			return modes
+		}
+	}
+
+	return append(modes, mode)
+}
+
+func containsRate(rates []float64, rate float64) bool {
+	for _, r := range rates {
+		if r == rate {
+			return true
+		}
+	}
+
+	return false
+}
+
+// printDevices is the list-devices command's output
+func printDevices(out io.Writer, devices []captureDevice) {
+	if len(devices) == 0 {
+		fmt.Fprintln(out, "no capture devices found")
+		return
+	}
+
+	for _, device := range devices {
+		fmt.Fprintf(out, "%s\n    --video-device %q\n", device.Name, device.Device)
+
+		for _, mode := range device.Modes {
+			rates := []string{}
+			for _, rate := range mode.FrameRates {
+				rates = append(rates, strconv.FormatFloat(rate, 'f', -1, 64))
+			}
+
+			fmt.Fprintf(out, "    %-10s %-10s %s fps\n", mode.Format, mode.Resolution, strings.Join(rates, ", "))
+		}
+	}
+}
+
+// listDevicesCommand runs "asv list-devices" and returns the exit code
+func listDevicesCommand(platform string, out io.Writer) int {
+	devices, err := listDevices(platform)
+	if err != nil {
+		fmt.Fprintf(out, "error: %s\n", err)
+		return 1
+	}
+
+	printDevices(out, devices)
+
+	return 0
+}
+
+// devicesHandler serves GET /api/devices, for picking a --video-device
+func devicesHandler(uArgs userArguments) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+			return
+		}
+
+		devices, err := listDevices(uArgs.operatingSys)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, devices)
+	}
+}
+
+func registerDeviceHandlers(uArgs userArguments) {
+	http.HandleFunc("/api/devices", devicesHandler(uArgs))
+}
@@ -0,0 +1,188 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+// v4l2 ioctls and flags, from linux/videodev2.h
+const (
+	vidiocQueryCap           = 0x80685600 // _IOR('V', 0, struct v4l2_capability)
+	vidiocEnumFmt            = 0xc0405602 // _IOWR('V', 2, struct v4l2_fmtdesc)
+	vidiocEnumFrameSizes     = 0xc02c564a // _IOWR('V', 74, struct v4l2_frmsizeenum)
+	vidiocEnumFrameIntervals = 0xc034564b // _IOWR('V', 75, struct v4l2_frmivalenum)
+
+	v4l2CapVideoCapture = 0x00000001
+	v4l2CapDeviceCaps   = 0x80000000
+	v4l2BufTypeCapture  = 1
+	v4l2FrameDiscrete   = 1
+)
+
+type v4l2Capability struct {
+	Driver       [16]byte
+	Card         [32]byte
+	BusInfo      [32]byte
+	Version      uint32
+	Capabilities uint32
+	DeviceCaps   uint32
+	Reserved     [3]uint32
+}
+
+type v4l2FmtDesc struct {
+	Index       uint32
+	Type        uint32
+	Flags       uint32
+	Description [32]byte
+	PixelFormat uint32
+	MbusCode    uint32
+	Reserved    [3]uint32
+}
+
+type v4l2FrameSizeEnum struct {
+	Index       uint32
+	PixelFormat uint32
+	Type        uint32
+	Width       uint32 // discrete size; stepwise sizes use the rest of the union
+	Height      uint32
+	Stepwise    [4]uint32
+	Reserved    [2]uint32
+}
+
+type v4l2FrameIntervalEnum struct {
+	Index       uint32
+	PixelFormat uint32
+	Width       uint32
+	Height      uint32
+	Type        uint32
+	Numerator   uint32 // discrete interval; stepwise intervals use the rest of the union
+	Denominator uint32
+	Stepwise    [4]uint32
+	Reserved    [2]uint32
+}
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
+
+// fourCC names a v4l2 pixel format, like YUYV or MJPG
+func fourCC(format uint32) string {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, format)
+
+	return string(bytes.TrimRight(b, " \x00"))
+}
+
+// listV4L2Devices asks every /dev/video* what it can capture. Metadata nodes
+// that many webcams also create are skipped.
+func listV4L2Devices() ([]captureDevice, error) {
+	paths, err := filepath.Glob("/dev/video*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	devices := []captureDevice{}
+	for _, path := range paths {
+		device, ok, err := queryV4L2Device(path)
+		if err != nil {
+			fmt.Printf("skipping %s: %s\n", path, err)
+			continue
+		}
+
+		if ok {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices, nil
+}
+
+func queryV4L2Device(path string) (captureDevice, bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return captureDevice{}, false, err
+	}
+	defer file.Close()
+
+	fd := file.Fd()
+
+	var capability v4l2Capability
+	if err = ioctl(fd, vidiocQueryCap, unsafe.Pointer(&capability)); err != nil {
+		return captureDevice{}, false, fmt.Errorf("not a v4l2 device: %s", err)
+	}
+
+	caps := capability.Capabilities
+	if caps&v4l2CapDeviceCaps != 0 {
+		caps = capability.DeviceCaps
+	}
+
+	if caps&v4l2CapVideoCapture == 0 {
+		return captureDevice{}, false, nil
+	}
+
+	device := captureDevice{Name: cString(capability.Card[:]), Device: path, Modes: []deviceMode{}}
+	for i := uint32(0); ; i++ {
+		format := v4l2FmtDesc{Index: i, Type: v4l2BufTypeCapture}
+		if ioctl(fd, vidiocEnumFmt, unsafe.Pointer(&format)) != nil {
+			break
+		}
+
+		device.Modes = append(device.Modes, v4l2Modes(fd, format.PixelFormat)...)
+	}
+
+	return device, true, nil
+}
+
+// v4l2Modes lists the discrete sizes and frame rates of one pixel format.
+// Stepwise sizes are rare on capture cards and are left out.
+func v4l2Modes(fd uintptr, pixelFormat uint32) []deviceMode {
+	modes := []deviceMode{}
+	for i := uint32(0); ; i++ {
+		size := v4l2FrameSizeEnum{Index: i, PixelFormat: pixelFormat}
+		if ioctl(fd, vidiocEnumFrameSizes, unsafe.Pointer(&size)) != nil || size.Type != v4l2FrameDiscrete {
+			break
+		}
+
+		mode := deviceMode{
+			Format:     fourCC(pixelFormat),
+			Resolution: fmt.Sprintf("%dx%d", size.Width, size.Height),
+			FrameRates: []float64{},
+		}
+
+		for j := uint32(0); ; j++ {
+			interval := v4l2FrameIntervalEnum{Index: j, PixelFormat: pixelFormat, Width: size.Width, Height: size.Height}
+			if ioctl(fd, vidiocEnumFrameIntervals, unsafe.Pointer(&interval)) != nil || interval.Type != v4l2FrameDiscrete {
+				break
+			}
+
+			if interval.Numerator != 0 {
+				mode.FrameRates = append(mode.FrameRates, float64(interval.Denominator)/float64(interval.Numerator))
+			}
+		}
+
+		modes = addMode(modes, mode)
+	}
+
+	return modes
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"unsafe"
+)
+
+// the ioctl numbers encode these sizes, so a wrong layout fails every call
+func TestV4L2StructSizes(t *testing.T) {
+	sizes := map[string][2]uintptr{
+		"v4l2_capability":  {unsafe.Sizeof(v4l2Capability{}), 104},
+		"v4l2_fmtdesc":     {unsafe.Sizeof(v4l2FmtDesc{}), 64},
+		"v4l2_frmsizeenum": {unsafe.Sizeof(v4l2FrameSizeEnum{}), 44},
+		"v4l2_frmivalenum": {unsafe.Sizeof(v4l2FrameIntervalEnum{}), 52},
+	}
+
+	for name, size := range sizes {
+		if size[0] != size[1] {
+			t.Errorf("%s is %d bytes, should be %d", name, size[0], size[1])
+		}
+	}
+}
+
+func TestFourCC(t *testing.T) {
+	if name := fourCC(0x56595559); name != "YUYV" {
+		t.Errorf("got %q, should be YUYV", name)
+	}
+
+	if name := fourCC(0x47504a4d); name != "MJPG" {
+		t.Errorf("got %q, should be MJPG", name)
+	}
+}
+
+func TestDevicesHandlerLinux(t *testing.T) {
+	w := httptest.NewRecorder()
+	devicesHandler(userArguments{operatingSys: osLinux})(w, httptest.NewRequest("GET", "/api/devices", nil))
+
+	var devices []captureDevice
+	if err := json.Unmarshal(w.Body.Bytes(), &devices); w.Code != http.StatusOK || err != nil {
+		t.Errorf("listing devices returned %d %s (%v)", w.Code, w.Body.String(), err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func listV4L2Devices() ([]captureDevice, error) {
+	return nil, fmt.Errorf("video4linux2 devices can only be listed on linux")
+}
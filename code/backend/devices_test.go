@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func openFixture(t *testing.T, name string) *os.File {
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	return file
+}
+
+func TestParseAVFoundationDevices(t *testing.T) {
+	file := openFixture(t, "ffmpeg_avfoundation_devices.txt")
+	defer file.Close()
+
+	names := []string{}
+	for _, device := range parseAVFoundationDevices(file) {
+		names = append(names, device.Device)
+	}
+
+	// the audio half also lists "FHD Capture", which mustn't show up twice
+	expected := []string{"FaceTime HD Camera", "FHD Capture", "Capture screen 0"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %v, should be %v", names, expected)
+	}
+}
+
+func TestParseAVFoundationModes(t *testing.T) {
+	file := openFixture(t, "ffmpeg_avfoundation_modes.txt")
+	defer file.Close()
+
+	expected := []deviceMode{
+		{Resolution: "1920x1080", FrameRates: []float64{30, 60}},
+		{Resolution: "1280x720", FrameRates: []float64{5, 60}},
+		{Resolution: "640x480", FrameRates: []float64{30}},
+	}
+
+	if modes := parseAVFoundationModes(file); !reflect.DeepEqual(modes, expected) {
+		t.Errorf("got %+v, should be %+v", modes, expected)
+	}
+}
+
+func TestParseDShowDevices(t *testing.T) {
+	for fixture, expected := range map[string][]string{
+		"ffmpeg_dshow_devices.txt":    {"video=FHD Capture", "video=Integrated Webcam"},
+		"ffmpeg_dshow_devices_v6.txt": {"video=FHD Capture"},
+	} {
+		file := openFixture(t, fixture)
+
+		names := []string{}
+		for _, device := range parseDShowDevices(file) {
+			names = append(names, device.Device)
+		}
+		file.Close()
+
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s gave %v, should be %v", fixture, names, expected)
+		}
+	}
+}
+
+func TestParseDShowOptions(t *testing.T) {
+	file := openFixture(t, "ffmpeg_dshow_options.txt")
+	defer file.Close()
+
+	expected := []deviceMode{
+		{Format: "yuyv422", Resolution: "1920x1080", FrameRates: []float64{5}},
+		{Format: "yuyv422", Resolution: "1280x720", FrameRates: []float64{10}},
+		{Format: "mjpeg", Resolution: "1920x1080", FrameRates: []float64{30, 60}},
+		{Format: "mjpeg", Resolution: "1280x720", FrameRates: []float64{30, 60.0002}},
+	}
+
+	if modes := parseDShowOptions(file); !reflect.DeepEqual(modes, expected) {
+		t.Errorf("got %+v, should be %+v", modes, expected)
+	}
+}
+
+func TestListDevicesRunsFfmpeg(t *testing.T) {
+	defer func(original func(...string) (string, error)) { ffmpegOutput = original }(ffmpegOutput)
+	ffmpegOutput = func(args ...string) (string, error) {
+		fixture := "ffmpeg_dshow_devices_v6.txt"
+		if strings.Contains(strings.Join(args, " "), "-list_options true -i video=FHD Capture") {
+			fixture = "ffmpeg_dshow_options.txt"
+		}
+
+		b, err := ioutil.ReadFile(fixture)
+		return string(b), err
+	}
+
+	devices, err := listDevices(osWindows)
+	if err != nil {
+		t.Fatalf("listDevices failed with %s", err)
+	}
+
+	if len(devices) != 1 || devices[0].Name != "FHD Capture" || len(devices[0].Modes) != 4 {
+		t.Errorf("unexpected devices %+v", devices)
+	}
+
+	var out bytes.Buffer
+	printDevices(&out, devices)
+	if !strings.Contains(out.String(), `--video-device "video=FHD Capture"`) || !strings.Contains(out.String(), "30, 60 fps") {
+		t.Errorf("unexpected list-devices output:\n%s", out.String())
+	}
+}
+
+func TestDevicesHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	devicesHandler(userArguments{operatingSys: "plan9"})(w, httptest.NewRequest("GET", "/api/devices", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("unsupported platform returned %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	devicesHandler(userArguments{operatingSys: osLinux})(w, httptest.NewRequest("POST", "/api/devices", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned %d", w.Code)
+	}
+}
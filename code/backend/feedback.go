@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v2"
+)
+
+// rtcpReader is the part of an RTPSender the feedback loop reads from
+type rtcpReader interface {
+	ReadRTCP() ([]rtcp.Packet, error)
+}
+
+// watchFeedback reads the RTCP a browser sends about feed index, whose track
+// has the given SSRC, and moves the feed between layers as its network
+// allows. It returns when the sender is closed with the peer connection.
+// Picture loss and full intra requests aren't acted on, since live encoders
+// send a keyframe at least every keyframeMaxGap anyway.
+func (s *viewerSession) watchFeedback(index int, sender rtcpReader, ssrc uint32) {
+	estimator := newBitrateEstimator(qualityLadder(s.args.encoder))
+
+	for {
+		packets, err := sender.ReadRTCP()
+		if err == io.EOF || err == io.ErrClosedPipe {
+			return
+		} else if err != nil {
+			continue // a malformed packet only loses that report
+		}
+
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				estimator.onREMB(p.Bitrate)
+			case *rtcp.ReceiverReport:
+				for _, report := range p.Reports {
+					if report.SSRC == ssrc {
+						estimator.onLoss(report.FractionLost)
+					}
+				}
+			}
+		}
+
+		before := estimator.current
+		if layer := estimator.choose(time.Now()); layer != before {
+			if err = s.setLayer(index, estimator.ladder[layer]); err != nil {
+				fmt.Printf("session %s feed %d layer error: %s\n", s.id, index, err)
+			}
+		}
+	}
+}
+
+// acceptREMB adds REMB to what we tell the browser we can use, so it sends
+// us its bandwidth estimates. pion only copies codecs out of the offer, not
+// their feedback.
+func acceptREMB(codec *webrtc.RTPCodec) {
+	remb := webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBGoogREMB}
+	if !hasFeedback(codec, remb) {
+		codec.RTCPFeedback = append(codec.RTCPFeedback, remb)
+	}
+}
+
+func hasFeedback(codec *webrtc.RTPCodec, feedback webrtc.RTCPFeedback) bool {
+	for _, have := range codec.RTCPFeedback {
+		if have == feedback {
+			return true
+		}
+	}
+
+	return false
+}
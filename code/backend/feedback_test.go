@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"atn/code/backend/internal/signal"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v2"
+)
+
+// feedbackReader replays RTCP to watchFeedback, then reports the sender closed
+type feedbackReader struct {
+	batches [][]rtcp.Packet
+}
+
+func (f *feedbackReader) ReadRTCP() ([]rtcp.Packet, error) {
+	if len(f.batches) == 0 {
+		return nil, io.EOF
+	}
+
+	batch := f.batches[0]
+	f.batches = f.batches[1:]
+
+	return batch, nil
+}
+
+func TestRunAcceptsFeedback(t *testing.T) {
+	mockArgs := userArguments{
+		sessionDescription: testOffer,
+		inputVideoPath:     "remb device",
+		inputResolution:    "1920x1080",
+		videoIsLive:        true,
+		operatingSys:       osLinux,
+		ivfHandle:          testIvfFile,
+		adaptiveBitrate:    true,
+	}
+
+	answer, err := run(mockArgs)
+	if err != nil {
+		t.Fatalf("run failed with %s", err)
+	}
+
+	s, err := sessions.get(answer.SessionID)
+	if err != nil {
+		t.Fatalf("session wasn't registered: %s", err)
+	}
+	defer sessions.close(s)
+
+	var description webrtc.SessionDescription
+	if err = signal.Decode(answer.ServerSdp, &description); err != nil {
+		t.Fatalf("bad answer: %s", err)
+	}
+
+	if !strings.Contains(description.SDP, "goog-remb") {
+		t.Errorf("answer doesn't ask for REMB:\n%s", description.SDP)
+	}
+
+	if s.connected == nil {
+		t.Error("feedback isn't watched once the session connects")
+	}
+}
@@ -6,6 +6,13 @@ replace atn/code/backend/internal/signal => ./internal/signal
 
 require (
 	atn/code/backend/internal/signal v0.0.0-00010101000000-000000000000
+	github.com/pion/ice v0.7.8
+	github.com/pion/logging v0.2.2
+	github.com/pion/rtcp v1.2.1
+	github.com/pion/rtp v1.3.2
+	github.com/pion/turn/v2 v2.0.2
 	github.com/pion/webrtc/v2 v2.2.0
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/crypto v0.0.0-20200128174031-69ecbb4d6d5d
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
 )
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pion/webrtc/v2/pkg/media/ivfreader"
+)
+
+const h264FrameRate = 30 // ffmpeg's raw H.264 output carries no timing
+
+// h264Reader splits an Annex B H.264 stream into access units at each access
+// unit delimiter. It satisfies ivfReader so streamVideo doesn't care which
+// codec it is sending.
+type h264Reader struct {
+	stream    *bufio.Reader
+	pending   []byte
+	frames    uint64
+	bytesRead int64
+}
+
+func newH264Reader(stream io.Reader) (*h264Reader, *ivfreader.IVFFileHeader) {
+	header := &ivfreader.IVFFileHeader{
+		FourCC:              "H264",
+		TimebaseDenominator: h264FrameRate,
+		TimebaseNumerator:   1,
+	}
+
+	return &h264Reader{stream: bufio.NewReader(stream)}, header
+}
+
+// startsAccessUnit reports whether buf ends in a start code followed by an
+// access unit delimiter, returning where that start code begins
+func startsAccessUnit(buf []byte) (int, bool) {
+	n := len(buf)
+	if n < 4 || buf[n-4] != 0 || buf[n-3] != 0 || buf[n-2] != 1 || buf[n-1]&0x1f != h264NalAccessUnitDelimiter {
+		return 0, false
+	}
+
+	start := n - 4
+	if start > 0 && buf[start-1] == 0 { // four byte start code
+		start--
+	}
+
+	return start, true
+}
+
+func (h *h264Reader) ParseNextFrame() ([]byte, *ivfreader.IVFFrameHeader, error) {
+	for {
+		b, err := h.stream.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		h.pending = append(h.pending, b)
+
+		start, ok := startsAccessUnit(h.pending)
+		if !ok || start == 0 {
+			continue
+		}
+
+		frame := make([]byte, start)
+		copy(frame, h.pending[:start])
+		h.pending = append([]byte{}, h.pending[start:]...)
+
+		header := &ivfreader.IVFFrameHeader{FrameSize: uint32(len(frame)), Timestamp: h.frames}
+		h.frames++
+		h.bytesRead += int64(len(frame))
+
+		return frame, header, nil
+	}
+}
+
+func (h *h264Reader) ResetReader(reset func(bytesRead int64) io.Reader) {
+	h.stream = bufio.NewReader(reset(h.bytesRead + int64(len(h.pending))))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestH264ReaderSplitsAccessUnits(t *testing.T) {
+	units := [][]byte{
+		{0, 0, 0, 1, 0x09, 0x10, 0, 0, 0, 1, 0x67, 0x42, 0, 0, 1, 0x65, 0x88, 0x84},
+		{0, 0, 1, 0x09, 0x30, 0, 0, 1, 0x41, 0x9a, 0x02},
+		{0, 0, 0, 1, 0x09, 0x30, 0, 0, 0, 1, 0x41, 0x9a, 0x04},
+	}
+
+	h264, header := newH264Reader(bytes.NewReader(bytes.Join(units, nil)))
+	if header.FourCC != "H264" || header.TimebaseDenominator != h264FrameRate {
+		t.Errorf("unexpected header %+v", header)
+	}
+
+	// the last access unit only ends when the next delimiter arrives
+	for i, unit := range units[:2] {
+		frame, frameHeader, err := h264.ParseNextFrame()
+		if err != nil {
+			t.Fatalf("frame %d error: %s", i, err)
+		}
+
+		if !bytes.Equal(frame, unit) {
+			t.Errorf("frame %d is % x, should be % x", i, frame, unit)
+		}
+
+		if frameHeader.Timestamp != uint64(i) || frameHeader.FrameSize != uint32(len(unit)) {
+			t.Errorf("frame %d has header %+v", i, frameHeader)
+		}
+	}
+
+	if _, _, err := h264.ParseNextFrame(); err != io.EOF {
+		t.Errorf("expected EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestH264ReaderFromPipe(t *testing.T) {
+	unit := []byte{0, 0, 0, 1, 0x09, 0x10, 0, 0, 1, 0x65, 0x88}
+	stream := bytes.Repeat(unit, 3)
+
+	r, w := io.Pipe()
+	go trickle(w, stream, 3)
+
+	h264, _ := newH264Reader(r)
+	for i := 0; i < 2; i++ {
+		frame, _, err := h264.ParseNextFrame()
+		if err != nil || !bytes.Equal(frame, unit) {
+			t.Fatalf("frame %d is % x (%v), should be % x", i, frame, err, unit)
+		}
+	}
+}
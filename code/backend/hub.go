@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	hubProtocolVersion = 1 // sent with every message; clients sending a newer one are refused
+	hubClientIDLength  = 12
+	hubSendBuffer      = 64
+	hubWelcome         = "welcome"
+	hubError           = "error"
+)
+
+// hubMessage is the envelope for everything sent over /api/events and the
+// control data channel. A message without a version is taken to be version 1.
+type hubMessage struct {
+	Version int             `json:"v,omitempty"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// hubClient is one connected viewer's event stream
+type hubClient struct {
+	id   string
+	name string // who it is signed in as
+	role role
+	send chan []byte
+}
+
+type hubHandler func(from *hubClient, data json.RawMessage) error
+
+// events is the hub every viewer's WebSocket and control channel joins
+var events = newEventHub()
+
+// eventHub pushes JSON events to every connected viewer and routes the
+// messages viewers send back to whichever subsystem registered for them
+type eventHub struct {
+	mu       sync.RWMutex
+	clients  map[string]*hubClient
+	handlers map[string]hubHandler
+	roles    map[string]role // least role allowed to send each message type
+	greeters []func(client *hubClient)
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		clients:  map[string]*hubClient{},
+		handlers: map[string]hubHandler{},
+		roles:    map[string]role{},
+	}
+}
+
+// on registers the handler for messages of msgType sent by viewers
+func (h *eventHub) on(msgType string, handler hubHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.handlers[msgType] = handler
+}
+
+// restrict only lets clients with at least role send messages of msgType
+func (h *eventHub) restrict(msgType string, least role) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.roles[msgType] = least
+}
+
+// onConnect runs greet for every client that connects, after its welcome, so
+// subsystems can send the state a late joiner missed
+func (h *eventHub) onConnect(greet func(client *hubClient)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.greeters = append(h.greeters, greet)
+}
+
+func (h *eventHub) register() *hubClient {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	client := &hubClient{id: randomID(hubClientIDLength), send: make(chan []byte, hubSendBuffer)}
+	h.clients[client.id] = client
+
+	return client
+}
+
+func (h *eventHub) unregister(client *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[client.id]; ok {
+		delete(h.clients, client.id)
+		close(client.send)
+	}
+}
+
+func encodeHubMessage(msgType string, data interface{}) ([]byte, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(hubMessage{Version: hubProtocolVersion, Type: msgType, Data: raw})
+}
+
+// publish sends an event to every client except the one with id except,
+// which is usually whoever caused it
+func (h *eventHub) publish(msgType string, data interface{}, except string) error {
+	msg, err := encodeHubMessage(msgType, data)
+	if err != nil {
+		return err
+	}
+
+	var slow []*hubClient
+
+	h.mu.RLock()
+	for id, client := range h.clients {
+		if id == except {
+			continue
+		}
+
+		select {
+		case client.send <- msg:
+		default: // a viewer that stopped reading shouldn't hold up everyone else
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range slow {
+		fmt.Printf("dropping event client %s, it fell behind\n", client.id)
+		h.unregister(client)
+	}
+
+	return nil
+}
+
+// sendTo sends an event to a single client, dropping it if the client is busy
+func (h *eventHub) sendTo(client *hubClient, msgType string, data interface{}) {
+	msg, err := encodeHubMessage(msgType, data)
+	if err != nil {
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if _, ok := h.clients[client.id]; !ok {
+		return
+	}
+
+	select {
+	case client.send <- msg:
+	default:
+	}
+}
+
+func (h *eventHub) dispatch(from *hubClient, msg hubMessage) error {
+	if msg.Version > hubProtocolVersion {
+		return fmt.Errorf("protocol version %d not supported, the server speaks %d", msg.Version, hubProtocolVersion)
+	}
+
+	h.mu.RLock()
+	handler, ok := h.handlers[msg.Type]
+	least, restricted := h.roles[msg.Type]
+	h.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("no handler for %s messages", msg.Type)
+	}
+
+	if restricted && from.role < least {
+		return fmt.Errorf("%s role required", least)
+	}
+
+	return handler(from, msg.Data)
+}
+
+type hubWelcomeData struct {
+	ClientID string `json:"clientId"`
+	Version  int    `json:"v"`
+}
+
+// join registers a client of the given role whose events are sent with send,
+// from their own goroutine, starting with a welcome that tells it its client
+// id so REST calls can identify it, then the greeters' events. Once send
+// fails or the client is unregistered, it is unregistered and done is called.
+func (h *eventHub) join(who identity, send func(msg []byte) error, done func()) *hubClient {
+	client := h.register()
+	client.name, client.role = who.Name, who.Role
+
+	welcome, _ := encodeHubMessage(hubWelcome, hubWelcomeData{ClientID: client.id, Version: hubProtocolVersion})
+	client.send <- welcome
+
+	h.mu.RLock()
+	greeters := h.greeters
+	h.mu.RUnlock()
+
+	for _, greet := range greeters {
+		greet(client)
+	}
+
+	go func() {
+		for msg := range client.send {
+			if err := send(msg); err != nil {
+				break
+			}
+		}
+
+		h.unregister(client)
+		done()
+	}()
+
+	return client
+}
+
+// receive dispatches a message from client, answering with an error event
+// when it can't be handled
+func (h *eventHub) receive(client *hubClient, raw []byte) {
+	var msg hubMessage
+	err := json.Unmarshal(raw, &msg)
+	if err == nil {
+		err = h.dispatch(client, msg)
+	}
+
+	if err != nil {
+		h.sendTo(client, hubError, apiError{Error: err.Error()})
+	}
+}
+
+// serveWebSocket streams events to one viewer until it disconnects
+func (h *eventHub) serveWebSocket(ws *websocket.Conn) {
+	client := h.join(identityFrom(ws.Request().Context()), func(msg []byte) error {
+		return websocket.Message.Send(ws, string(msg))
+	}, func() { ws.Close() })
+	defer h.unregister(client)
+
+	for {
+		var raw []byte
+		if err := websocket.Message.Receive(ws, &raw); err != nil {
+			return
+		}
+
+		h.receive(client, raw)
+	}
+}
+
+func registerEventHandlers(h *eventHub) {
+	http.Handle("/api/events", websocket.Handler(h.serveWebSocket))
+}
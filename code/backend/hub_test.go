@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialHub connects to a test server's event stream and returns the client id
+// it was welcomed with
+func dialHub(t *testing.T, url string) (*websocket.Conn, string) {
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(url, "http"), "", url)
+	if err != nil {
+		t.Fatalf("dial failed with %s", err)
+	}
+
+	var welcome hubMessage
+	if err = websocket.JSON.Receive(ws, &welcome); err != nil || welcome.Type != hubWelcome {
+		t.Fatalf("expected a welcome, got %+v, %s", welcome, err)
+	}
+
+	var data hubWelcomeData
+	json.Unmarshal(welcome.Data, &data)
+
+	return ws, data.ClientID
+}
+
+func receiveWithin(ws *websocket.Conn, d time.Duration) (hubMessage, error) {
+	ws.SetReadDeadline(time.Now().Add(d))
+	defer ws.SetReadDeadline(time.Time{})
+
+	var msg hubMessage
+	err := websocket.JSON.Receive(ws, &msg)
+
+	return msg, err
+}
+
+func TestEventHubPublishSkipsSender(t *testing.T) {
+	h := newEventHub()
+	sender, other := h.register(), h.register()
+
+	if err := h.publish("test", "hello", sender.id); err != nil {
+		t.Fatalf("publish failed with %s", err)
+	}
+
+	select {
+	case msg := <-other.send:
+		if !strings.Contains(string(msg), `"hello"`) {
+			t.Errorf("other client got %s", msg)
+		}
+	default:
+		t.Error("other client got nothing")
+	}
+
+	select {
+	case msg := <-sender.send:
+		t.Errorf("sender got its own event back: %s", msg)
+	default:
+	}
+}
+
+func TestEventHubDropsSlowClients(t *testing.T) {
+	h := newEventHub()
+	client := h.register()
+
+	for i := 0; i <= hubSendBuffer; i++ {
+		h.publish("test", i, "")
+	}
+
+	if _, ok := h.clients[client.id]; ok {
+		t.Error("client that never read is still registered")
+	}
+}
+
+func TestEventHubDispatch(t *testing.T) {
+	h := newEventHub()
+	got := ""
+	h.on("ping", func(from *hubClient, data json.RawMessage) error {
+		got = string(data)
+		return nil
+	})
+
+	if err := h.dispatch(h.register(), hubMessage{Type: "ping", Data: json.RawMessage(`1`)}); err != nil || got != "1" {
+		t.Errorf("dispatch gave %q, %s", got, err)
+	}
+
+	if err := h.dispatch(h.register(), hubMessage{Type: "unknown"}); err == nil {
+		t.Error("dispatching an unknown type should fail")
+	}
+}
+
+func TestEventHubWebSocket(t *testing.T) {
+	h := newEventHub()
+	h.on("echo", func(from *hubClient, data json.RawMessage) error {
+		return fmt.Errorf("echo %s", data)
+	})
+
+	ts := httptest.NewServer(websocket.Handler(h.serveWebSocket))
+	defer ts.Close()
+
+	ws, _ := dialHub(t, ts.URL)
+	defer ws.Close()
+
+	websocket.JSON.Send(ws, hubMessage{Type: "echo", Data: json.RawMessage(`"hi"`)})
+
+	msg, err := receiveWithin(ws, time.Second)
+	if err != nil || msg.Type != hubError || !strings.Contains(string(msg.Data), "echo") {
+		t.Errorf("expected the handler's error back, got %+v, %s", msg, err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pion/ice"
+	"github.com/pion/webrtc/v2"
+)
+
+// parseICEServer reads an --ice-server value. TURN credentials go before the
+// host, as in "turn:alice:secret@turn.example.com:3478?transport=udp".
+func parseICEServer(value string) (webrtc.ICEServer, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return webrtc.ICEServer{}, fmt.Errorf("ice server %q has no scheme", value)
+	}
+
+	scheme, rest := parts[0], parts[1]
+	server := webrtc.ICEServer{URLs: []string{value}}
+
+	hostPart := rest
+	if q := strings.Index(hostPart, "?"); q >= 0 {
+		hostPart = hostPart[:q]
+	}
+
+	if at := strings.LastIndex(hostPart, "@"); at >= 0 {
+		credentials := strings.SplitN(hostPart[:at], ":", 2)
+		if len(credentials) != 2 || credentials[0] == "" {
+			return webrtc.ICEServer{}, fmt.Errorf("ice server %q credentials should be username:credential", value)
+		}
+
+		server.Username = credentials[0]
+		server.Credential = credentials[1]
+		server.URLs = []string{scheme + ":" + rest[at+1:]}
+	}
+
+	parsed, err := ice.ParseURL(server.URLs[0])
+	if err != nil {
+		return webrtc.ICEServer{}, fmt.Errorf("ice server %q error: %s", value, err)
+	}
+
+	if (parsed.Scheme == ice.SchemeTypeTURN || parsed.Scheme == ice.SchemeTypeTURNS) && server.Username == "" {
+		return webrtc.ICEServer{}, fmt.Errorf("ice server %q is TURN but has no credentials", value)
+	}
+
+	return server, nil
+}
+
+// parseICEServers reads every --ice-server value
+func parseICEServers(values []string) ([]webrtc.ICEServer, error) {
+	servers := []webrtc.ICEServer{}
+	for _, value := range values {
+		server, err := parseICEServer(value)
+		if err != nil {
+			return nil, err
+		}
+
+		servers = append(servers, server)
+	}
+
+	return servers, nil
+}
+
+// browserICEServer is an RTCIceServer as the browser expects it
+type browserICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+type iceConfig struct {
+	ICEServers []browserICEServer `json:"iceServers"`
+}
+
+func newICEConfig(servers []webrtc.ICEServer) iceConfig {
+	config := iceConfig{ICEServers: []browserICEServer{}}
+	for _, server := range servers {
+		credential, _ := server.Credential.(string)
+		config.ICEServers = append(config.ICEServers, browserICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: credential,
+		})
+	}
+
+	return config
+}
+
+// iceConfigHandler serves GET /api/ice-config, an RTCConfiguration the browser
+// can pass straight to RTCPeerConnection so both ends use the same servers
+func iceConfigHandler(uArgs userArguments) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store") // it can hold TURN credentials
+		writeJSON(w, http.StatusOK, newICEConfig(uArgs.iceServers))
+	}
+}
+
+func registerICEHandlers(uArgs userArguments) {
+	http.HandleFunc("/api/ice-config", iceConfigHandler(uArgs))
+}
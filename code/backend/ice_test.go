@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v2"
+)
+
+func TestParseICEServer(t *testing.T) {
+	good := []struct {
+		value    string
+		url      string
+		username string
+	}{
+		{"stun:stun.l.google.com:19302", "stun:stun.l.google.com:19302", ""},
+		{"turn:alice:secret@turn.example.com:3478", "turn:turn.example.com:3478", "alice"},
+		{"turns:alice:p@ss@turn.example.com:5349?transport=tcp", "turns:turn.example.com:5349?transport=tcp", "alice"},
+	}
+
+	for _, c := range good {
+		server, err := parseICEServer(c.value)
+		if err != nil {
+			t.Errorf("%s: failed with %s", c.value, err)
+			continue
+		}
+
+		if server.URLs[0] != c.url || server.Username != c.username {
+			t.Errorf("%s: parsed as %+v", c.value, server)
+		}
+	}
+
+	if server, _ := parseICEServer("turns:alice:p@ss@turn.example.com:5349"); server.Credential != "p@ss" {
+		t.Errorf("credential with an @ parsed as %v", server.Credential)
+	}
+
+	for _, value := range []string{"turn.example.com", "turn:turn.example.com:3478", "turn::secret@turn.example.com", "http://example.com"} {
+		if _, err := parseICEServer(value); err == nil {
+			t.Errorf("%s: parsed but should have failed", value)
+		}
+	}
+}
+
+func TestICEConfigHandler(t *testing.T) {
+	servers, err := parseICEServers([]string{"stun:stun.example.com:3478", "turn:alice:secret@turn.example.com:3478"})
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	iceConfigHandler(userArguments{iceServers: servers})(w, httptest.NewRequest("GET", "/api/ice-config", nil))
+
+	var config map[string][]map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &config); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got %d %s (%v)", w.Code, w.Body.String(), err)
+	}
+
+	turnServer := config["iceServers"][1]
+	if len(config["iceServers"]) != 2 || turnServer["username"] != "alice" || turnServer["credential"] != "secret" {
+		t.Errorf("unexpected config %s", w.Body.String())
+	}
+
+	if _, ok := config["iceServers"][0]["username"]; ok {
+		t.Errorf("STUN server shouldn't have a username: %s", w.Body.String())
+	}
+}
+
+// startTestTURN runs a TURN server on loopback that accepts user/pass
+func startTestTURN(t *testing.T) (*turn.Server, string) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	key := turn.GenerateAuthKey("user", "atn", "pass")
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:         "atn",
+		LoggerFactory: &logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevelDisabled},
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return key, username == "user"
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            conn,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{RelayAddress: net.ParseIP("127.0.0.1"), Address: "127.0.0.1"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	return server, conn.LocalAddr().String()
+}
+
+func TestRunGathersTURNRelayCandidates(t *testing.T) {
+	server, addr := startTestTURN(t)
+	defer server.Close()
+
+	turnServer, err := parseICEServer("turn:user:pass@" + addr + "?transport=udp")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	mockArgs := userArguments{
+		sessionDescription: testOffer,
+		inputVideoPath:     "turn device",
+		inputResolution:    "1920x1080",
+		videoIsLive:        true,
+		operatingSys:       osLinux,
+		ivfHandle:          testIvfFile,
+		iceServers:         []webrtc.ICEServer{turnServer},
+		trickleICE:         true,
+	}
+
+	answer, err := run(mockArgs)
+	if err != nil {
+		t.Fatalf("run failed with %s", err)
+	}
+
+	session, err := sessions.get(answer.SessionID)
+	if err != nil {
+		t.Fatalf("session wasn't registered: %s", err)
+	}
+	defer sessions.close(session)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		batch := session.takeCandidates(time.Second)
+		for _, c := range batch.Candidates {
+			if strings.Contains(c.Candidate, "typ relay") {
+				return
+			}
+		}
+
+		if batch.Done {
+			break
+		}
+	}
+
+	t.Error("no relay candidate was gathered from the TURN server")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media/ivfreader"
+)
+
+// fullReader blocks each Read until p is filled. ivfreader expects a whole
+// header or frame from a single Read, which a pipe doesn't guarantee.
+type fullReader struct {
+	stream io.Reader
+}
+
+func (f fullReader) Read(p []byte) (int, error) {
+	return io.ReadFull(f.stream, p)
+}
+
+// newIvfStreamReader parses IVF from a stream that is still being written.
+// It blocks until the file header has arrived.
+func newIvfStreamReader(stream io.Reader) (*ivfreader.IVFReader, *ivfreader.IVFFileHeader, error) {
+	return ivfreader.NewWith(fullReader{stream: stream})
+}
+
+// startPipe starts execStream with its stdout piped back to us
+func startPipe(execStream *exec.Cmd) (*ivfPipe, error) {
+	stdout, err := execStream.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg stdout error: %s", err)
+	}
+
+	if err = execStream.Start(); err != nil {
+		return nil, fmt.Errorf("ffmpeg start error: %s", err)
+	}
+
+	return &ivfPipe{ReadCloser: stdout, execStream: execStream}, nil
+}
+
+// startVideoPipe starts execStream and reads the codec it writes to stdout,
+// IVF for VP8 and Annex B for H.264
+func startVideoPipe(execStream *exec.Cmd, codec string) (ivfReader, *ivfreader.IVFFileHeader, io.ReadCloser, error) {
+	if codec != webrtc.H264 {
+		return startIvfPipe(execStream)
+	}
+
+	pipe, err := startPipe(execStream)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	h264, header := newH264Reader(pipe)
+
+	return h264, header, pipe, nil
+}
+
+// startIvfPipe starts execStream and reads the IVF it writes to stdout. The
+// returned closer kills the process and releases the pipe.
+func startIvfPipe(execStream *exec.Cmd) (ivfReader, *ivfreader.IVFFileHeader, io.ReadCloser, error) {
+	pipe, err := startPipe(execStream)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ivf, header, err := newIvfStreamReader(pipe)
+	if err != nil {
+		pipe.Close()
+		return nil, nil, nil, fmt.Errorf("ffmpeg ivf header error: %s", err)
+	}
+
+	return ivf, header, pipe, nil
+}
+
+type ivfPipe struct {
+	io.ReadCloser
+	execStream *exec.Cmd
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+// Close is safe to call more than once, since a stop request and the stream
+// ending can both try to shut ffmpeg down
+func (p *ivfPipe) Close() error {
+	p.closeOnce.Do(func() {
+		if p.execStream.Process != nil {
+			p.execStream.Process.Kill()
+		}
+
+		p.ReadCloser.Close()
+		p.closeErr = p.execStream.Wait()
+	})
+
+	return p.closeErr
+}
+
+// closeOnStop closes c if stop is closed before the returned cancel is
+// called. A nil stop never fires.
+func closeOnStop(stop <-chan struct{}, c io.Closer) (cancel func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
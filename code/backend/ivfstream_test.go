@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+
+	"github.com/pion/webrtc/v2/pkg/media/ivfreader"
+)
+
+// trickle writes data to w a few bytes at a time, like ffmpeg flushing a pipe
+func trickle(w *io.PipeWriter, data []byte, chunk int) {
+	for len(data) > 0 {
+		n := chunk
+		if n > len(data) {
+			n = len(data)
+		}
+
+		w.Write(data[:n])
+		data = data[n:]
+	}
+
+	w.Close()
+}
+
+func TestNewIvfStreamReaderFromPipe(t *testing.T) {
+	data, err := ioutil.ReadFile(testIvfFile)
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	fileReader, _, err := ivfreader.NewWith(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	expectedFrames := 0
+	for _, _, err = fileReader.ParseNextFrame(); err == nil; _, _, err = fileReader.ParseNextFrame() {
+		expectedFrames++
+	}
+
+	r, w := io.Pipe()
+	go trickle(w, data, 7)
+
+	pipeReader, header, err := newIvfStreamReader(r)
+	if err != nil {
+		t.Fatalf("newIvfStreamReader failed with %s", err)
+	}
+
+	if header.FourCC != "VP80" {
+		t.Errorf("FourCC is %s, should be VP80", header.FourCC)
+	}
+
+	frames := 0
+	for _, _, err = pipeReader.ParseNextFrame(); err == nil; _, _, err = pipeReader.ParseNextFrame() {
+		frames++
+	}
+
+	if frames != expectedFrames {
+		t.Errorf("read %d frames from the pipe, should be %d", frames, expectedFrames)
+	}
+}
+
+func TestStartIvfPipeFailure(t *testing.T) {
+	_, _, _, err := startIvfPipe(exec.Command("not a real command"))
+	if err == nil {
+		t.Error("startIvfPipe should have failed to start a missing command")
+	}
+}
+
+func TestStreamVideoStopsWhenPipeCloses(t *testing.T) {
+	data, _ := ioutil.ReadFile(testIvfFile)
+
+	r, w := io.Pipe()
+	go trickle(w, data, 1024)
+
+	ivf, header, err := newIvfStreamReader(r)
+	if err != nil {
+		t.Fatalf("newIvfStreamReader failed with %s", err)
+	}
+
+	madeUpArgs := userArguments{videoIsLive: true}
+
+	// returns instead of waiting for more data once the writer goes away
+	streamVideo(ivf, mockVideoTrackReturningNil{}, 0, float32(header.TimebaseDenominator), r, madeUpArgs)
+}
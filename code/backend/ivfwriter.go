@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	ivfFileHeaderSize  = 32
+	ivfFrameHeaderSize = 12
+	ivfFrameCountAt    = 24
+)
+
+// ivfWriter writes already encoded frames into an IVF container. pion's
+// ivfwriter wants RTP packets, but we have whole frames straight from ffmpeg.
+type ivfWriter struct {
+	out    io.Writer
+	frames uint32
+}
+
+func newIvfWriter(out io.Writer, fourCC string, width, height uint16, timebaseDenom, timebaseNum uint32) (*ivfWriter, error) {
+	header := make([]byte, ivfFileHeaderSize)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0) // version
+	binary.LittleEndian.PutUint16(header[6:], ivfFileHeaderSize)
+	copy(header[8:], fourCC)
+	binary.LittleEndian.PutUint16(header[12:], width)
+	binary.LittleEndian.PutUint16(header[14:], height)
+	binary.LittleEndian.PutUint32(header[16:], timebaseDenom)
+	binary.LittleEndian.PutUint32(header[20:], timebaseNum)
+
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &ivfWriter{out: out}, nil
+}
+
+func (w *ivfWriter) writeFrame(frame []byte, timestamp uint64) error {
+	header := make([]byte, ivfFrameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], timestamp)
+
+	if _, err := w.out.Write(header); err != nil {
+		return err
+	}
+
+	if _, err := w.out.Write(frame); err != nil {
+		return err
+	}
+
+	w.frames++
+
+	return nil
+}
+
+// finish fills in the frame count when the output can seek back to the header
+func (w *ivfWriter) finish() error {
+	out, ok := w.out.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.frames)
+
+	if _, err := out.Seek(ivfFrameCountAt, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := out.Write(count)
+
+	return err
+}
+
+// isVP8Keyframe reports whether frame can be decoded on its own. Bit 0 of
+// the VP8 frame tag is 0 for key frames.
+func isVP8Keyframe(frame []byte) bool {
+	return len(frame) > 0 && frame[0]&0x01 == 0
+}
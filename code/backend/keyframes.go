@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// keyframeMaxGap is the longest live video goes without a keyframe. A viewer
+// that joins, switches feed or loses packets (and sends a PLI or FIR) can only
+// start decoding again at one. ffmpeg can't be asked for a keyframe while it
+// runs, and restarting it for one would reopen the camera and blank every
+// other viewer, so instead every live encoder is made to send them at least
+// this often, whatever its keyframe interval.
+const keyframeMaxGap = 2 * time.Second
+
+// forceKeyframes adds the ffmpeg output option that keeps keyframes no more
+// than keyframeMaxGap apart
+func forceKeyframes(args []string) []string {
+	every := strconv.FormatFloat(keyframeMaxGap.Seconds(), 'f', -1, 64)
+
+	return insertBeforeOutput(args, "-force_key_frames", "expr:gte(t,n_forced*"+every+")")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+func TestForceKeyframes(t *testing.T) {
+	args := forceKeyframes([]string{"-g", "300", "-f", "ivf", "pipe:1"})
+	if got := strings.Join(args, " "); got != "-g 300 -force_key_frames expr:gte(t,n_forced*2) -f ivf pipe:1" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestBroadcasterHoldsNewTracksUntilKeyframe(t *testing.T) {
+	b := newVideoBroadcaster(webrtc.VP8)
+
+	early, late := 0, 0
+	b.addTrack(countingVideoTrack{samples: &early})
+	b.WriteSample(media.Sample{Data: []byte{0x00}}) // keyframe
+	b.addTrack(countingVideoTrack{samples: &late})
+
+	b.WriteSample(media.Sample{Data: []byte{0x01}}) // depends on the keyframe
+	if early != 2 || late != 0 {
+		t.Errorf("got %d and %d frames, the late track should wait for a keyframe", early, late)
+	}
+
+	b.WriteSample(media.Sample{Data: []byte{0x00}})
+	b.WriteSample(media.Sample{Data: []byte{0x01}})
+	if late != 2 {
+		t.Errorf("the late track got %d frames after the keyframe", late)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+const (
+	defaultLatencyBudget = 500 * time.Millisecond
+	frameQueueLimit      = 120 // about four seconds at 30fps; reading waits for the sender past this
+	latencySmoothing     = 0.1 // weight of each new measurement in the running average
+	latencyReportMaxAge  = 30 * time.Second
+)
+
+// queuedFrame is a frame read from ffmpeg that hasn't been sent yet
+type queuedFrame struct {
+	data      []byte
+	timestamp uint64
+	keyframe  bool
+	received  time.Time
+}
+
+// frameQueue sits between reading frames from ffmpeg and sending them paced.
+// Reading never waits on the pacer, so a backlog shows up here, where it can
+// be skipped, rather than in ffmpeg's pipe, where it can't be seen.
+type frameQueue struct {
+	mu      sync.Mutex
+	frames  []queuedFrame
+	closed  bool
+	changed chan struct{} // closed and replaced whenever frames are pushed or popped
+}
+
+func newFrameQueue() *frameQueue {
+	return &frameQueue{changed: make(chan struct{})}
+}
+
+// notify wakes everything waiting on the queue; q.mu must be held
+func (q *frameQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// wait unlocks q.mu until the queue next changes
+func (q *frameQueue) wait() {
+	changed := q.changed
+	q.mu.Unlock()
+	<-changed
+	q.mu.Lock()
+}
+
+func (q *frameQueue) push(f queuedFrame) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.frames) >= frameQueueLimit && !q.closed {
+		q.wait()
+	}
+
+	q.frames = append(q.frames, f)
+	q.notify()
+}
+
+// pop waits for the next frame, returning false once the queue is closed and
+// empty
+func (q *frameQueue) pop() (queuedFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.frames) == 0 && !q.closed {
+		q.wait()
+	}
+
+	if len(q.frames) == 0 {
+		return queuedFrame{}, false
+	}
+
+	f := q.frames[0]
+	q.frames = q.frames[1:]
+	q.notify()
+
+	return f, true
+}
+
+// close lets pop drain what is left and then stop
+func (q *frameQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notify()
+}
+
+// skipStale drops the queued frames that are more than budget behind the
+// newest one read, going ahead to the latest queued keyframe. With no
+// keyframe queued everything goes, and it reports false so the frames that
+// follow are dropped too until one arrives.
+func (q *frameQueue) skipStale(budget time.Duration, p *framePacer) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) < 2 {
+		return 0, true
+	}
+
+	oldest, newest := q.frames[0], q.frames[len(q.frames)-1]
+	if newest.timestamp < oldest.timestamp || p.span(oldest.timestamp, newest.timestamp, len(q.frames)) <= budget {
+		return 0, true // within budget, or ffmpeg restarted and its clock started over
+	}
+
+	latest := -1
+	for i, f := range q.frames {
+		if f.keyframe {
+			latest = i
+		}
+	}
+
+	if latest == 0 {
+		return 0, true // already at the latest keyframe
+	}
+
+	skipped := len(q.frames)
+	if latest > 0 {
+		skipped = latest
+	}
+
+	q.frames = q.frames[skipped:]
+	q.notify()
+
+	return skipped, latest > 0
+}
+
+// span is how long the frames from oldest to newest cover, guessed from how
+// many there are when the stream has no timebase
+func (p *framePacer) span(oldest, newest uint64, frames int) time.Duration {
+	if p.secondsPerTick == 0 {
+		return time.Duration(frames) * time.Second / defaultFrameRate
+	}
+
+	return p.duration(newest - oldest)
+}
+
+// skipped restarts the schedule after frames were skipped, waiting for a
+// keyframe first unless the next frame is one
+func (p *framePacer) skipped(toKeyframe bool) {
+	p.anchored = false
+	p.catchingUp = !toKeyframe
+}
+
+// latencyRecorder is implemented by tracks that keep how long frames took
+// from ffmpeg to being sent
+type latencyRecorder interface {
+	recordLatency(d time.Duration)
+}
+
+// sendFrames paces the queued frames out to videoTrack until the queue is
+// closed and empty. Live video that falls more than budget behind the newest
+// frame read skips ahead, so viewers see what is happening now rather than a
+// steadily growing delay.
+func sendFrames(queue *frameQueue, videoTrack videoMediaTrack, pacer *framePacer, budget time.Duration) {
+	recorder, _ := videoTrack.(latencyRecorder)
+
+	for {
+		if pacer.live && budget > 0 {
+			if skipped, toKeyframe := queue.skipStale(budget, pacer); skipped > 0 {
+				pacer.skipped(toKeyframe)
+			}
+		}
+
+		f, ok := queue.pop()
+		if !ok {
+			return
+		}
+
+		samples, send := pacer.next(f.timestamp, f.keyframe)
+		if !send {
+			continue
+		}
+
+		if err := videoTrack.WriteSample(media.Sample{Data: f.data, Samples: samples}); err != nil {
+			continue
+		}
+
+		if recorder != nil {
+			recorder.recordLatency(time.Since(f.received))
+		}
+
+		fmt.Print("=")
+	}
+}
+
+// latencyAverage is a running average of how long frames wait in the server
+type latencyAverage struct {
+	mu      sync.Mutex
+	average time.Duration
+	samples bool
+}
+
+func (l *latencyAverage) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.samples {
+		l.average = d
+		l.samples = true
+		return
+	}
+
+	l.average += time.Duration(latencySmoothing * float64(d-l.average))
+}
+
+func (l *latencyAverage) value() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.average
+}
+
+// latencyReport is what a browser measures of its own share of the delay,
+// from RTCPeerConnection.getStats: the selected candidate pair's
+// currentRoundTripTime, and the inbound video's jitterBufferDelay and
+// totalDecodeTime per frame. pion doesn't measure the round trip itself.
+type latencyReport struct {
+	RoundTripMs    float64 `json:"roundTripMs"`
+	JitterBufferMs float64 `json:"jitterBufferMs"`
+	DecodeMs       float64 `json:"decodeMs"`
+}
+
+// latencyEstimate breaks a session's glass to glass delay into the parts we
+// can measure. Capture and encoding inside ffmpeg aren't included.
+type latencyEstimate struct {
+	ServerMs   float64    `json:"serverMs"`  // from ffmpeg to sent, on the slowest feed
+	NetworkMs  float64    `json:"networkMs"` // half the reported round trip, or the control channel's
+	PlayoutMs  float64    `json:"playoutMs"` // the browser's jitter buffer and decoder
+	TotalMs    float64    `json:"totalMs"`
+	ReportedAt *time.Time `json:"reportedAt,omitempty"` // when the browser last reported, if recently
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// latency estimates the session's delay; s.mu must be held
+func (s *viewerSession) latency(now time.Time) latencyEstimate {
+	var estimate latencyEstimate
+	for _, feed := range s.feeds {
+		if feed.broadcaster == nil {
+			continue
+		}
+
+		if ms := milliseconds(feed.broadcaster.latency.value()); ms > estimate.ServerMs {
+			estimate.ServerMs = ms
+		}
+	}
+
+	if s.latencyReport != nil && now.Sub(s.latencyReportedAt) < latencyReportMaxAge {
+		reportedAt := s.latencyReportedAt
+		estimate.ReportedAt = &reportedAt
+		estimate.NetworkMs = s.latencyReport.RoundTripMs / 2
+		estimate.PlayoutMs = s.latencyReport.JitterBufferMs + s.latencyReport.DecodeMs
+	} else {
+		estimate.NetworkMs = milliseconds(s.roundTrip.value()) / 2
+	}
+
+	estimate.TotalMs = estimate.ServerMs + estimate.NetworkMs + estimate.PlayoutMs
+
+	return estimate
+}
+
+// serveLatency handles /api/sessions/{id}/latency. GET returns the session's
+// latency estimate and POST takes the browser's latencyReport, which it
+// should send every few seconds while connected.
+func serveLatency(w http.ResponseWriter, req *http.Request, s *viewerSession, segments []string) {
+	if len(segments) != 0 {
+		writeJSONError(w, http.StatusNotFound, notFoundError{what: req.URL.Path})
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		estimate := s.latency(time.Now())
+		s.mu.Unlock()
+
+		writeJSON(w, http.StatusOK, estimate)
+	case http.MethodPost:
+		var report latencyReport
+		if err := readJSON(req, &report); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if report.RoundTripMs < 0 || report.JitterBufferMs < 0 || report.DecodeMs < 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("latency report has negative times"))
+			return
+		}
+
+		s.mu.Lock()
+		s.latencyReport = &report
+		s.latencyReportedAt = time.Now()
+		s.mu.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+// sentFrames keeps the first byte of every frame written to it
+type sentFrames struct {
+	sent []byte
+}
+
+func (s *sentFrames) WriteSample(sample media.Sample) error {
+	s.sent = append(s.sent, sample.Data[0])
+	return nil
+}
+
+// queueFrames queues frames 100ms apart, numbered by their data
+func queueFrames(q *frameQueue, from, to int, keyframes ...int) {
+	for i := from; i < to; i++ {
+		keyframe := false
+		for _, k := range keyframes {
+			keyframe = keyframe || k == i
+		}
+
+		q.push(queuedFrame{data: []byte{byte(i)}, timestamp: uint64(i * 100), keyframe: keyframe, received: time.Now()})
+	}
+}
+
+func TestFrameQueueSkipStale(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	p := clock.pacer(1, 1000, true)
+
+	q := newFrameQueue()
+	queueFrames(q, 0, 5, 0)
+	if skipped, _ := q.skipStale(500*time.Millisecond, p); skipped != 0 {
+		t.Errorf("skipped %d frames within the budget", skipped)
+	}
+
+	queueFrames(q, 5, 10, 4, 7)
+	if skipped, toKeyframe := q.skipStale(500*time.Millisecond, p); skipped != 7 || !toKeyframe {
+		t.Errorf("skipped %d frames, to a keyframe %t", skipped, toKeyframe)
+	}
+	if f, _ := q.pop(); f.data[0] != 7 {
+		t.Errorf("the queue went on from frame %d, should be the latest keyframe", f.data[0])
+	}
+
+	q = newFrameQueue()
+	queueFrames(q, 0, 10)
+	if skipped, toKeyframe := q.skipStale(500*time.Millisecond, p); skipped != 10 || toKeyframe {
+		t.Errorf("without a keyframe skipped %d frames, to a keyframe %t", skipped, toKeyframe)
+	}
+}
+
+func TestSendFramesKeepsLiveVideoWithinBudget(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+
+	// a second of video backed up behind a stalled sender
+	q := newFrameQueue()
+	queueFrames(q, 0, 10, 0, 5)
+	q.close()
+
+	track := &sentFrames{}
+	sendFrames(q, track, clock.pacer(1, 1000, true), 500*time.Millisecond)
+
+	if !bytes.Equal(track.sent, []byte{5, 6, 7, 8, 9}) {
+		t.Errorf("sent frames %v, should have skipped to the keyframe at 5", track.sent)
+	}
+
+	// a replayed file is never skipped
+	q = newFrameQueue()
+	queueFrames(q, 0, 10, 0, 5)
+	q.close()
+
+	track = &sentFrames{}
+	sendFrames(q, track, clock.pacer(1, 1000, false), 500*time.Millisecond)
+
+	if len(track.sent) != 10 {
+		t.Errorf("replay sent %v", track.sent)
+	}
+}
+
+func TestBroadcasterAveragesLatency(t *testing.T) {
+	b := newVideoBroadcaster("")
+	b.recordLatency(10 * time.Millisecond)
+	b.recordLatency(20 * time.Millisecond)
+
+	if got := b.latency.value(); got != 11*time.Millisecond {
+		t.Errorf("average latency %s, should be 11ms", got)
+	}
+}
+
+func TestServeLatency(t *testing.T) {
+	s, _ := feedTestSession()
+	s.attachFeed(&sentFrames{}, s.args.sources[0])
+	s.feeds[0].broadcaster.recordLatency(40 * time.Millisecond)
+	defer s.detachFeeds()
+
+	w := httptest.NewRecorder()
+	serveLatency(w, httptest.NewRequest(http.MethodPost, "/api/sessions/x/latency",
+		strings.NewReader(`{"roundTripMs": 30, "jitterBufferMs": 50, "decodeMs": 5}`)), s, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("report got %d", w.Code)
+	}
+
+	s.mu.Lock()
+	estimate := s.latency(time.Now())
+	stale := s.latency(time.Now().Add(latencyReportMaxAge))
+	s.mu.Unlock()
+
+	if estimate.ServerMs != 40 || estimate.NetworkMs != 15 || estimate.PlayoutMs != 55 || estimate.TotalMs != 110 || estimate.ReportedAt == nil {
+		t.Errorf("unexpected estimate %+v", estimate)
+	}
+
+	if stale.TotalMs != 40 || stale.ReportedAt != nil {
+		t.Errorf("an old report was still used: %+v", stale)
+	}
+
+	w = httptest.NewRecorder()
+	serveLatency(w, httptest.NewRequest(http.MethodPost, "/api/sessions/x/latency",
+		strings.NewReader(`{"roundTripMs": -1}`)), s, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a negative round trip got %d", w.Code)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import "time"
+
+const (
+	rtpVideoClockRate = 90000
+	defaultFrameRate  = 30
+	pacingMaxLag      = defaultLatencyBudget // behind live by this much, frames are dropped to catch up
+	pacingMaxGap      = 2 * time.Second      // a timestamp jump this big is a new stream, not a pause
+	pacingDriftShare  = 8                    // a small lag is taken out of the schedule an eighth at a time
+)
+
+// framePacer sends frames when their timestamps say they are due. Each frame
+// is scheduled from the first frame's time on the monotonic clock rather than
+// from the frame before it, so sleeping late for one frame doesn't push back
+// all the rest. It also works out each frame's duration on the RTP clock.
+type framePacer struct {
+	secondsPerTick float64 // one timestamp unit, from the stream's timebase
+	live           bool
+	skip           bool // drop frames to catch up when too far behind live
+	maxLag         time.Duration
+	now            func() time.Time
+	sleep          func(time.Duration)
+
+	anchored   bool
+	start      time.Time // when the frame stamped first was sent
+	first      uint64
+	last       uint64 // the timestamp of the last frame sent
+	catchingUp bool   // dropping frames until the next keyframe
+}
+
+func newFramePacer(timebaseNum, timebaseDenom float32, live bool) *framePacer {
+	p := &framePacer{live: live, skip: live, maxLag: pacingMaxLag, now: time.Now, sleep: time.Sleep}
+	if timebaseNum > 0 && timebaseDenom > 0 {
+		p.secondsPerTick = float64(timebaseNum) / float64(timebaseDenom)
+	}
+
+	return p
+}
+
+// setBudget skips live video ahead once it falls budget behind; a budget of 0
+// never skips, however far behind it gets
+func (p *framePacer) setBudget(budget time.Duration) {
+	if budget > 0 {
+		p.maxLag = budget
+	}
+
+	p.skip = p.live && budget > 0
+}
+
+func (p *framePacer) duration(ticks uint64) time.Duration {
+	return time.Duration(float64(ticks) * p.secondsPerTick * float64(time.Second))
+}
+
+func (p *framePacer) anchor(timestamp uint64, now time.Time) {
+	p.anchored = true
+	p.start = now
+	p.first = timestamp
+	p.last = timestamp
+}
+
+// next waits until the frame stamped timestamp is due, and returns how many
+// RTP clock ticks have passed since the last frame sent. A frame it returns
+// false for should be dropped: when live video falls too far behind, frames
+// are skipped up to the next keyframe, since sending them all quickly would
+// only make every viewer's decoder stutter.
+func (p *framePacer) next(timestamp uint64, keyframe bool) (uint32, bool) {
+	nominal := uint32(rtpVideoClockRate / defaultFrameRate)
+	if p.secondsPerTick == 0 { // no timing to go on
+		return nominal, true
+	}
+
+	if p.catchingUp && !keyframe {
+		return 0, false
+	}
+
+	now := p.now()
+	if !p.anchored || timestamp < p.last || p.duration(timestamp-p.last) > pacingMaxGap {
+		// the first frame, or ffmpeg was restarted and its clock started over
+		p.catchingUp = false
+		p.anchor(timestamp, now)
+		return nominal, true
+	}
+
+	samples := uint32(float64(timestamp-p.last)*p.secondsPerTick*rtpVideoClockRate + 0.5)
+
+	if p.catchingUp { // caught up at a keyframe, so start the schedule again here
+		p.catchingUp = false
+		p.anchor(timestamp, now)
+		return samples, true
+	}
+
+	due := p.start.Add(p.duration(timestamp - p.first))
+	switch lag := now.Sub(due); {
+	case lag < 0:
+		p.sleep(-lag)
+	case lag > p.maxLag && p.skip && !keyframe:
+		p.catchingUp = true
+		return 0, false
+	case lag > p.maxLag:
+		p.start = p.start.Add(lag) // a replayed file, or live video with no budget, can't skip ahead, so just stop trying to catch up
+	default:
+		// a little behind, likely because the source's clock runs fast
+		// against ours, so creep towards it
+		p.start = p.start.Add(lag / pacingDriftShare)
+	}
+
+	p.last = timestamp
+
+	return samples, true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock stands in for the monotonic clock; sleeping moves it on
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) pacer(timebaseNum, timebaseDenom float32, live bool) *framePacer {
+	p := newFramePacer(timebaseNum, timebaseDenom, live)
+	p.now = func() time.Time { return c.now }
+	p.sleep = func(d time.Duration) {
+		c.slept += d
+		c.now = c.now.Add(d)
+	}
+
+	return p
+}
+
+func TestFramePacerFollowsTimestamps(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	p := clock.pacer(1, 1000, true) // millisecond timestamps
+
+	if samples, send := p.next(5000, true); !send || samples != rtpVideoClockRate/defaultFrameRate {
+		t.Errorf("first frame gave %d, %t", samples, send)
+	}
+
+	// 25fps with one frame coming 10ms late: the RTP clock follows the
+	// timestamps, and the late frame doesn't delay the one after it
+	for i, frame := range []struct {
+		timestamp uint64
+		samples   uint32
+		arrives   time.Duration
+	}{
+		{5040, 3600, 0},
+		{5080, 3600, 50 * time.Millisecond},
+		{5120, 3600, 0},
+	} {
+		clock.now = clock.now.Add(frame.arrives)
+		clock.slept = 0
+
+		samples, send := p.next(frame.timestamp, false)
+		if !send || samples != frame.samples {
+			t.Errorf("frame %d gave %d, %t", i, samples, send)
+		}
+
+		if frame.timestamp == 5120 && (clock.slept < 30*time.Millisecond || clock.slept >= 40*time.Millisecond) {
+			t.Errorf("frame after the late one waited %s, should be about 30ms", clock.slept)
+		}
+	}
+}
+
+func TestFramePacerCatchesUpLive(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	p := clock.pacer(1, 30, true) // frame count timestamps, like the H.264 reader
+
+	p.next(0, true)
+	clock.now = clock.now.Add(time.Second) // the reader stalled for a second
+
+	if _, send := p.next(1, false); send {
+		t.Error("a frame a second behind live was sent")
+	}
+	if _, send := p.next(2, false); send {
+		t.Error("frames should be dropped until a keyframe")
+	}
+
+	samples, send := p.next(3, true)
+	if !send || samples != 3*3000 {
+		t.Errorf("the catch up keyframe gave %d, %t", samples, send)
+	}
+
+	clock.slept = 0
+	if _, send = p.next(4, false); !send || clock.slept == 0 {
+		t.Errorf("after catching up frames should be paced again, slept %s", clock.slept)
+	}
+}
+
+func TestFramePacerReplayDoesNotDrop(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	p := clock.pacer(1, 30, false)
+
+	p.next(0, true)
+	clock.now = clock.now.Add(time.Second)
+
+	if _, send := p.next(1, false); !send {
+		t.Error("a replayed file dropped a frame")
+	}
+
+	clock.slept = 0
+	p.next(2, false)
+	if clock.slept < 30*time.Millisecond {
+		t.Errorf("replay raced to catch up, slept %s", clock.slept)
+	}
+}
+
+func TestFramePacerWithoutBudgetDoesNotDrop(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	p := clock.pacer(1, 30, true)
+	p.setBudget(0)
+
+	p.next(0, true)
+	clock.now = clock.now.Add(time.Second)
+
+	if _, send := p.next(1, false); !send {
+		t.Error("live video with no latency budget dropped a frame")
+	}
+
+	clock.slept = 0
+	if _, send := p.next(2, false); !send || clock.slept < 30*time.Millisecond {
+		t.Errorf("frames should be paced from where it fell behind to, slept %s", clock.slept)
+	}
+
+	p.setBudget(100 * time.Millisecond)
+	clock.now = clock.now.Add(time.Second)
+	if _, send := p.next(3, false); send {
+		t.Error("with a budget again, a frame a second behind live was sent")
+	}
+}
+
+func TestFramePacerRestartedStream(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	p := clock.pacer(1, 1000, true)
+
+	p.next(90000, true)
+	clock.now = clock.now.Add(40 * time.Millisecond)
+	p.next(90040, false)
+
+	// ffmpeg restarted, so its timestamps start over
+	clock.slept = 0
+	if samples, send := p.next(0, true); !send || samples != rtpVideoClockRate/defaultFrameRate || clock.slept != 0 {
+		t.Errorf("restarted stream gave %d, %t after %s", samples, send, clock.slept)
+	}
+
+	if samples, _ := p.next(40, false); samples != 3600 {
+		t.Errorf("frame after the restart lasted %d", samples)
+	}
+}
+
+func TestFramePacerWithoutTimebase(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	p := clock.pacer(0, 30, true)
+
+	for i := uint64(0); i < 3; i++ {
+		if samples, send := p.next(i*1000, false); !send || samples != rtpVideoClockRate/defaultFrameRate {
+			t.Errorf("frame %d gave %d, %t", i, samples, send)
+		}
+	}
+
+	if clock.slept != 0 {
+		t.Errorf("slept %s without any timing", clock.slept)
+	}
+}
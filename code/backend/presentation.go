@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	presentationEvent     = "presentation"
+	presentationLive      = "live"
+	presentationFrozen    = "frozen"
+	presentationReviewing = "reviewing"
+)
+
+// presentationState is what every viewer should be showing. Viewers follow
+// it rather than pausing on their own, so a lecture hall sees what the
+// presenter sees.
+type presentationState struct {
+	Mode           string    `json:"mode"`
+	FrameTimestamp int64     `json:"frameTimestamp,omitempty"` // frozen: the frame in milliseconds, as annotations use
+	Snapshot       string    `json:"snapshot,omitempty"`       // reviewing: the snapshot's ID
+	Version        uint64    `json:"version"`                  // goes up with every change, so stale events can be ignored
+	ChangedAt      time.Time `json:"changedAt"`
+	ChangedBy      string    `json:"changedBy,omitempty"`
+}
+
+// presentation holds the one presentation state and pushes changes to it
+// over the event hub
+type presentation struct {
+	mu        sync.Mutex
+	state     presentationState
+	hub       *eventHub
+	snapshots *snapshotStore
+}
+
+func newPresentation(hub *eventHub, snapshots *snapshotStore) *presentation {
+	return &presentation{
+		state:     presentationState{Mode: presentationLive, ChangedAt: time.Now()},
+		hub:       hub,
+		snapshots: snapshots,
+	}
+}
+
+func (p *presentation) current() presentationState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state
+}
+
+// set moves every viewer to next. Freezing without a frame freezes on the
+// frame showing now; reviewing needs a snapshot that exists.
+func (p *presentation) set(next presentationState, by, from string) (presentationState, error) {
+	switch next.Mode {
+	case presentationLive:
+		next.FrameTimestamp, next.Snapshot = 0, ""
+	case presentationFrozen:
+		next.Snapshot = ""
+		if next.FrameTimestamp == 0 {
+			next.FrameTimestamp = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+	case presentationReviewing:
+		next.FrameTimestamp = 0
+		if next.Snapshot == "" {
+			return presentationState{}, badRequestError{err: fmt.Errorf("reviewing needs a snapshot")}
+		}
+
+		snap, err := p.snapshots.get(next.Snapshot)
+		if err != nil {
+			return presentationState{}, err
+		}
+		next.FrameTimestamp = snap.FrameTimestamp // so annotations made while reviewing land on it
+	default:
+		return presentationState{}, badRequestError{err: fmt.Errorf("mode %q is not live, frozen or reviewing", next.Mode)}
+	}
+
+	p.mu.Lock()
+	next.Version = p.state.Version + 1
+	next.ChangedAt = time.Now()
+	next.ChangedBy = by
+	p.state = next
+	p.mu.Unlock()
+
+	return next, p.hub.publish(presentationEvent, next, from)
+}
+
+func (p *presentation) handleEvent(from *hubClient, data json.RawMessage) error {
+	var next presentationState
+	if err := json.Unmarshal(data, &next); err != nil {
+		return err
+	}
+
+	_, err := p.set(next, from.name, from.id)
+
+	return err
+}
+
+// greet tells a viewer that just connected what it should be showing
+func (p *presentation) greet(client *hubClient) {
+	p.hub.sendTo(client, presentationEvent, p.current())
+}
+
+// presentationHandler serves GET and PUT /api/presentation. Like
+// annotations, PUTs should carry the X-Client-ID from the event stream.
+func presentationHandler(p *presentation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, p.current())
+		case http.MethodPut:
+			var next presentationState
+			err := readJSON(r, &next)
+			if err == nil {
+				next, err = p.set(next, identityFrom(r.Context()).Name, r.Header.Get(clientIDHeader))
+			}
+
+			if err != nil {
+				writeJSONError(w, errorStatus(err), err)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, next)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		}
+	}
+}
+
+func registerPresentationHandlers(p *presentation) {
+	p.hub.on(presentationEvent, p.handleEvent)
+	p.hub.restrict(presentationEvent, rolePresenter)
+	p.hub.onConnect(p.greet)
+	http.HandleFunc("/api/presentation", presentationHandler(p))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestPresentationFollowsPresenter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "presentation")
+	defer os.RemoveAll(dir)
+
+	h := newEventHub()
+	p := newPresentation(h, newSnapshotStore(dir))
+	h.on(presentationEvent, p.handleEvent)
+	h.restrict(presentationEvent, rolePresenter)
+	presenter, viewer := h.register(), h.register()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/api/presentation", strings.NewReader(`{"mode": "frozen", "frameTimestamp": 1234}`))
+	req.Header.Set(clientIDHeader, presenter.id)
+	presentationHandler(p)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("freezing got %d: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case msg := <-viewer.send:
+		var event struct {
+			Type string            `json:"type"`
+			Data presentationState `json:"data"`
+		}
+		json.Unmarshal(msg, &event)
+		if event.Type != presentationEvent || event.Data.Mode != presentationFrozen || event.Data.FrameTimestamp != 1234 || event.Data.Version != 1 {
+			t.Errorf("viewer got %s", msg)
+		}
+	default:
+		t.Error("the viewer wasn't told to freeze")
+	}
+
+	select {
+	case msg := <-presenter.send:
+		t.Errorf("the presenter got its own change back: %s", msg)
+	default:
+	}
+
+	if err := h.dispatch(viewer, hubMessage{Type: presentationEvent, Data: json.RawMessage(`{"mode": "live"}`)}); err == nil {
+		t.Error("a viewer changed the presentation")
+	}
+
+	for body, status := range map[string]int{
+		`{"mode": "paused"}`:                        http.StatusBadRequest,
+		`{"mode": "reviewing"}`:                     http.StatusBadRequest,
+		`{"mode": "reviewing", "snapshot": "nope"}`: http.StatusNotFound,
+	} {
+		w = httptest.NewRecorder()
+		presentationHandler(p)(w, httptest.NewRequest(http.MethodPut, "/api/presentation", strings.NewReader(body)))
+		if w.Code != status {
+			t.Errorf("%s got %d, should be %d", body, w.Code, status)
+		}
+	}
+
+	if state := p.current(); state.Mode != presentationFrozen || state.Version != 1 {
+		t.Errorf("a rejected change altered the state to %+v", state)
+	}
+
+	presenter.name, presenter.role = "attending", rolePresenter
+	if err := h.dispatch(presenter, hubMessage{Type: presentationEvent, Data: json.RawMessage(`{"mode": "live"}`)}); err != nil {
+		t.Fatalf("the presenter couldn't go live over the event stream: %s", err)
+	}
+
+	if state := p.current(); state.Mode != presentationLive || state.ChangedBy != "attending" {
+		t.Errorf("a change over the event stream should be put down to who made it: %+v", state)
+	}
+}
+
+func TestPresentationGreetsLateViewers(t *testing.T) {
+	h := newEventHub()
+	p := newPresentation(h, newSnapshotStore(""))
+	h.onConnect(p.greet)
+
+	if _, err := p.set(presentationState{Mode: presentationFrozen}, "", ""); err != nil {
+		t.Fatalf("set failed with %s", err)
+	}
+
+	ts := httptest.NewServer(websocket.Handler(h.serveWebSocket))
+	defer ts.Close()
+
+	ws, _ := dialHub(t, ts.URL)
+	defer ws.Close()
+
+	msg, err := receiveWithin(ws, time.Second)
+	if err != nil || msg.Type != presentationEvent || !strings.Contains(string(msg.Data), presentationFrozen) {
+		t.Errorf("a late viewer got %+v, %s", msg, err)
+	}
+}
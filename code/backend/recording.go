@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+const (
+	recordingFormatIvf  = "ivf"
+	recordingFormatWebm = "webm"
+	recordingTimebase   = 1000 // frame timestamps are in milliseconds
+	recordingIDTime     = "20060102-150405"
+	recordingQueue      = 60 // frames buffered ahead of a recording's files before some are dropped
+)
+
+type recordingMarker struct {
+	Label    string    `json:"label"`
+	Step     string    `json:"step,omitempty"`
+	At       time.Time `json:"at"`
+	OffsetMs int64     `json:"offsetMs"`
+}
+
+// recordingManifest is saved next to the video files of every recording
+type recordingManifest struct {
+	ID         string            `json:"id"`
+	Source     string            `json:"source,omitempty"`
+	Device     string            `json:"device"`
+	Resolution string            `json:"resolution"`
+	StartedAt  time.Time         `json:"startedAt"`
+	StoppedAt  *time.Time        `json:"stoppedAt,omitempty"`
+	Files      []string          `json:"files"`
+	Markers    []recordingMarker `json:"markers"`
+}
+
+// recording is attached to a broadcaster like any viewer's track. Frames are
+// stamped with the recording's own clock, so the files stay continuous when
+// ffmpeg restarts and its timestamps start over. They are queued and written
+// from the recording's own goroutine, so a slow disk or remux ffmpeg can't
+// hold up the viewers; when the queue is full frames are dropped until the
+// next keyframe.
+type recording struct {
+	mu          sync.Mutex
+	manifest    recordingManifest
+	dir         string
+	started     time.Time
+	sawKeyframe bool
+	closed      bool
+	frames      chan recordedFrame
+	done        chan struct{} // closed once every queued frame is written
+	writers     []*ivfWriter
+	closers     []io.Closer
+
+	broadcaster *videoBroadcaster
+	trackID     uint64
+	audio       *recordingAudio // nil without an audio device
+}
+
+// recordedFrame is a frame waiting to be written, stamped when it arrived
+type recordedFrame struct {
+	data      []byte
+	timestamp uint64
+}
+
+func newRecording(dir string, src videoSource, b *videoBroadcaster) *recording {
+	now := time.Now()
+	rec := &recording{
+		dir:     dir,
+		started: now,
+		manifest: recordingManifest{
+			ID:         now.Format(recordingIDTime) + "-" + randomID(4),
+			Source:     src.Name,
+			Device:     src.Device,
+			Resolution: src.Resolution,
+			StartedAt:  now,
+			Files:      []string{},
+			Markers:    []recordingMarker{},
+		},
+		frames:      make(chan recordedFrame, recordingQueue),
+		done:        make(chan struct{}),
+		broadcaster: b,
+	}
+
+	go rec.writeFrames()
+
+	return rec
+}
+
+func (rec *recording) WriteSample(s media.Sample) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	// frames before the first keyframe can't be decoded from the file
+	if rec.closed || !rec.sawKeyframe && !isKeyframe(rec.broadcaster.codec, s.Data) {
+		return nil
+	}
+
+	timestamp := uint64(time.Since(rec.started) / time.Millisecond)
+	select {
+	case rec.frames <- recordedFrame{data: s.Data, timestamp: timestamp}:
+		rec.sawKeyframe = true
+	default:
+		rec.sawKeyframe = false
+	}
+
+	return nil
+}
+
+// writeFrames writes the queued frames to every file until the queue is
+// closed. The writers are all opened before the recording is attached, so
+// they don't change while it runs.
+func (rec *recording) writeFrames() {
+	defer close(rec.done)
+
+	id := rec.manifest.ID
+	for f := range rec.frames {
+		for _, w := range rec.writers {
+			if err := w.writeFrame(f.data, f.timestamp); err != nil {
+				fmt.Printf("recording %s write error: %s\n", id, err)
+			}
+		}
+	}
+}
+
+func (rec *recording) saveManifest() error {
+	b, err := json.MarshalIndent(rec.manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(rec.dir, rec.manifest.ID+".json"), b, 0644)
+}
+
+// remuxFile closes the IVF stream into ffmpeg's stdin and waits for it to
+// finish writing the container
+type remuxFile struct {
+	stdin      io.WriteCloser
+	execStream *exec.Cmd
+}
+
+func (r remuxFile) Close() error {
+	r.stdin.Close()
+	return r.execStream.Wait()
+}
+
+func composeRemuxCommand(outputPath string) *exec.Cmd {
+	return exec.Command("ffmpeg", "-y", "-f", "ivf", "-i", "pipe:0",
+		"-c", "copy", outputPath)
+}
+
+func parseResolution(resolution string) (uint16, uint16) {
+	parts := strings.SplitN(resolution, "x", 2)
+	if len(parts) != 2 {
+		return 0, 0
+	}
+
+	width, _ := strconv.ParseUint(parts[0], 10, 16)
+	height, _ := strconv.ParseUint(parts[1], 10, 16)
+
+	return uint16(width), uint16(height)
+}
+
+// recordingManager keeps track of recordings in progress and finds finished
+// ones from their manifests on disk
+type recordingManager struct {
+	mu     sync.Mutex
+	dir    string
+	active map[string]*recording
+	mux    func(videoPath, audioPath, outputPath string) error
+}
+
+func newRecordingManager(dir string) *recordingManager {
+	return &recordingManager{dir: dir, active: map[string]*recording{}, mux: muxAudio}
+}
+
+func (m *recordingManager) openFormat(rec *recording, format string) error {
+	width, height := parseResolution(rec.manifest.Resolution)
+	path := filepath.Join(m.dir, rec.manifest.ID+"."+format)
+
+	var out io.Writer
+	switch format {
+	case recordingFormatIvf:
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+
+		out = file
+		rec.closers = append(rec.closers, file)
+	case recordingFormatWebm:
+		execStream := composeRemuxCommand(path)
+		stdin, err := execStream.StdinPipe()
+		if err != nil {
+			return err
+		}
+
+		if err = execStream.Start(); err != nil {
+			return fmt.Errorf("ffmpeg remux start error: %s", err)
+		}
+
+		out = stdin
+		rec.closers = append(rec.closers, remuxFile{stdin: stdin, execStream: execStream})
+	default:
+		return fmt.Errorf("recording format %s not supported", format)
+	}
+
+	w, err := newIvfWriter(out, ivfFourCC(rec.broadcaster.codec), width, height, recordingTimebase, 1)
+	if err != nil {
+		return err
+	}
+
+	rec.writers = append(rec.writers, w)
+	rec.manifest.Files = append(rec.manifest.Files, filepath.Base(path))
+
+	return nil
+}
+
+// start records everything b broadcasts into one file per format
+func (m *recordingManager) start(b *videoBroadcaster, src videoSource, formats []string) (recordingManifest, error) {
+	if len(formats) == 0 {
+		formats = []string{recordingFormatIvf}
+	}
+
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return recordingManifest{}, err
+	}
+
+	rec := newRecording(m.dir, src, b)
+	for _, format := range formats {
+		if err := m.openFormat(rec, format); err != nil {
+			rec.close()
+			return recordingManifest{}, err
+		}
+	}
+
+	if err := rec.saveManifest(); err != nil {
+		rec.close()
+		return recordingManifest{}, err
+	}
+
+	m.mu.Lock()
+	m.active[rec.manifest.ID] = rec
+	m.mu.Unlock()
+
+	rec.trackID = b.addTrack(rec)
+
+	return rec.manifest, nil
+}
+
+// close writes out whatever is still queued, then finishes every file
+func (rec *recording) close() {
+	rec.mu.Lock()
+	if !rec.closed {
+		rec.closed = true
+		close(rec.frames)
+	}
+	rec.mu.Unlock()
+
+	<-rec.done
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	for _, w := range rec.writers {
+		w.finish()
+	}
+
+	for _, c := range rec.closers {
+		if err := c.Close(); err != nil {
+			fmt.Printf("recording %s close error: %s\n", rec.manifest.ID, err)
+		}
+	}
+}
+
+func (m *recordingManager) lookup(id string) (*recording, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.active[id]
+	if !ok {
+		return nil, fmt.Errorf("no recording %s in progress", id)
+	}
+
+	return rec, nil
+}
+
+func (m *recordingManager) stop(id string) (recordingManifest, error) {
+	m.mu.Lock()
+	rec, ok := m.active[id]
+	delete(m.active, id)
+	m.mu.Unlock()
+
+	if !ok {
+		return recordingManifest{}, fmt.Errorf("no recording %s in progress", id)
+	}
+
+	broadcasters.leave(rec.broadcaster, rec.trackID)
+	if rec.audio != nil {
+		broadcasters.leave(rec.audio.broadcaster, rec.audio.trackID)
+	}
+	rec.close()
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.audio != nil {
+		if err := m.mergeAudio(rec); err != nil {
+			fmt.Printf("recording %s audio kept apart: %s\n", rec.manifest.ID, err)
+		}
+	}
+
+	stoppedAt := time.Now()
+	rec.manifest.StoppedAt = &stoppedAt
+
+	return rec.manifest, rec.saveManifest()
+}
+
+// mark adds a step marker at the current point in the recording
+func (m *recordingManager) mark(id string, marker recordingMarker) (recordingManifest, error) {
+	rec, err := m.lookup(id)
+	if err != nil {
+		return recordingManifest{}, err
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	marker.At = time.Now()
+	marker.OffsetMs = int64(time.Since(rec.started) / time.Millisecond)
+	rec.manifest.Markers = append(rec.manifest.Markers, marker)
+
+	return rec.manifest, rec.saveManifest()
+}
+
+// list returns every recording with a manifest on disk, newest first
+func (m *recordingManager) list() ([]recordingManifest, error) {
+	paths, err := filepath.Glob(filepath.Join(m.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := []recordingManifest{}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var manifest recordingManifest
+		if err = json.Unmarshal(b, &manifest); err != nil {
+			return nil, fmt.Errorf("manifest %s error: %s", path, err)
+		}
+
+		manifests = append(manifests, manifest)
+	}
+
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].StartedAt.After(manifests[j].StartedAt)
+	})
+
+	return manifests, nil
+}
+
+type recordingRequest struct {
+	Formats []string `json:"formats"`
+	Source  string   `json:"source"` // the first source if empty
+}
+
+func recordingsHandler(m *recordingManager, uArgs userArguments) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			manifests, err := m.list()
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, manifests)
+		case http.MethodPost:
+			var req recordingRequest
+			if err := readJSON(r, &req); err != nil && !errors.Is(err, io.EOF) { // the body is optional
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			src, err := uArgs.source(req.Source)
+			if err != nil {
+				writeJSONError(w, http.StatusNotFound, err)
+				return
+			}
+
+			b := broadcasters.join(uArgs.forSource(src))
+			manifest, err := m.start(b, src, req.Formats)
+			if err != nil {
+				broadcasters.leave(b, 0) // stops it again if nobody else is watching
+			} else if uArgs.audioDevice != "" {
+				id, audio := manifest.ID, broadcasters.join(uArgs.forAudio())
+				if manifest, err = m.addAudio(id, audio); err != nil {
+					broadcasters.leave(audio, 0) // stops it again if nobody else is listening
+					m.stop(id)
+				}
+			}
+
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, manifest)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		}
+	}
+}
+
+// recordingHandler serves /api/recordings/{id}/stop and /api/recordings/{id}/markers
+func recordingHandler(m *recordingManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		segments := pathSegments(r.URL.Path, "/api/recordings/")
+		if len(segments) != 2 || r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("%s %s not found", r.Method, r.URL.Path))
+			return
+		}
+
+		id := segments[0]
+		if _, err := m.lookup(id); err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+
+		var manifest recordingManifest
+		var err error
+
+		switch segments[1] {
+		case "stop":
+			manifest, err = m.stop(id)
+		case "markers":
+			var marker recordingMarker
+			if err = readJSON(r, &marker); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			manifest, err = m.mark(id, marker)
+		default:
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+			return
+		}
+
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, manifest)
+	}
+}
+
+func registerRecordingHandlers(m *recordingManager, uArgs userArguments) {
+	http.HandleFunc("/api/recordings", recordingsHandler(m, uArgs))
+	http.HandleFunc("/api/recordings/", recordingHandler(m))
+}
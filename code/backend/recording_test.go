@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+	"github.com/pion/webrtc/v2/pkg/media/ivfreader"
+)
+
+func TestRecordingLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newRecordingManager(dir)
+	b := newVideoBroadcaster(webrtc.VP8)
+	src := videoSource{Name: "scope", Device: "device", Resolution: "1920x1080"}
+
+	manifest, err := m.start(b, src, []string{recordingFormatIvf})
+	if err != nil {
+		t.Fatalf("start failed with %s", err)
+	}
+
+	b.WriteSample(media.Sample{Data: []byte{0x01, 0xff}}) // inter frame before any keyframe
+	b.WriteSample(media.Sample{Data: []byte{0x00, 0xff}})
+	b.WriteSample(media.Sample{Data: []byte{0x01, 0xff}})
+
+	if _, err = m.mark(manifest.ID, recordingMarker{Label: "incision", Step: "1"}); err != nil {
+		t.Errorf("mark failed with %s", err)
+	}
+
+	manifest, err = m.stop(manifest.ID)
+	if err != nil {
+		t.Fatalf("stop failed with %s", err)
+	}
+
+	if manifest.StoppedAt == nil || len(manifest.Markers) != 1 || manifest.Markers[0].Label != "incision" {
+		t.Errorf("manifest is wrong after stopping: %+v", manifest)
+	}
+
+	if b.viewerCount() != 0 {
+		t.Error("stopped recording is still attached to the broadcaster")
+	}
+
+	f, err := os.Open(filepath.Join(dir, manifest.Files[0]))
+	if err != nil {
+		t.Fatalf("recorded file missing: %s", err)
+	}
+	defer f.Close()
+
+	ivf, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		t.Fatalf("recorded file isn't IVF: %s", err)
+	}
+
+	if header.Width != 1920 || header.Height != 1080 || header.NumFrames != 2 {
+		t.Errorf("header is wrong: %+v", header)
+	}
+
+	if frame, _, _ := ivf.ParseNextFrame(); !isVP8Keyframe(frame) {
+		t.Error("recording should start with a keyframe")
+	}
+
+	listed, err := m.list()
+	if err != nil || len(listed) != 1 || listed[0].ID != manifest.ID {
+		t.Errorf("list returned %+v, %s", listed, err)
+	}
+
+	if _, err = m.stop(manifest.ID); err == nil {
+		t.Error("stopping a finished recording should fail")
+	}
+}
+
+func TestRecordingDoesNotHoldUpViewers(t *testing.T) {
+	b := newVideoBroadcaster(webrtc.VP8)
+	rec := newRecording("", videoSource{}, b)
+
+	// a remux ffmpeg that has stopped reading
+	r, stalled := io.Pipe()
+	w, _ := newIvfWriter(ioutil.Discard, "VP80", 0, 0, recordingTimebase, 1)
+	w.out = stalled
+	rec.writers = append(rec.writers, w)
+	rec.trackID = b.addTrack(rec)
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 2*recordingQueue; i++ {
+			b.WriteSample(media.Sample{Data: []byte{byte(i % 2), 0xff}})
+		}
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("a stalled recording blocked the broadcaster")
+	}
+
+	go io.Copy(ioutil.Discard, r)
+	b.removeTrack(rec.trackID)
+	rec.close()
+
+	if w.frames == 0 || w.frames >= 2*recordingQueue {
+		t.Errorf("wrote %d frames, should have dropped some once the queue filled", w.frames)
+	}
+}
+
+func TestRecordingUnsupportedFormat(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "recordings")
+	defer os.RemoveAll(dir)
+
+	m := newRecordingManager(dir)
+	if _, err := m.start(newVideoBroadcaster(webrtc.VP8), videoSource{}, []string{"avi"}); err == nil {
+		t.Error("start should have failed for avi")
+	}
+}
+
+func TestRecordingHandlerNotFound(t *testing.T) {
+	m := newRecordingManager("")
+
+	for _, path := range []string{"/api/recordings/missing/stop", "/api/recordings/missing", "/api/recordings/missing/stop/now"} {
+		w := httptest.NewRecorder()
+		recordingHandler(m)(w, httptest.NewRequest("POST", path, strings.NewReader("{}")))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s returned %d, should be %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
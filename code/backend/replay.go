@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+const (
+	defaultReplayWindow = 5 * time.Minute
+	replayMaxBytes      = 256 << 20 // per pipeline, however long the window
+)
+
+// bufferedFrame is one encoded frame kept for replay
+type bufferedFrame struct {
+	seq      uint64
+	data     []byte
+	samples  uint32
+	keyframe bool
+	at       time.Time // when it was sent live
+}
+
+// replayBuffer keeps the last window of a full quality pipeline's frames, so
+// a viewer can watch a moment again after it has gone by live. Frames are
+// dropped a keyframe's group at a time, so it always starts at a keyframe,
+// and the keyframes are indexed so playback can start at any of them.
+type replayBuffer struct {
+	window   time.Duration
+	maxBytes int
+
+	mu        sync.Mutex
+	frames    []bufferedFrame
+	keyframes []uint64 // the seq of every keyframe in frames
+	bytes     int
+	nextSeq   uint64
+	changed   chan struct{} // closed and replaced whenever a frame is added
+}
+
+func newReplayBuffer(window time.Duration, maxBytes int) *replayBuffer {
+	return &replayBuffer{window: window, maxBytes: maxBytes, changed: make(chan struct{})}
+}
+
+// add keeps a frame sent live at at
+func (rb *replayBuffer) add(data []byte, samples uint32, keyframe bool, at time.Time) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if len(rb.frames) == 0 && !keyframe {
+		return // nothing before a keyframe can be decoded
+	}
+
+	if keyframe {
+		rb.keyframes = append(rb.keyframes, rb.nextSeq)
+	}
+	rb.frames = append(rb.frames, bufferedFrame{seq: rb.nextSeq, data: data, samples: samples, keyframe: keyframe, at: at})
+	rb.nextSeq++
+	rb.bytes += len(data)
+
+	// drop the oldest group while what is left still covers the window
+	for len(rb.keyframes) > 1 && (rb.bytes > rb.maxBytes || !rb.frames[rb.keyframes[1]-rb.frames[0].seq].at.After(at.Add(-rb.window))) {
+		rb.dropGroup()
+	}
+
+	if rb.bytes > rb.maxBytes { // a single group too big to keep
+		rb.frames, rb.keyframes, rb.bytes = nil, nil, 0
+	}
+
+	close(rb.changed)
+	rb.changed = make(chan struct{})
+}
+
+// dropGroup drops the frames from the first keyframe up to the second; rb.mu
+// must be held
+func (rb *replayBuffer) dropGroup() {
+	n := int(rb.keyframes[1] - rb.keyframes[0])
+	for i := range rb.frames[:n] {
+		rb.bytes -= len(rb.frames[i].data)
+		rb.frames[i].data = nil // so the dropped frames can be collected
+	}
+
+	rb.frames = rb.frames[n:]
+	rb.keyframes = rb.keyframes[1:]
+}
+
+// seek returns the seq of the last keyframe sent live at or before at, or the
+// oldest one if at is before the buffer starts. It is false if nothing is
+// buffered.
+func (rb *replayBuffer) seek(at time.Time) (uint64, bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if len(rb.keyframes) == 0 {
+		return 0, false
+	}
+
+	first := rb.frames[0].seq
+	i := sort.Search(len(rb.keyframes), func(i int) bool { return rb.frames[rb.keyframes[i]-first].at.After(at) })
+	if i > 0 {
+		i--
+	}
+
+	return rb.keyframes[i], true
+}
+
+// frame returns the frame numbered seq. A player asking for one already
+// dropped gets the oldest keyframe instead, so it carries on from there.
+// Asking for one not added yet returns false and a channel that is closed
+// once it might have been.
+func (rb *replayBuffer) frame(seq uint64) (bufferedFrame, bool, <-chan struct{}) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if len(rb.frames) == 0 || seq >= rb.nextSeq {
+		return bufferedFrame{}, false, rb.changed
+	}
+
+	first := rb.frames[0].seq
+	if seq < first {
+		seq = rb.keyframes[0]
+	}
+
+	return rb.frames[seq-first], true, rb.changed
+}
+
+// available returns how far back the buffer goes from now
+func (rb *replayBuffer) available(now time.Time) time.Duration {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if len(rb.frames) == 0 {
+		return 0
+	}
+
+	return now.Sub(rb.frames[0].at)
+}
+
+// replayPlayer plays a replay buffer into a viewer's track, as far behind
+// live as where it started, until it is closed. It stands in for the track on
+// the full quality broadcaster, so the pipeline keeps running and filling the
+// buffer while nobody else is watching it live.
+type replayPlayer struct {
+	behind      int64 // nanoseconds the frame last played is behind live; first, so it is aligned
+	buffer      *replayBuffer
+	track       videoMediaTrack
+	broadcaster *videoBroadcaster
+	trackID     uint64
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func newReplayPlayer(buffer *replayBuffer, track videoMediaTrack) *replayPlayer {
+	return &replayPlayer{buffer: buffer, track: track, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// WriteSample ignores the live frames, which reach the player through the
+// buffer
+func (p *replayPlayer) WriteSample(media.Sample) error {
+	return nil
+}
+
+// play sends the buffer's frames from seq on, spaced out as they were sent
+// live. After falling out of the buffer it starts again from the oldest
+// keyframe.
+func (p *replayPlayer) play(seq uint64) {
+	defer close(p.done)
+
+	var start, first time.Time
+	for {
+		f, ok, changed := p.buffer.frame(seq)
+		if !ok {
+			select {
+			case <-changed:
+				continue
+			case <-p.stop:
+				return
+			}
+		}
+
+		if f.seq != seq || start.IsZero() {
+			start, first = time.Now(), f.at
+		}
+
+		if wait := time.Until(start.Add(f.at.Sub(first))); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-p.stop:
+				timer.Stop()
+				return
+			}
+		}
+
+		_ = p.track.WriteSample(media.Sample{Data: f.data, Samples: f.samples})
+		atomic.StoreInt64(&p.behind, int64(time.Since(f.at)))
+		seq = f.seq + 1
+	}
+}
+
+// close stops playing and waits for the last frame to be written
+func (p *replayPlayer) close() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *replayPlayer) behindLive() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.behind))
+}
+
+var (
+	errNoReplay        = errors.New("instant replay is turned off")
+	errNothingToReplay = errors.New("nothing from that source has been kept to replay yet")
+)
+
+// replay plays feed index from ago behind live on the session's own track.
+// Replaying a feed that already is starts it again from the new time.
+func (s *viewerSession) replay(index int, ago time.Duration) error {
+	if s.args.replayWindow == 0 {
+		return errNoReplay
+	}
+
+	if ago <= 0 {
+		return badRequestError{err: fmt.Errorf("replay has to start in the past")}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.feeds) {
+		return notFoundError{what: fmt.Sprintf("feed %d", index)}
+	}
+
+	// only full quality is kept, whichever layer the feed is watching
+	feed := s.feeds[index]
+	b := s.pipelines.join(s.args.forSource(feed.source))
+	if b.replay == nil {
+		s.pipelines.leave(b, 0)
+		return errNoReplay
+	}
+
+	seq, ok := b.replay.seek(time.Now().Add(-ago))
+	if !ok {
+		s.pipelines.leave(b, 0)
+		return errNothingToReplay
+	}
+
+	s.leaveFeed(feed)
+
+	p := newReplayPlayer(b.replay, feed.track)
+	p.broadcaster = b
+	p.trackID = b.addTrack(p)
+	feed.replay = p
+	go p.play(seq)
+
+	return nil
+}
+
+// goLive moves feed index back to live video
+func (s *viewerSession) goLive(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.feeds) {
+		return notFoundError{what: fmt.Sprintf("feed %d", index)}
+	}
+
+	feed := s.feeds[index]
+	if feed.replay != nil {
+		s.moveFeed(feed, feed.source, feed.layer)
+	}
+
+	return nil
+}
+
+// leaveFeed stops whatever is feeding feed's track, live video or a replay;
+// s.mu must be held, or feed no longer be one of s.feeds
+func (s *viewerSession) leaveFeed(feed *sessionFeed) {
+	if feed.replay == nil {
+		s.pipelines.leave(feed.broadcaster, feed.trackID)
+		return
+	}
+
+	feed.replay.close()
+	s.pipelines.leave(feed.replay.broadcaster, feed.replay.trackID)
+	feed.replay = nil
+}
+
+type replayRequest struct {
+	SecondsAgo float64 `json:"secondsAgo"`
+}
+
+// replayStatus is where a feed is playing from
+type replayStatus struct {
+	Live        bool  `json:"live"`
+	BehindMs    int64 `json:"behindMs,omitempty"` // replaying: how far behind live
+	AvailableMs int64 `json:"availableMs"`        // how far back a replay can start
+}
+
+// replayStatus reports feed index; s.mu must be held
+func (s *viewerSession) replayStatus(index int) (replayStatus, error) {
+	if index < 0 || index >= len(s.feeds) {
+		return replayStatus{}, notFoundError{what: fmt.Sprintf("feed %d", index)}
+	}
+
+	feed := s.feeds[index]
+	status := replayStatus{Live: feed.replay == nil}
+	if feed.replay != nil {
+		status.BehindMs = int64(feed.replay.behindLive() / time.Millisecond)
+	}
+
+	if buffer := s.pipelines.replayBuffer(feed.source.Device, s.codec); buffer != nil {
+		status.AvailableMs = int64(buffer.available(time.Now()) / time.Millisecond)
+	}
+
+	return status, nil
+}
+
+// replayBuffer returns the buffer kept for device in codec, nil if nothing
+// has been
+func (r *broadcasterRegistry) replayBuffer(device, codec string) *replayBuffer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b, ok := r.byPipeline[pipelineKey{device: device, codec: codec}]; ok {
+		return b.replay
+	}
+
+	return nil
+}
+
+// serveReplay handles /api/sessions/{id}/feeds/{index}/replay. GET says where
+// the feed is playing from, PUT with {"secondsAgo": 30} replays it from that
+// far back, and DELETE jumps back to live.
+func serveReplay(w http.ResponseWriter, req *http.Request, s *viewerSession, feed string) {
+	index, err := strconv.Atoi(feed)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, notFoundError{what: req.URL.Path})
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body replayRequest
+		if err = readJSON(req, &body); err == nil {
+			err = s.replay(index, time.Duration(body.SecondsAgo*float64(time.Second)))
+		}
+	case http.MethodDelete:
+		err = s.goLive(index)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+		return
+	}
+
+	if err == errNoReplay || err == errNothingToReplay {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeJSONError(w, errorStatus(err), err)
+		return
+	}
+
+	s.mu.Lock()
+	status, err := s.replayStatus(index)
+	s.mu.Unlock()
+
+	if err != nil {
+		writeJSONError(w, errorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+// channelTrack passes on the second byte of every frame written to it, which
+// is safe to write from a replay's goroutine
+type channelTrack chan byte
+
+func (c channelTrack) WriteSample(s media.Sample) error {
+	c <- s.Data[1]
+	return nil
+}
+
+func (c channelTrack) expect(t *testing.T, want ...byte) {
+	t.Helper()
+
+	for _, w := range want {
+		select {
+		case got := <-c:
+			if got != w {
+				t.Fatalf("got frame %d, expected %d", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("frame %d never came", w)
+		}
+	}
+}
+
+func TestReplayBuffer(t *testing.T) {
+	rb := newReplayBuffer(time.Second, 1000)
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	rb.add([]byte{0x01}, 0, false, at(0)) // can't be decoded, so isn't kept
+	for _, f := range []struct {
+		keyframe bool
+		ms       int
+	}{{true, 0}, {false, 500}, {true, 1000}, {false, 1500}, {true, 2100}} {
+		rb.add([]byte{0x00}, 3000, f.keyframe, at(f.ms))
+	}
+
+	if len(rb.frames) != 3 || rb.frames[0].seq != 2 || !rb.frames[0].keyframe {
+		t.Fatalf("the first group should have been dropped once the second covered the window: %+v", rb.frames)
+	}
+
+	for ms, want := range map[int]uint64{1700: 2, 0: 2, 3000: 4} {
+		if seq, ok := rb.seek(at(ms)); !ok || seq != want {
+			t.Errorf("seeking to %dms gave %d, should be the keyframe %d", ms, seq, want)
+		}
+	}
+
+	if f, ok, _ := rb.frame(0); !ok || f.seq != 2 {
+		t.Errorf("a dropped frame should give the oldest keyframe, got %+v", f)
+	}
+
+	if _, ok, changed := rb.frame(5); ok || changed == nil {
+		t.Error("a frame not added yet should be waited for")
+	}
+
+	small := newReplayBuffer(time.Hour, 5)
+	small.add([]byte{0x00, 0, 0}, 0, true, at(0))
+	small.add([]byte{0x01}, 0, false, at(10))
+	small.add([]byte{0x00, 0, 0}, 0, true, at(20))
+	if small.bytes != 3 || len(small.frames) != 1 {
+		t.Errorf("past its size, the oldest group should go: %d bytes in %d frames", small.bytes, len(small.frames))
+	}
+
+	small.add(make([]byte, 10), 0, true, at(30))
+	if small.bytes != 0 || len(small.frames) != 0 {
+		t.Error("a group bigger than the buffer can't be kept")
+	}
+}
+
+func TestSessionReplay(t *testing.T) {
+	s, _ := feedTestSession()
+	s.args.replayWindow = time.Minute
+
+	track := make(channelTrack, 16)
+	s.attachFeed(track, s.args.sources[0])
+	scope := s.feeds[0].broadcaster
+	if scope.replay == nil {
+		t.Fatal("a full quality pipeline should keep frames for replay")
+	}
+
+	scope.WriteSample(media.Sample{Data: []byte{0x00, 1}})
+	scope.WriteSample(media.Sample{Data: []byte{0x01, 2}})
+	scope.WriteSample(media.Sample{Data: []byte{0x01, 3}})
+	track.expect(t, 1, 2, 3)
+
+	w := httptest.NewRecorder()
+	serveReplay(w, httptest.NewRequest(http.MethodPut, "/api/sessions/x/feeds/0/replay", strings.NewReader(`{"secondsAgo": 3600}`)), s, "0")
+
+	var status replayStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil || w.Code != http.StatusOK || status.Live {
+		t.Fatalf("replaying returned %d %+v, %v", w.Code, status, err)
+	}
+
+	track.expect(t, 1, 2, 3) // from the oldest keyframe, as far back as it goes
+	if !s.feedInfos()[0].Replay || scope.viewerCount() != 1 {
+		t.Errorf("the replay should stand in for the track on the pipeline, which has %d viewers", scope.viewerCount())
+	}
+
+	scope.WriteSample(media.Sample{Data: []byte{0x01, 4}})
+	track.expect(t, 4) // through the buffer, not straight from live
+
+	w = httptest.NewRecorder()
+	serveReplay(w, httptest.NewRequest(http.MethodDelete, "/api/sessions/x/feeds/0/replay", nil), s, "0")
+	if w.Code != http.StatusOK || s.feeds[0].replay != nil {
+		t.Fatalf("going live returned %d", w.Code)
+	}
+
+	scope.WriteSample(media.Sample{Data: []byte{0x00, 5}})
+	track.expect(t, 5)
+
+	for feed, status := range map[string]int{"1": http.StatusNotFound, "scope": http.StatusNotFound} {
+		w = httptest.NewRecorder()
+		serveReplay(w, httptest.NewRequest(http.MethodPut, "/api/sessions/x/feeds/"+feed+"/replay", strings.NewReader(`{"secondsAgo": 30}`)), s, feed)
+		if w.Code != status {
+			t.Errorf("feed %s returned %d, should be %d", feed, w.Code, status)
+		}
+	}
+
+	s.args.replayWindow = 0
+	if err := s.replay(0, time.Second); err != errNoReplay {
+		t.Errorf("replay should be refused when it is turned off, got %v", err)
+	}
+}
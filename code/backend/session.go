@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	candidatePollWindow = 10 * time.Second
+	disconnectGrace     = 15 * time.Second
+	candidateSettleTime = 250 * time.Millisecond
+)
+
+// viewerSession is one browser's peer connection, plus the local ICE
+// candidates it hasn't collected yet when trickling
+type viewerSession struct {
+	id        string
+	owner     identity // who negotiated it; only they and presenters may use it
+	pc        *webrtc.PeerConnection
+	codec     string
+	args      userArguments // what the session was negotiated with
+	pipelines *broadcasterRegistry
+	createdAt time.Time
+	release   func() // detaches the session's tracks from their broadcasters
+	connected func() // run once, the first time ICE connects
+
+	mu            sync.Mutex
+	candidates    []webrtc.ICECandidateInit
+	gatheringDone bool
+	changed       chan struct{} // closed and replaced whenever candidates change
+	state         webrtc.ICEConnectionState
+	teardown      *time.Timer // pending close while disconnected
+	feeds         []*sessionFeed
+	audio         *sessionAudio // nil without an audio track
+	closeOnce     sync.Once
+
+	latencyReport     *latencyReport // the browser's last, nil until it sends one
+	latencyReportedAt time.Time
+	roundTrip         latencyAverage // timed by pinging over the control channel
+	control           *hubClient     // the control channel, nil without one
+	hub               *eventHub
+}
+
+func newViewerSession(pc *webrtc.PeerConnection) *viewerSession {
+	return &viewerSession{
+		id:        randomToken(),
+		pc:        pc,
+		pipelines: broadcasters,
+		createdAt: time.Now(),
+		changed:   make(chan struct{}),
+		state:     webrtc.ICEConnectionStateNew,
+	}
+}
+
+// close releases everything the session holds. It is safe to call more than
+// once, which happens when closing the peer connection reports Closed.
+func (s *viewerSession) close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		if s.teardown != nil {
+			s.teardown.Stop()
+		}
+		s.mu.Unlock()
+
+		if s.release != nil {
+			s.release()
+		}
+
+		s.mu.Lock()
+		control, hub := s.control, s.hub
+		s.mu.Unlock()
+
+		if control != nil {
+			hub.unregister(control)
+		}
+
+		if s.pc != nil {
+			if err := s.pc.Close(); err != nil {
+				fmt.Printf("session %s close error: %s\n", s.id, err)
+			}
+		}
+	})
+}
+
+// onLocalCandidate queues a gathered candidate; nil means gathering finished
+func (s *viewerSession) onLocalCandidate(c *webrtc.ICECandidate) {
+	if c == nil {
+		// pion hands each candidate over from its own goroutine, so the end
+		// of gathering can overtake the last few (usually the slow TURN ones)
+		time.AfterFunc(candidateSettleTime, s.finishGathering)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.candidates = append(s.candidates, c.ToJSON())
+	s.notify()
+}
+
+func (s *viewerSession) finishGathering() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gatheringDone = true
+	s.notify()
+}
+
+// notify wakes anyone waiting in takeCandidates; s.mu must be held
+func (s *viewerSession) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+type candidateBatch struct {
+	Candidates []webrtc.ICECandidateInit `json:"candidates"`
+	Done       bool                      `json:"done"`
+}
+
+// takeCandidates hands over the queued candidates, waiting up to wait for
+// one to arrive if none are queued and gathering is still going
+func (s *viewerSession) takeCandidates(wait time.Duration) candidateBatch {
+	timeout := time.After(wait)
+	for {
+		s.mu.Lock()
+		if len(s.candidates) > 0 || s.gatheringDone {
+			batch := candidateBatch{Candidates: s.candidates, Done: s.gatheringDone}
+			s.candidates = nil
+			s.mu.Unlock()
+
+			return batch
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return candidateBatch{Candidates: []webrtc.ICECandidateInit{}}
+		}
+	}
+}
+
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*viewerSession
+	grace    time.Duration
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: map[string]*viewerSession{}, grace: disconnectGrace}
+}
+
+var sessions = newSessionRegistry()
+
+func (r *sessionRegistry) add(s *viewerSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[s.id] = s
+}
+
+func (r *sessionRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, id)
+}
+
+// close tears a session down and forgets it
+func (r *sessionRegistry) close(s *viewerSession) {
+	r.remove(s.id)
+	s.close()
+}
+
+// onStateChange follows a session's ICE state. Disconnected and failed
+// sessions get a grace period to recover, since a network blip or a phone
+// switching to wifi often comes back on its own.
+func (r *sessionRegistry) onStateChange(s *viewerSession, state webrtc.ICEConnectionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = state
+
+	switch state {
+	case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+		if s.teardown == nil {
+			s.teardown = time.AfterFunc(r.grace, func() { r.close(s) })
+		}
+	case webrtc.ICEConnectionStateClosed:
+		go r.close(s) // close takes s.mu
+	case webrtc.ICEConnectionStateConnected:
+		if s.connected != nil {
+			go s.connected()
+			s.connected = nil
+		}
+		fallthrough
+	default:
+		if s.teardown != nil {
+			s.teardown.Stop()
+			s.teardown = nil
+		}
+	}
+}
+
+// sessionInfo is what the admin endpoint shows for each session
+type sessionInfo struct {
+	ID        string          `json:"id"`
+	Feeds     []feedInfo      `json:"feeds"`
+	Codec     string          `json:"codec"`
+	Audio     bool            `json:"audio"` // whether audio is being sent
+	State     string          `json:"state"`
+	Latency   latencyEstimate `json:"latency"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+func (r *sessionRegistry) list() []sessionInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	infos := []sessionInfo{}
+	for _, s := range r.sessions {
+		s.mu.Lock()
+		infos = append(infos, sessionInfo{
+			ID:        s.id,
+			Feeds:     s.feedInfos(),
+			Codec:     s.codec,
+			Audio:     s.audioOn(),
+			State:     s.state.String(),
+			Latency:   s.latency(now),
+			CreatedAt: s.createdAt,
+		})
+		s.mu.Unlock()
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+
+	return infos
+}
+
+// usableBy reports whether id may use the session, which only the viewer who
+// negotiated it and presenters may
+func (s *viewerSession) usableBy(id identity) bool {
+	return id.Role >= rolePresenter || id == s.owner
+}
+
+func (r *sessionRegistry) get(id string) (*viewerSession, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, notFoundError{what: "session " + id}
+	}
+
+	return s, nil
+}
+
+// sessionHandler serves /api/sessions/{id}/candidates, where POST adds one of
+// the browser's candidates and GET long-polls for the server's, and through
+// serveFeeds, serveLatency and serveAudio, /api/sessions/{id}/feeds,
+// /api/sessions/{id}/latency and /api/sessions/{id}/audio
+func sessionHandler(r *sessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		segments := pathSegments(req.URL.Path, "/api/sessions/")
+		if len(segments) < 2 {
+			writeJSONError(w, http.StatusNotFound, notFoundError{what: req.URL.Path})
+			return
+		}
+
+		// someone else's session is as good as missing, so its id can't be probed
+		s, err := r.get(segments[0])
+		if err == nil && !s.usableBy(identityFrom(req.Context())) {
+			err = notFoundError{what: "session " + segments[0]}
+		}
+
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+
+		switch segments[1] {
+		case "candidates":
+			serveCandidates(w, req, s, segments[2:])
+		case "feeds":
+			serveFeeds(w, req, s, segments[2:])
+		case "latency":
+			serveLatency(w, req, s, segments[2:])
+		case "audio":
+			serveAudio(w, req, s, segments[2:])
+		default:
+			writeJSONError(w, http.StatusNotFound, notFoundError{what: req.URL.Path})
+		}
+	}
+}
+
+// serveCandidates handles /api/sessions/{id}/candidates
+func serveCandidates(w http.ResponseWriter, req *http.Request, s *viewerSession, segments []string) {
+	if len(segments) != 0 {
+		writeJSONError(w, http.StatusNotFound, notFoundError{what: req.URL.Path})
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.takeCandidates(candidatePollWindow))
+	case http.MethodPost:
+		var candidate webrtc.ICECandidateInit
+		if err := readJSON(req, &candidate); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := s.pc.AddICECandidate(candidate); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("add candidate error: %s", err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+	}
+}
+
+// adminSessionsHandler serves GET /api/admin/sessions, listing every live
+// session, and DELETE /api/admin/sessions/{id}, which disconnects one
+func adminSessionsHandler(r *sessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		segments := pathSegments(req.URL.Path, "/api/admin/sessions")
+
+		switch {
+		case len(segments) == 0 && req.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, r.list())
+		case len(segments) == 1 && req.Method == http.MethodDelete:
+			s, err := r.get(segments[0])
+			if err != nil {
+				writeJSONError(w, http.StatusNotFound, err)
+				return
+			}
+
+			s.notice("warning", "a presenter ended this session")
+			r.close(s)
+			w.WriteHeader(http.StatusNoContent)
+		case len(segments) > 1:
+			writeJSONError(w, http.StatusNotFound, notFoundError{what: req.URL.Path})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+		}
+	}
+}
+
+func registerSessionHandlers(r *sessionRegistry) {
+	http.HandleFunc("/api/sessions/", sessionHandler(r))
+	http.HandleFunc("/api/admin/sessions", adminSessionsHandler(r))
+	http.HandleFunc("/api/admin/sessions/", adminSessionsHandler(r))
+}
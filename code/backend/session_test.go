@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func TestTakeCandidatesWaits(t *testing.T) {
+	s := newViewerSession(nil)
+
+	start := time.Now()
+	if batch := s.takeCandidates(20 * time.Millisecond); len(batch.Candidates) != 0 || batch.Done {
+		t.Errorf("expected an empty batch, got %+v", batch)
+	}
+
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("takeCandidates returned before the wait was up")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.onLocalCandidate(&webrtc.ICECandidate{Protocol: webrtc.ICEProtocolUDP, Address: "192.168.0.2", Port: 5000, Typ: webrtc.ICECandidateTypeHost, Component: 1})
+	}()
+
+	batch := s.takeCandidates(time.Second)
+	if len(batch.Candidates) != 1 || !strings.Contains(batch.Candidates[0].Candidate, "192.168.0.2") {
+		t.Errorf("expected the gathered candidate, got %+v", batch)
+	}
+
+	s.onLocalCandidate(nil)
+	if batch = s.takeCandidates(time.Second); !batch.Done || len(batch.Candidates) != 0 {
+		t.Errorf("expected gathering to be done, got %+v", batch)
+	}
+}
+
+func TestTrickleRun(t *testing.T) {
+	mockArgs := userArguments{
+		sessionDescription: testOffer,
+		inputResolution:    "1920x1080",
+		videoIsLive:        true,
+		operatingSys:       osLinux,
+		ivfHandle:          testIvfFile,
+		iceServers:         []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+		trickleICE:         true,
+	}
+
+	answer, err := run(mockArgs)
+	if err != nil {
+		t.Fatalf("run failed with %s", err)
+	}
+
+	if answer.SessionID == "" {
+		t.Fatal("run didn't return a session id")
+	}
+
+	handler := sessionHandler(sessions)
+	path := "/api/sessions/" + answer.SessionID + "/candidates"
+
+	body := `{"candidate": "candidate:0 1 UDP 2122252543 192.168.0.112 54441 typ host", "sdpMid": "0", "sdpMLineIndex": 0}`
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("adding a candidate returned %d: %s", w.Code, w.Body.String())
+	}
+
+	for done := false; !done; {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path, nil))
+
+		var batch candidateBatch
+		if err = json.Unmarshal(w.Body.Bytes(), &batch); err != nil {
+			t.Fatalf("bad candidate batch %s: %s", w.Body.String(), err)
+		}
+
+		done = batch.Done
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/sessions/nope/candidates", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown session returned %d, should be %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestSessionHandlerChecksOwner(t *testing.T) {
+	registry := newSessionRegistry()
+	handler := sessionHandler(registry)
+
+	s := newViewerSession(nil)
+	s.owner = identity{Name: "alice", Role: roleViewer}
+	registry.add(s)
+
+	for _, c := range []struct {
+		who  identity
+		code int
+	}{
+		{identity{Name: "alice", Role: roleViewer}, http.StatusOK},
+		{identity{Name: "bob", Role: roleViewer}, http.StatusNotFound},
+		{identity{Name: "carol", Role: roleConsultant}, http.StatusNotFound},
+		{identity{Name: "dave", Role: rolePresenter}, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/api/sessions/"+s.id+"/feeds", nil)
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(context.WithValue(req.Context(), identityKey{}, c.who)))
+		if w.Code != c.code {
+			t.Errorf("%s reading alice's session returned %d, should be %d", c.who.Name, w.Code, c.code)
+		}
+	}
+
+	req := httptest.NewRequest("PUT", "/api/sessions/"+s.id+"/feeds/0", strings.NewReader(`{"source": "room"}`))
+	w := httptest.NewRecorder()
+	handler(w, req.WithContext(context.WithValue(req.Context(), identityKey{}, identity{Name: "bob", Role: roleViewer})))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("bob switching alice's feed returned %d, should be 404", w.Code)
+	}
+}
+
+func TestSessionGracePeriod(t *testing.T) {
+	registry := newSessionRegistry()
+	registry.grace = 20 * time.Millisecond
+
+	released := make(chan struct{}, 2)
+	s := newViewerSession(nil)
+	s.release = func() { released <- struct{}{} }
+	registry.add(s)
+
+	registry.onStateChange(s, webrtc.ICEConnectionStateDisconnected)
+	registry.onStateChange(s, webrtc.ICEConnectionStateConnected)
+
+	select {
+	case <-released:
+		t.Fatal("session was closed after it reconnected")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	registry.onStateChange(s, webrtc.ICEConnectionStateFailed)
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("failed session wasn't closed after the grace period")
+	}
+
+	if _, err := registry.get(s.id); err == nil {
+		t.Error("closed session is still registered")
+	}
+
+	registry.onStateChange(s, webrtc.ICEConnectionStateClosed)
+	select {
+	case <-released:
+		t.Error("session was released twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAdminSessionsHandler(t *testing.T) {
+	registry := newSessionRegistry()
+	handler := adminSessionsHandler(registry)
+
+	released := false
+	s := newViewerSession(nil)
+	s.feeds = []*sessionFeed{{source: videoSource{Name: "scope", Device: "device"}}}
+	s.codec = webrtc.VP8
+	s.release = func() { released = true }
+	registry.add(s)
+	registry.onStateChange(s, webrtc.ICEConnectionStateConnected)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/admin/sessions", nil))
+
+	var infos []sessionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("listing sessions returned %d %s (%v)", w.Code, w.Body.String(), err)
+	}
+
+	if len(infos) != 1 || infos[0].ID != s.id || infos[0].State != "connected" || infos[0].Feeds[0].Device != "device" {
+		t.Errorf("unexpected session list %+v", infos)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("DELETE", "/api/admin/sessions/"+s.id, nil))
+	if w.Code != http.StatusNoContent || !released {
+		t.Errorf("disconnecting returned %d, released %v", w.Code, released)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("DELETE", "/api/admin/sessions/"+s.id, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("disconnecting a gone session returned %d, should be 404", w.Code)
+	}
+}
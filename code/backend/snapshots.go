@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	snapshotEvent      = "snapshot"
+	snapshotFormatPNG  = "png"
+	snapshotFormatJPEG = "jpeg"
+	snapshotMaxFrames  = 600      // past this, frames since the keyframe aren't kept and no snapshot can be taken
+	snapshotMaxBytes   = 32 << 20 // likewise
+)
+
+// snapshot is a still of one source decoded on the server, so every viewer
+// annotates exactly the same image. Annotations on it are saved against its
+// FrameTimestamp.
+type snapshot struct {
+	ID             string    `json:"id"`
+	Source         string    `json:"source,omitempty"`
+	Device         string    `json:"device"`
+	Format         string    `json:"format"`
+	TakenAt        time.Time `json:"takenAt"`
+	FrameTimestamp int64     `json:"frameTimestamp"` // TakenAt in milliseconds
+	Procedure      string    `json:"procedure,omitempty"`
+	Step           string    `json:"step,omitempty"`
+	Image          string    `json:"image"` // where to load it from
+}
+
+// frameDecoder decodes the last of frames, which start at a keyframe, into an
+// image at path
+type frameDecoder func(codec string, frames [][]byte, path string) error
+
+// keepFrame adds frame to the frames a snapshot would decode; b.mu must be held
+func (b *videoBroadcaster) keepFrame(frame []byte, keyframe bool) {
+	if keyframe {
+		b.sinceKeyframe = append(b.sinceKeyframe[:0], frame)
+		b.sinceKeyframeBytes = len(frame)
+		return
+	}
+
+	if len(b.sinceKeyframe) == 0 {
+		return // waiting for a keyframe
+	}
+
+	if len(b.sinceKeyframe) >= snapshotMaxFrames || b.sinceKeyframeBytes+len(frame) > snapshotMaxBytes {
+		b.sinceKeyframe = nil
+		b.sinceKeyframeBytes = 0
+		return
+	}
+
+	b.sinceKeyframe = append(b.sinceKeyframe, frame)
+	b.sinceKeyframeBytes += len(frame)
+}
+
+// currentFrame returns what is needed to decode the frame last sent: every
+// frame since the last keyframe
+func (b *videoBroadcaster) currentFrame() [][]byte {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return append([][]byte(nil), b.sinceKeyframe...)
+}
+
+// watching returns a running full quality pipeline for device that has a
+// frame to take a snapshot of, or nil. A snapshot is of what viewers are
+// watching, so it never starts a pipeline.
+func (r *broadcasterRegistry) watching(device string) *videoBroadcaster {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, b := range r.byPipeline {
+		if key.device == device && key.layer == "" && key.codec != webrtc.Opus && b.running && len(b.currentFrame()) > 0 {
+			return b
+		}
+	}
+
+	return nil
+}
+
+func composeSnapshotCommand(codec, path string) *exec.Cmd {
+	inputFormat := "ivf"
+	if codec == webrtc.H264 {
+		inputFormat = "h264"
+	}
+
+	args := []string{"-y", "-loglevel", "error", "-f", inputFormat, "-i", "pipe:0", "-update", "1"}
+	if strings.HasSuffix(path, ".jpg") {
+		args = append(args, "-q:v", "2")
+	}
+
+	return exec.Command("ffmpeg", append(args, path)...)
+}
+
+// writeFrames writes frames the way ffmpeg reads codec from a pipe
+func writeFrames(out io.Writer, codec string, frames [][]byte) error {
+	if codec == webrtc.H264 {
+		for _, frame := range frames {
+			if _, err := out.Write(frame); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	w, err := newIvfWriter(out, ivfFourCC(codec), 0, 0, defaultFrameRate, 1)
+	if err != nil {
+		return err
+	}
+
+	for i, frame := range frames {
+		if err = w.writeFrame(frame, uint64(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeFrame has ffmpeg decode frames, overwriting the image with each one
+// so the last frame is what is left
+func decodeFrame(codec string, frames [][]byte, path string) error {
+	execStream := composeSnapshotCommand(codec, path)
+
+	var stderr bytes.Buffer
+	execStream.Stderr = &stderr
+
+	stdin, err := execStream.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("ffmpeg stdin error: %s", err)
+	}
+
+	if err = execStream.Start(); err != nil {
+		return fmt.Errorf("ffmpeg start error: %s", err)
+	}
+
+	writeErr := writeFrames(stdin, codec, frames)
+	stdin.Close()
+
+	if err = execStream.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg snapshot error: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return writeErr
+}
+
+// snapshotStore saves each snapshot as an image with a JSON file beside it
+type snapshotStore struct {
+	dir    string
+	decode frameDecoder
+}
+
+func newSnapshotStore(dir string) *snapshotStore {
+	return &snapshotStore{dir: dir, decode: decodeFrame}
+}
+
+func snapshotExtension(format string) string {
+	if format == snapshotFormatJPEG {
+		return "jpg"
+	}
+
+	return "png"
+}
+
+func (st *snapshotStore) imagePath(snap snapshot) string {
+	return filepath.Join(st.dir, snap.ID+"."+snapshotExtension(snap.Format))
+}
+
+// save decodes frames into snap's image and writes its metadata
+func (st *snapshotStore) save(snap snapshot, codec string, frames [][]byte) (snapshot, error) {
+	now := time.Now()
+	snap.ID = now.Format(recordingIDTime) + "-" + randomID(4)
+	snap.TakenAt = now
+	snap.FrameTimestamp = now.UnixNano() / int64(time.Millisecond)
+	snap.Image = "/api/snapshots/" + snap.ID + "/image"
+
+	if err := os.MkdirAll(st.dir, 0755); err != nil {
+		return snapshot{}, err
+	}
+
+	if err := st.decode(codec, frames, st.imagePath(snap)); err != nil {
+		return snapshot{}, err
+	}
+
+	b, err := json.MarshalIndent(snap, "", "\t")
+	if err != nil {
+		return snapshot{}, err
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(st.dir, snap.ID+".json"), b, 0644); err != nil {
+		return snapshot{}, err
+	}
+
+	return snap, nil
+}
+
+func (st *snapshotStore) get(id string) (snapshot, error) {
+	if id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return snapshot{}, notFoundError{what: "snapshot " + id}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(st.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return snapshot{}, notFoundError{what: "snapshot " + id}
+	} else if err != nil {
+		return snapshot{}, err
+	}
+
+	var snap snapshot
+	if err = json.Unmarshal(b, &snap); err != nil {
+		return snapshot{}, fmt.Errorf("snapshot %s error: %s", id, err)
+	}
+
+	return snap, nil
+}
+
+// list returns every snapshot, newest first
+func (st *snapshotStore) list() ([]snapshot, error) {
+	paths, err := filepath.Glob(filepath.Join(st.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	snaps := []snapshot{}
+	for _, path := range paths {
+		snap, err := st.get(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		snaps = append(snaps, snap)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].TakenAt.After(snaps[j].TakenAt) })
+
+	return snaps, nil
+}
+
+type snapshotRequest struct {
+	Source    string `json:"source"`    // the first source if empty
+	Format    string `json:"format"`    // png or jpeg, png if empty
+	Procedure string `json:"procedure"` // optional
+	Step      string `json:"step"`      // the procedure's current step if empty
+}
+
+// snapshotService takes snapshots of what viewers are watching and tells
+// every viewer about them
+type snapshotService struct {
+	store     *snapshotStore
+	steps     *stepStore
+	hub       *eventHub
+	pipelines *broadcasterRegistry
+	uArgs     userArguments
+}
+
+func (ss snapshotService) take(req snapshotRequest, from string) (snapshot, error) {
+	switch req.Format {
+	case "":
+		req.Format = snapshotFormatPNG
+	case snapshotFormatPNG, snapshotFormatJPEG:
+	default:
+		return snapshot{}, badRequestError{err: fmt.Errorf("format %s is not png or jpeg", req.Format)}
+	}
+
+	src, err := ss.uArgs.source(req.Source)
+	if err != nil {
+		return snapshot{}, err
+	}
+
+	snap := snapshot{Source: src.Name, Device: src.Device, Format: req.Format, Procedure: req.Procedure, Step: req.Step}
+	if req.Procedure != "" {
+		p, err := ss.steps.get(req.Procedure)
+		if err != nil {
+			return snapshot{}, err
+		}
+
+		if snap.Step == "" {
+			snap.Step = p.CurrentStep
+		} else if _, err = p.stepIndex(snap.Step); err != nil {
+			return snapshot{}, err
+		}
+	}
+
+	b := ss.pipelines.watching(src.Device)
+	if b == nil {
+		return snapshot{}, errNothingToSnapshot
+	}
+
+	if snap, err = ss.store.save(snap, b.codec, b.currentFrame()); err != nil {
+		return snapshot{}, err
+	}
+
+	return snap, ss.hub.publish(snapshotEvent, snap, from)
+}
+
+var errNothingToSnapshot = errors.New("nobody is watching that source, so there is no frame to take")
+
+// snapshotsHandler serves GET /api/snapshots, listing them, and POST
+// /api/snapshots, which takes one. Like annotations, POSTs should carry the
+// X-Client-ID from the event stream.
+func snapshotsHandler(ss snapshotService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			snaps, err := ss.store.list()
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, snaps)
+		case http.MethodPost:
+			var req snapshotRequest
+			if err := readJSON(r, &req); err != nil && !errors.Is(err, io.EOF) { // the body is optional
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			snap, err := ss.take(req, r.Header.Get(clientIDHeader))
+			if err == errNothingToSnapshot {
+				writeJSONError(w, http.StatusConflict, err)
+				return
+			} else if err != nil {
+				writeJSONError(w, errorStatus(err), err)
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, snap)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		}
+	}
+}
+
+// snapshotHandler serves GET /api/snapshots/{id} and /api/snapshots/{id}/image
+func snapshotHandler(st *snapshotStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		segments := pathSegments(r.URL.Path, "/api/snapshots/")
+		if len(segments) == 0 || len(segments) > 2 || (len(segments) == 2 && segments[1] != "image") {
+			writeJSONError(w, http.StatusNotFound, notFoundError{what: r.URL.Path})
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+			return
+		}
+
+		snap, err := st.get(segments[0])
+		if err != nil {
+			writeJSONError(w, errorStatus(err), err)
+			return
+		}
+
+		if len(segments) == 1 {
+			writeJSON(w, http.StatusOK, snap)
+			return
+		}
+
+		http.ServeFile(w, r, st.imagePath(snap))
+	}
+}
+
+func registerSnapshotHandlers(ss snapshotService) {
+	http.HandleFunc("/api/snapshots", snapshotsHandler(ss))
+	http.HandleFunc("/api/snapshots/", snapshotHandler(ss.store))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+func TestBroadcasterKeepsFramesSinceKeyframe(t *testing.T) {
+	b := newVideoBroadcaster(webrtc.VP8)
+
+	b.WriteSample(media.Sample{Data: []byte{0x01}})
+	if frames := b.currentFrame(); len(frames) != 0 {
+		t.Errorf("kept %d frames that can't be decoded", len(frames))
+	}
+
+	b.WriteSample(media.Sample{Data: []byte{0x00, 0xaa}})
+	b.WriteSample(media.Sample{Data: []byte{0x01, 0xbb}})
+	if frames := b.currentFrame(); len(frames) != 2 || frames[0][1] != 0xaa {
+		t.Errorf("kept %x", frames)
+	}
+
+	b.WriteSample(media.Sample{Data: []byte{0x00, 0xcc}})
+	if frames := b.currentFrame(); len(frames) != 1 || frames[0][1] != 0xcc {
+		t.Errorf("a keyframe should start over, kept %x", frames)
+	}
+}
+
+func TestComposeSnapshotCommand(t *testing.T) {
+	png := strings.Join(composeSnapshotCommand(webrtc.VP8, "a.png").Args, " ")
+	if !strings.Contains(png, "-f ivf -i pipe:0 -update 1 a.png") {
+		t.Errorf("unexpected command %q", png)
+	}
+
+	jpeg := strings.Join(composeSnapshotCommand(webrtc.H264, "a.jpg").Args, " ")
+	if !strings.Contains(jpeg, "-f h264") || !strings.Contains(jpeg, "-q:v 2 a.jpg") {
+		t.Errorf("unexpected command %q", jpeg)
+	}
+}
+
+// snapshotTestService uses a decoder that saves how many frames it was given
+func snapshotTestService(t *testing.T, dir string) (snapshotService, *broadcasterRegistry) {
+	steps, err := loadStepStore(filepath.Join(dir, "steps.json"))
+	if err != nil {
+		t.Fatalf("loadStepStore failed with %s", err)
+	}
+
+	registry := newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+		<-stop
+		return nil
+	})
+
+	store := newSnapshotStore(filepath.Join(dir, "snapshots"))
+	store.decode = func(codec string, frames [][]byte, path string) error {
+		return ioutil.WriteFile(path, []byte{byte(len(frames))}, 0644)
+	}
+
+	return snapshotService{
+		store:     store,
+		steps:     steps,
+		hub:       newEventHub(),
+		pipelines: registry,
+		uArgs: userArguments{
+			videoCodec: webrtc.VP8,
+			sources:    []videoSource{{Name: "scope", Device: "/dev/video2"}},
+		},
+	}, registry
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snapshots")
+	defer os.RemoveAll(dir)
+
+	ss, registry := snapshotTestService(t, dir)
+	handler := snapshotsHandler(ss)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/api/snapshots", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("a snapshot of a source nobody is watching got %d", w.Code)
+	}
+
+	b := registry.join(ss.uArgs.forSource(ss.uArgs.sources[0]))
+	b.WriteSample(media.Sample{Data: []byte{0x00}})
+	b.WriteSample(media.Sample{Data: []byte{0x01}})
+
+	p, _ := ss.steps.addStep("lap-chole", "Dissect Calot's triangle")
+	ss.steps.setCurrent("lap-chole", p.Steps[0].ID)
+
+	snap, err := ss.take(snapshotRequest{Procedure: "lap-chole", Format: snapshotFormatJPEG}, "")
+	if err != nil {
+		t.Fatalf("take failed with %s", err)
+	}
+
+	if snap.Step != p.Steps[0].ID || snap.Source != "scope" || snap.FrameTimestamp == 0 {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+
+	w = httptest.NewRecorder()
+	snapshotHandler(ss.store)(w, httptest.NewRequest(http.MethodGet, snap.Image, nil))
+	if w.Code != http.StatusOK || w.Body.String() != "\x02" {
+		t.Errorf("image got %d %q, should be decoded from both frames", w.Code, w.Body.String())
+	}
+
+	snaps, err := ss.store.list()
+	if err != nil || len(snaps) != 1 || snaps[0].ID != snap.ID {
+		t.Errorf("listed %+v, %v", snaps, err)
+	}
+
+	if _, err = ss.take(snapshotRequest{Format: "gif"}, ""); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("a gif snapshot gave %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	snapshotHandler(ss.store)(w, httptest.NewRequest(http.MethodGet, "/api/snapshots/..%2fsteps", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("a path outside the snapshots got %d", w.Code)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultSourceName = "main"
+
+var resolutionPattern = regexp.MustCompile(`^\d+x\d+$`)
+
+// videoSource is a named capture device, like the scope camera or the room
+// camera. Each one watched gets its own ffmpeg pipeline.
+type videoSource struct {
+	Name       string `json:"name"`
+	Device     string `json:"device"`
+	Resolution string `json:"resolution,omitempty"` // the video resolution when empty
+}
+
+// parseSource reads a --source value, "name=device" or
+// "name=device@1280x720"
+func parseSource(value string) (videoSource, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return videoSource{}, fmt.Errorf("source %q should be name=device", value)
+	}
+
+	src := videoSource{Name: parts[0], Device: parts[1]}
+	if at := strings.LastIndex(src.Device, "@"); at >= 0 && resolutionPattern.MatchString(src.Device[at+1:]) {
+		src.Device, src.Resolution = src.Device[:at], src.Device[at+1:]
+	}
+
+	return src, nil
+}
+
+// resolveSources fills in resolutions and checks names. Without any sources
+// configured, the single --video-device is the "main" source.
+func resolveSources(configured []videoSource, device, resolution string) ([]videoSource, error) {
+	if len(configured) == 0 {
+		return []videoSource{{Name: defaultSourceName, Device: device, Resolution: resolution}}, nil
+	}
+
+	sources := []videoSource{}
+	seen := map[string]bool{}
+	for _, src := range configured {
+		if src.Name == "" || src.Device == "" {
+			return nil, fmt.Errorf("source %+v needs a name and a device", src)
+		}
+
+		if seen[src.Name] {
+			return nil, fmt.Errorf("source %s is configured twice", src.Name)
+		}
+		seen[src.Name] = true
+
+		if src.Resolution == "" {
+			src.Resolution = resolution
+		}
+
+		sources = append(sources, src)
+	}
+
+	return sources, nil
+}
+
+// source finds a source by name; an empty name is the first one
+func (uArgs userArguments) source(name string) (videoSource, error) {
+	for _, src := range uArgs.sources {
+		if name == "" || src.Name == name {
+			return src, nil
+		}
+	}
+
+	if name == "" { // arguments built by hand, as in tests
+		return videoSource{Name: defaultSourceName, Device: uArgs.inputVideoPath, Resolution: uArgs.inputResolution}, nil
+	}
+
+	return videoSource{}, notFoundError{what: "source " + name}
+}
+
+// forSource is uArgs capturing from src, which is what broadcasters.join and
+// videoControl need
+func (uArgs userArguments) forSource(src videoSource) userArguments {
+	uArgs.inputVideoPath = src.Device
+	uArgs.inputResolution = src.Resolution
+
+	return uArgs
+}
+
+// sourcesHandler serves GET /api/sources so viewers can pick feeds
+func sourcesHandler(uArgs userArguments) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+			return
+		}
+
+		sources := uArgs.sources
+		if sources == nil {
+			sources = []videoSource{}
+		}
+
+		writeJSON(w, http.StatusOK, sources)
+	}
+}
+
+func registerSourceHandlers(uArgs userArguments) {
+	http.HandleFunc("/api/sources", sourcesHandler(uArgs))
+}
+
+// sessionFeed is one of a session's video tracks and the source currently
+// feeding it. Switching source or quality layer moves the track to another
+// broadcaster, so the browser keeps the same track and nothing is
+// renegotiated. A replay plays into the same track.
+type sessionFeed struct {
+	source      videoSource
+	layer       qualityLayer
+	track       videoMediaTrack
+	broadcaster *videoBroadcaster
+	trackID     uint64
+	replay      *replayPlayer // nil while live
+}
+
+type feedInfo struct {
+	Index  int    `json:"index"`
+	Source string `json:"source"`
+	Device string `json:"device"`
+	Layer  string `json:"layer,omitempty"` // empty at full quality
+	Replay bool   `json:"replay"`          // playing from the replay buffer rather than live
+}
+
+// attachFeed starts feeding track from src
+func (s *viewerSession) attachFeed(track videoMediaTrack, src videoSource) {
+	b := s.pipelines.join(s.args.forSource(src))
+	feed := &sessionFeed{source: src, track: track, broadcaster: b, trackID: b.addTrack(track)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.feeds = append(s.feeds, feed)
+}
+
+// switchFeed moves feed index over to the source called name
+func (s *viewerSession) switchFeed(index int, name string) error {
+	src, err := s.args.source(name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.feeds) {
+		return notFoundError{what: fmt.Sprintf("feed %d", index)}
+	}
+
+	feed := s.feeds[index]
+	if feed.source.Name == src.Name {
+		return nil
+	}
+
+	s.moveFeed(feed, src, feed.layer)
+
+	return nil
+}
+
+// moveFeed feeds feed from layer of src instead, live; s.mu must be held
+func (s *viewerSession) moveFeed(feed *sessionFeed, src videoSource, layer qualityLayer) {
+	// leave first, so the two pipelines' frames never interleave on the track
+	s.leaveFeed(feed)
+
+	uArgs := s.args.forSource(src)
+	uArgs.qualityLayer = layer
+
+	feed.source = src
+	feed.layer = layer
+	feed.broadcaster = s.pipelines.join(uArgs)
+	feed.trackID = feed.broadcaster.addTrack(feed.track)
+}
+
+// detachFeeds stops every feed, when the session closes
+func (s *viewerSession) detachFeeds() {
+	s.mu.Lock()
+	feeds := s.feeds
+	s.feeds = nil
+	s.mu.Unlock()
+
+	for _, feed := range feeds {
+		s.leaveFeed(feed)
+	}
+}
+
+// feedInfos lists the session's feeds; s.mu must be held
+func (s *viewerSession) feedInfos() []feedInfo {
+	infos := []feedInfo{}
+	for i, feed := range s.feeds {
+		infos = append(infos, feedInfo{Index: i, Source: feed.source.Name, Device: feed.source.Device, Layer: feed.layer.Name, Replay: feed.replay != nil})
+	}
+
+	return infos
+}
+
+type feedRequest struct {
+	Source string `json:"source"`
+}
+
+// serveFeeds handles /api/sessions/{id}/feeds, listing the session's feeds,
+// and PUT /api/sessions/{id}/feeds/{index}, which switches one to another
+// source. /api/sessions/{id}/feeds/{index}/replay goes to serveReplay.
+func serveFeeds(w http.ResponseWriter, req *http.Request, s *viewerSession, segments []string) {
+	switch {
+	case len(segments) == 2 && segments[1] == "replay":
+		serveReplay(w, req, s, segments[0])
+	case len(segments) == 0 && req.Method == http.MethodGet:
+		s.mu.Lock()
+		infos := s.feedInfos()
+		s.mu.Unlock()
+
+		writeJSON(w, http.StatusOK, infos)
+	case len(segments) == 1 && req.Method == http.MethodPut:
+		index, err := strconv.Atoi(segments[0])
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, notFoundError{what: req.URL.Path})
+			return
+		}
+
+		var body feedRequest
+		if err = readJSON(req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err = s.switchFeed(index, body.Source); err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+
+		s.mu.Lock()
+		infos := s.feedInfos()
+		s.mu.Unlock()
+
+		writeJSON(w, http.StatusOK, infos)
+	case len(segments) > 1:
+		writeJSONError(w, http.StatusNotFound, notFoundError{what: req.URL.Path})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+	}
+}
+
+// requestedSources resolves the feeds asked for with the offer. The offer
+// needs a video section to receive each one in.
+func requestedSources(uArgs userArguments, offerSDP string) ([]videoSource, error) {
+	names := uArgs.feeds
+	if len(names) == 0 {
+		names = []string{""}
+	}
+
+	if sections := strings.Count(offerSDP, "m=video "); len(names) > sections {
+		return nil, sdpError{category: sdpDecodeError, err: fmt.Errorf("%d feeds asked for but the offer has %d video sections", len(names), sections)}
+	}
+
+	sources := []videoSource{}
+	for _, name := range names {
+		src, err := uArgs.source(name)
+		if err != nil {
+			return nil, sdpError{category: sdpDecodeError, err: err}
+		}
+
+		sources = append(sources, src)
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"atn/code/backend/internal/signal"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		value string
+		want  videoSource
+		fails bool
+	}{
+		{value: "scope=/dev/video2", want: videoSource{Name: "scope", Device: "/dev/video2"}},
+		{value: "room=FHD Capture@1280x720", want: videoSource{Name: "room", Device: "FHD Capture", Resolution: "1280x720"}},
+		{value: "overhead=video=USB Camera", want: videoSource{Name: "overhead", Device: "video=USB Camera"}},
+		{value: "scope=cam@work", want: videoSource{Name: "scope", Device: "cam@work"}},
+		{value: "/dev/video2", fails: true},
+		{value: "=/dev/video2", fails: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseSource(test.value)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q should fail, got %+v", test.value, got)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf("%q gave %+v (%v), should be %+v", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestResolveSources(t *testing.T) {
+	sources, err := resolveSources(nil, "/dev/video0", "1920x1080")
+	if err != nil || len(sources) != 1 || sources[0] != (videoSource{Name: defaultSourceName, Device: "/dev/video0", Resolution: "1920x1080"}) {
+		t.Errorf("without sources got %+v (%v)", sources, err)
+	}
+
+	sources, err = resolveSources([]videoSource{{Name: "scope", Device: "/dev/video2"}, {Name: "room", Device: "/dev/video4", Resolution: "1280x720"}}, "", "1920x1080")
+	if err != nil || sources[0].Resolution != "1920x1080" || sources[1].Resolution != "1280x720" {
+		t.Errorf("resolutions weren't filled in: %+v (%v)", sources, err)
+	}
+
+	if _, err = resolveSources([]videoSource{{Name: "scope", Device: "a"}, {Name: "scope", Device: "b"}}, "", ""); err == nil {
+		t.Error("duplicate source names should fail")
+	}
+}
+
+// feedTestSession has scope and room sources on a registry that never runs
+// ffmpeg
+func feedTestSession() (*viewerSession, *broadcasterRegistry) {
+	registry := newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+		<-stop
+		return nil
+	})
+	registry.stallTimeout = time.Hour // the fake sends no frames
+
+	s := newViewerSession(nil)
+	s.pipelines = registry
+	s.args = userArguments{
+		videoCodec: webrtc.VP8,
+		sources: []videoSource{
+			{Name: "scope", Device: "/dev/video2", Resolution: "1920x1080"},
+			{Name: "room", Device: "/dev/video4", Resolution: "1280x720"},
+		},
+	}
+
+	return s, registry
+}
+
+func TestSwitchFeed(t *testing.T) {
+	s, registry := feedTestSession()
+
+	samples := 0
+	s.attachFeed(countingVideoTrack{samples: &samples}, s.args.sources[0])
+	scope := s.feeds[0].broadcaster
+
+	if err := s.switchFeed(0, "room"); err != nil {
+		t.Fatalf("switchFeed failed with %s", err)
+	}
+
+	room := registry.join(s.args.forSource(s.args.sources[1]))
+	if scope.viewerCount() != 0 || room.viewerCount() != 1 || s.feeds[0].broadcaster != room {
+		t.Errorf("track wasn't moved: scope has %d viewers, room %d", scope.viewerCount(), room.viewerCount())
+	}
+
+	scope.WriteSample(media.Sample{Data: []byte{0x00}})
+	room.WriteSample(media.Sample{Data: []byte{0x00}})
+	if samples != 1 {
+		t.Errorf("the track got %d samples, should only get room's", samples)
+	}
+
+	if err := s.switchFeed(0, "overhead"); err == nil {
+		t.Error("switching to an unknown source should fail")
+	}
+
+	if err := s.switchFeed(1, "scope"); err == nil {
+		t.Error("switching a feed the session doesn't have should fail")
+	}
+
+	s.detachFeeds()
+	if room.viewerCount() != 0 {
+		t.Error("detaching left the track on its broadcaster")
+	}
+}
+
+func TestFeedsHandler(t *testing.T) {
+	registry := newSessionRegistry()
+	handler := sessionHandler(registry)
+
+	s, _ := feedTestSession()
+	s.attachFeed(countingVideoTrack{samples: new(int)}, s.args.sources[0])
+	registry.add(s)
+	defer s.detachFeeds()
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("PUT", "/api/sessions/"+s.id+"/feeds/0", strings.NewReader(`{"source": "room"}`)))
+
+	var feeds []feedInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &feeds); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("switching returned %d %s (%v)", w.Code, w.Body.String(), err)
+	}
+
+	if len(feeds) != 1 || feeds[0].Source != "room" || feeds[0].Device != "/dev/video4" {
+		t.Errorf("unexpected feeds %+v", feeds)
+	}
+
+	for path, status := range map[string]int{
+		"/api/sessions/" + s.id + "/feeds/3":   http.StatusNotFound,
+		"/api/sessions/" + s.id + "/feeds/one": http.StatusNotFound,
+		"/api/sessions/" + s.id + "/other":     http.StatusNotFound,
+	} {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("PUT", path, strings.NewReader(`{"source": "scope"}`)))
+		if w.Code != status {
+			t.Errorf("PUT %s returned %d, should be %d", path, w.Code, status)
+		}
+	}
+}
+
+// twoVideoOffer is testOffer with a second video section, as a browser
+// sends after adding two recvonly transceivers
+func twoVideoOffer(t *testing.T) string {
+	var offer webrtc.SessionDescription
+	if err := signal.Decode(testOffer, &offer); err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	video := offer.SDP[strings.Index(offer.SDP, "m=video"):]
+	second := strings.Replace(video, "a=mid:0", "a=mid:1", 1)
+	second = strings.Replace(second, "a=ssrc:456225876", "a=ssrc:456225877", 1)
+
+	offer.SDP = strings.Replace(offer.SDP, "a=group:BUNDLE 0", "a=group:BUNDLE 0 1", 1) + second
+
+	return signal.Encode(offer)
+}
+
+func TestRunWithTwoFeeds(t *testing.T) {
+	mockArgs := userArguments{
+		sessionDescription: twoVideoOffer(t),
+		videoIsLive:        true,
+		operatingSys:       osLinux,
+		ivfHandle:          testIvfFile,
+		sources: []videoSource{
+			{Name: "scope", Device: "/dev/video2", Resolution: "1920x1080"},
+			{Name: "room", Device: "/dev/video4", Resolution: "1280x720"},
+		},
+		feeds: []string{"room", "scope"},
+	}
+
+	answer, err := run(mockArgs)
+	if err != nil {
+		t.Fatalf("run failed with %s", err)
+	}
+
+	s, err := sessions.get(answer.SessionID)
+	if err != nil {
+		t.Fatalf("session wasn't registered: %s", err)
+	}
+	defer sessions.close(s)
+
+	s.mu.Lock()
+	feeds := s.feedInfos()
+	s.mu.Unlock()
+	if len(feeds) != 2 || feeds[0].Source != "room" || feeds[1].Source != "scope" {
+		t.Errorf("unexpected feeds %+v", feeds)
+	}
+
+	var sdp webrtc.SessionDescription
+	signal.Decode(answer.ServerSdp, &sdp)
+	room, scope := strings.Index(sdp.SDP, "a=msid:pion room"), strings.Index(sdp.SDP, "a=msid:pion scope")
+	if room < 0 || scope < room {
+		t.Errorf("answer should send room then scope:\n%s", sdp.SDP)
+	}
+
+	mockArgs.feeds = []string{"room", "scope", "room"}
+	if _, err = run(mockArgs); err == nil || asSdpError(err, sdpInternalError).status() != http.StatusBadRequest {
+		t.Errorf("more feeds than video sections gave %v", err)
+	}
+
+	mockArgs.feeds = []string{"overhead"}
+	if _, err = run(mockArgs); err == nil {
+		t.Error("an unknown source should fail")
+	}
+}
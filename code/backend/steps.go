@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	stepIDLength   = 8
+	procedureEvent = "procedure"
+)
+
+type surgicalStep struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	Completed bool   `json:"completed"`
+}
+
+// procedure is a reusable list of surgical steps, e.g. one per operation type
+type procedure struct {
+	ID          string         `json:"id"`
+	Steps       []surgicalStep `json:"steps"`
+	CurrentStep string         `json:"currentStep"`
+}
+
+func (p *procedure) stepIndex(stepID string) (int, error) {
+	for i, step := range p.Steps {
+		if step.ID == stepID {
+			return i, nil
+		}
+	}
+
+	return -1, notFoundError{what: fmt.Sprintf("step %s in procedure %s", stepID, p.ID)}
+}
+
+// stepStore keeps every procedure in a single JSON file that is rewritten
+// after each change
+type stepStore struct {
+	mu         sync.Mutex
+	path       string
+	procedures map[string]*procedure
+}
+
+func loadStepStore(path string) (*stepStore, error) {
+	s := &stepStore{path: path, procedures: map[string]*procedure{}}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &s.procedures); err != nil {
+		return nil, fmt.Errorf("steps file %s error: %s", path, err)
+	}
+
+	return s, nil
+}
+
+// save writes to a temporary file first so a crash can't leave half a file
+func (s *stepStore) save() error {
+	b, err := json.MarshalIndent(s.procedures, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+func (s *stepStore) lookup(id string) (*procedure, error) {
+	p, ok := s.procedures[id]
+	if !ok {
+		return nil, notFoundError{what: "procedure " + id}
+	}
+
+	return p, nil
+}
+
+func (s *stepStore) list() []procedure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	procedures := []procedure{}
+	for _, p := range s.procedures {
+		procedures = append(procedures, *p)
+	}
+
+	sort.Slice(procedures, func(i, j int) bool { return procedures[i].ID < procedures[j].ID })
+
+	return procedures
+}
+
+func (s *stepStore) get(id string) (procedure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.lookup(id)
+	if err != nil {
+		return procedure{}, err
+	}
+
+	return *p, nil
+}
+
+// update runs change against procedure id and saves the result. When create
+// is set a missing procedure is started empty instead of being an error.
+func (s *stepStore) update(id string, create bool, change func(p *procedure) error) (procedure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.lookup(id)
+	existed := err == nil
+	if !existed && !create {
+		return procedure{}, err
+	} else if !existed {
+		p = &procedure{ID: id, Steps: []surgicalStep{}}
+	}
+
+	edited := *p
+	edited.Steps = append([]surgicalStep{}, p.Steps...)
+	if err = change(&edited); err != nil {
+		return procedure{}, err
+	}
+
+	s.procedures[id] = &edited
+	if err = s.save(); err != nil { // put back what is still on disk
+		if existed {
+			s.procedures[id] = p
+		} else {
+			delete(s.procedures, id)
+		}
+
+		return procedure{}, err
+	}
+
+	return edited, nil
+}
+
+func (s *stepStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	delete(s.procedures, id)
+	if err = s.save(); err != nil {
+		s.procedures[id] = p
+		return err
+	}
+
+	return nil
+}
+
+func (s *stepStore) addStep(id, title string) (procedure, error) {
+	return s.update(id, true, func(p *procedure) error {
+		p.Steps = append(p.Steps, surgicalStep{ID: randomID(stepIDLength), Title: title})
+		return nil
+	})
+}
+
+type stepChange struct {
+	Title     *string `json:"title"`
+	Completed *bool   `json:"completed"`
+}
+
+func (s *stepStore) editStep(id, stepID string, change stepChange) (procedure, error) {
+	return s.update(id, false, func(p *procedure) error {
+		i, err := p.stepIndex(stepID)
+		if err != nil {
+			return err
+		}
+
+		if change.Title != nil {
+			p.Steps[i].Title = *change.Title
+		}
+
+		if change.Completed != nil {
+			p.Steps[i].Completed = *change.Completed
+		}
+
+		return nil
+	})
+}
+
+func (s *stepStore) deleteStep(id, stepID string) (procedure, error) {
+	return s.update(id, false, func(p *procedure) error {
+		i, err := p.stepIndex(stepID)
+		if err != nil {
+			return err
+		}
+
+		p.Steps = append(p.Steps[:i], p.Steps[i+1:]...)
+		if p.CurrentStep == stepID {
+			p.CurrentStep = ""
+		}
+
+		return nil
+	})
+}
+
+// reorder puts the steps in the order of stepIDs, which must name every step once
+func (s *stepStore) reorder(id string, stepIDs []string) (procedure, error) {
+	return s.update(id, false, func(p *procedure) error {
+		if len(stepIDs) != len(p.Steps) {
+			return badRequestError{err: fmt.Errorf("order has %d steps, procedure %s has %d", len(stepIDs), id, len(p.Steps))}
+		}
+
+		ordered := make([]surgicalStep, 0, len(stepIDs))
+		seen := map[string]bool{}
+		for _, stepID := range stepIDs {
+			i, err := p.stepIndex(stepID)
+			if err != nil {
+				return err
+			} else if seen[stepID] {
+				return badRequestError{err: fmt.Errorf("step %s is in the order twice", stepID)}
+			}
+
+			seen[stepID] = true
+			ordered = append(ordered, p.Steps[i])
+		}
+
+		p.Steps = ordered
+
+		return nil
+	})
+}
+
+func (s *stepStore) setCurrent(id, stepID string) (procedure, error) {
+	return s.update(id, false, func(p *procedure) error {
+		if stepID != "" {
+			if _, err := p.stepIndex(stepID); err != nil {
+				return err
+			}
+		}
+
+		p.CurrentStep = stepID
+
+		return nil
+	})
+}
+
+type stepOrder struct {
+	StepIDs []string `json:"stepIds"`
+}
+
+type currentStep struct {
+	StepID string `json:"stepId"`
+}
+
+// procedureChange is pushed to every viewer when a procedure changes, so
+// step lists and the current step stay in step everywhere
+type procedureChange struct {
+	ID        string     `json:"id"`
+	Procedure *procedure `json:"procedure,omitempty"` // nil when it was deleted
+}
+
+// proceduresHandler serves:
+//
+//	GET    /api/procedures
+//	GET    /api/procedures/{id}
+//	DELETE /api/procedures/{id}
+//	GET    /api/procedures/{id}/steps
+//	POST   /api/procedures/{id}/steps
+//	PUT    /api/procedures/{id}/steps/{stepID}
+//	DELETE /api/procedures/{id}/steps/{stepID}
+//	PUT    /api/procedures/{id}/order
+//	PUT    /api/procedures/{id}/current
+//
+// Every change is published to the hub. Like annotations, changes should
+// carry the X-Client-ID from the event stream.
+func proceduresHandler(s *stepStore, hub *eventHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		segments := pathSegments(r.URL.Path, "/api/procedures")
+		if len(segments) == 0 && r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, s.list())
+			return
+		}
+
+		var id, action, stepID string
+		switch len(segments) {
+		case 3:
+			stepID = segments[2]
+			fallthrough
+		case 2:
+			action = segments[1]
+			fallthrough
+		case 1:
+			id = segments[0]
+		}
+
+		var p procedure
+		var err error
+		status := http.StatusOK
+
+		switch {
+		case len(segments) > 3 || id == "":
+			err = notFoundError{what: r.URL.Path}
+		case action == "" && r.Method == http.MethodGet:
+			p, err = s.get(id)
+		case action == "" && r.Method == http.MethodDelete:
+			if err = s.remove(id); err == nil {
+				hub.publish(procedureEvent, procedureChange{ID: id}, r.Header.Get(clientIDHeader))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		case action == "steps" && stepID == "" && r.Method == http.MethodGet:
+			if p, err = s.get(id); err == nil {
+				writeJSON(w, http.StatusOK, p.Steps)
+				return
+			}
+		case action == "steps" && stepID == "" && r.Method == http.MethodPost:
+			var step surgicalStep
+			if err = readJSON(r, &step); err == nil {
+				p, err = s.addStep(id, step.Title)
+				status = http.StatusCreated
+			}
+		case action == "steps" && stepID != "" && r.Method == http.MethodPut:
+			var change stepChange
+			if err = readJSON(r, &change); err == nil {
+				p, err = s.editStep(id, stepID, change)
+			}
+		case action == "steps" && stepID != "" && r.Method == http.MethodDelete:
+			p, err = s.deleteStep(id, stepID)
+		case action == "order" && stepID == "" && r.Method == http.MethodPut:
+			var order stepOrder
+			if err = readJSON(r, &order); err == nil {
+				p, err = s.reorder(id, order.StepIDs)
+			}
+		case action == "current" && stepID == "" && r.Method == http.MethodPut:
+			var current currentStep
+			if err = readJSON(r, &current); err == nil {
+				p, err = s.setCurrent(id, current.StepID)
+			}
+		default:
+			err = notFoundError{what: r.Method + " " + r.URL.Path}
+		}
+
+		if err != nil {
+			writeJSONError(w, errorStatus(err), err)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			hub.publish(procedureEvent, procedureChange{ID: p.ID, Procedure: &p}, r.Header.Get(clientIDHeader))
+		}
+
+		writeJSON(w, status, p)
+	}
+}
+
+func registerStepHandlers(s *stepStore, hub *eventHub) {
+	http.HandleFunc("/api/procedures", proceduresHandler(s, hub))
+	http.HandleFunc("/api/procedures/", proceduresHandler(s, hub))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func stepRequest(t *testing.T, handler http.HandlerFunc, method, path, body string, status int) procedure {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+	if w.Code != status {
+		t.Fatalf("%s %s returned %d, should be %d: %s", method, path, w.Code, status, w.Body.String())
+	}
+
+	var p procedure
+	json.Unmarshal(w.Body.Bytes(), &p)
+
+	return p
+}
+
+func TestStepStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "steps")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "steps.json")
+	s, err := loadStepStore(path)
+	if err != nil {
+		t.Fatalf("loadStepStore failed with %s", err)
+	}
+
+	hub := newEventHub()
+	viewer := hub.register()
+	handler := proceduresHandler(s, hub)
+
+	stepRequest(t, handler, "POST", "/api/procedures/lap-chole/steps", `{"title": "port placement"}`, http.StatusCreated)
+	p := stepRequest(t, handler, "POST", "/api/procedures/lap-chole/steps", `{"title": "dissect triangle"}`, http.StatusCreated)
+	first, second := p.Steps[0].ID, p.Steps[1].ID
+
+	p = stepRequest(t, handler, "PUT", "/api/procedures/lap-chole/order", `{"stepIds": ["`+second+`", "`+first+`"]}`, http.StatusOK)
+	if p.Steps[0].ID != second {
+		t.Errorf("reorder didn't move %s first: %+v", second, p.Steps)
+	}
+
+	stepRequest(t, handler, "PUT", "/api/procedures/lap-chole/steps/"+first, `{"completed": true}`, http.StatusOK)
+	stepRequest(t, handler, "PUT", "/api/procedures/lap-chole/current", `{"stepId": "`+second+`"}`, http.StatusOK)
+
+	reloaded, err := loadStepStore(path)
+	if err != nil {
+		t.Fatalf("reloading failed with %s", err)
+	}
+
+	p, err = reloaded.get("lap-chole")
+	if err != nil {
+		t.Fatalf("procedure wasn't saved: %s", err)
+	}
+
+	if p.CurrentStep != second || !p.Steps[1].Completed || p.Steps[1].Title != "port placement" {
+		t.Errorf("saved procedure is wrong: %+v", p)
+	}
+
+	p = stepRequest(t, handler, "DELETE", "/api/procedures/lap-chole/steps/"+second, "", http.StatusOK)
+	if len(p.Steps) != 1 || p.CurrentStep != "" {
+		t.Errorf("deleting the current step left %+v", p)
+	}
+
+	// every change went out to viewers, and nothing that only read
+	if changes := len(viewer.send); changes != 6 {
+		t.Errorf("viewers were sent %d procedure changes, should be 6", changes)
+	}
+}
+
+func TestStepHandlerErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "steps")
+	defer os.RemoveAll(dir)
+
+	s, _ := loadStepStore(filepath.Join(dir, "steps.json"))
+	handler := proceduresHandler(s, newEventHub())
+
+	stepRequest(t, handler, "GET", "/api/procedures/missing", "", http.StatusNotFound)
+	stepRequest(t, handler, "PUT", "/api/procedures/missing/current", `{"stepId": ""}`, http.StatusNotFound)
+	stepRequest(t, handler, "POST", "/api/procedures/new/steps", `not json`, http.StatusBadRequest)
+
+	p := stepRequest(t, handler, "POST", "/api/procedures/new/steps", `{"title": "one"}`, http.StatusCreated)
+	stepRequest(t, handler, "PUT", "/api/procedures/new/order", `{"stepIds": ["`+p.Steps[0].ID+`", "`+p.Steps[0].ID+`"]}`, http.StatusBadRequest)
+	stepRequest(t, handler, "PUT", "/api/procedures/new/steps/nope", `{"title": "two"}`, http.StatusNotFound)
+	stepRequest(t, handler, "PATCH", "/api/procedures/new", "", http.StatusNotFound)
+}
+
+func TestLoadStepStoreCorrupt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "steps")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "steps.json")
+	ioutil.WriteFile(path, []byte("{"), 0644)
+
+	if _, err := loadStepStore(path); err == nil {
+		t.Error("loadStepStore should fail on a corrupt file")
+	}
+}
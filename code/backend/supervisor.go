@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type pipelineState string
+
+const (
+	pipelineStarting   pipelineState = "starting"
+	pipelineRunning    pipelineState = "running"
+	pipelineRestarting pipelineState = "restarting"
+	pipelineFailed     pipelineState = "failed"
+	pipelineStopped    pipelineState = "stopped"
+)
+
+const (
+	pipelineEvent        = "pipeline"
+	pipelineLogLines     = 50
+	pipelineStallTimeout = 10 * time.Second
+	pipelineMinBackoff   = time.Second
+	pipelineMaxBackoff   = 30 * time.Second
+	pipelineFailedAfter  = 5 // restarts in a row without a frame before giving a pipeline up as failed
+)
+
+type pipelineLogLine struct {
+	At   time.Time `json:"at"`
+	Line string    `json:"line"`
+}
+
+// pipelineLog keeps the last lines ffmpeg wrote to stderr, and prints them
+// with the pipeline's name so interleaved pipelines can be told apart
+type pipelineLog struct {
+	name string
+
+	mu      sync.Mutex
+	lines   []pipelineLogLine
+	partial []byte
+}
+
+func newPipelineLog(name string) *pipelineLog {
+	return &pipelineLog{name: name}
+}
+
+// Write splits on \r as well as \n, since ffmpeg redraws its progress line
+// with \r. Progress lines themselves are dropped so they can't flood out the
+// errors worth keeping.
+func (l *pipelineLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.partial = append(l.partial, p...)
+	for {
+		end := bytes.IndexAny(l.partial, "\r\n")
+		if end < 0 {
+			break
+		}
+
+		line := strings.TrimSpace(string(l.partial[:end]))
+		l.partial = l.partial[end+1:]
+
+		if line == "" || strings.HasPrefix(line, "frame=") {
+			continue
+		}
+
+		fmt.Printf("ffmpeg %s: %s\n", l.name, line)
+		l.lines = append(l.lines, pipelineLogLine{At: time.Now(), Line: line})
+		if len(l.lines) > pipelineLogLines {
+			l.lines = l.lines[len(l.lines)-pipelineLogLines:]
+		}
+	}
+
+	return len(p), nil
+}
+
+func (l *pipelineLog) tail() []pipelineLogLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]pipelineLogLine{}, l.lines...)
+}
+
+// pipelineHealth is what the supervisor knows about one broadcaster's
+// pipeline
+type pipelineHealth struct {
+	lastFrame int64 // unix nanoseconds, set by WriteSample; first for atomic alignment
+
+	mu        sync.Mutex
+	state     pipelineState
+	restarts  int
+	lastError string
+	log       *pipelineLog
+}
+
+func (h *pipelineHealth) frameSent() {
+	atomic.StoreInt64(&h.lastFrame, time.Now().UnixNano())
+}
+
+func (h *pipelineHealth) lastFrameAt() time.Time {
+	if nanos := atomic.LoadInt64(&h.lastFrame); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+
+	return time.Time{}
+}
+
+// pipelineInfo is a pipeline's health as the API and hub events show it
+type pipelineInfo struct {
+	Device    string            `json:"device"`
+	Codec     string            `json:"codec"`
+	Layer     string            `json:"layer,omitempty"`
+	State     pipelineState     `json:"state"`
+	Viewers   int               `json:"viewers"`
+	Restarts  int               `json:"restarts"`
+	LastError string            `json:"lastError,omitempty"`
+	LastFrame *time.Time        `json:"lastFrame,omitempty"`
+	Log       []pipelineLogLine `json:"log,omitempty"`
+}
+
+func (b *videoBroadcaster) info(key pipelineKey, withLog bool) pipelineInfo {
+	h := &b.health
+
+	h.mu.Lock()
+	info := pipelineInfo{
+		Device:    key.device,
+		Codec:     key.codec,
+		Layer:     key.layer,
+		State:     h.state,
+		Viewers:   b.viewerCount(),
+		Restarts:  h.restarts,
+		LastError: h.lastError,
+	}
+	h.mu.Unlock()
+
+	if last := h.lastFrameAt(); !last.IsZero() {
+		info.LastFrame = &last
+	}
+
+	if withLog {
+		info.Log = h.log.tail()
+	}
+
+	return info
+}
+
+// setState records a state change and tells whoever is listening
+func (r *broadcasterRegistry) setState(b *videoBroadcaster, key pipelineKey, state pipelineState, err error) {
+	h := &b.health
+
+	h.mu.Lock()
+	if h.state == state && err == nil {
+		h.mu.Unlock()
+		return
+	}
+
+	h.state = state
+	if state == pipelineRestarting || state == pipelineFailed {
+		h.restarts++
+	}
+	if err != nil {
+		h.lastError = err.Error()
+	}
+	h.mu.Unlock()
+
+	r.mu.Lock()
+	notify := r.onState
+	r.mu.Unlock()
+
+	if notify != nil {
+		notify(b.info(key, false))
+	}
+}
+
+// supervise runs b's pipeline until stop is closed. When ffmpeg exits or
+// stops sending frames it is restarted, backing off exponentially while it
+// keeps failing. A pipeline whose viewers have all gone isn't restarted.
+func (r *broadcasterRegistry) supervise(b *videoBroadcaster, key pipelineKey, uArgs userArguments, stop <-chan struct{}) {
+	uArgs.ffmpegStderr = b.health.log
+	backoff := r.minBackoff
+	failures := 0
+
+	for {
+		r.setState(b, key, pipelineStarting, nil)
+
+		started := time.Now()
+		err := r.attempt(b, key, uArgs, stop)
+		if isClosed(stop) {
+			r.setState(b, key, pipelineStopped, nil)
+			return
+		}
+
+		if err == nil {
+			err = fmt.Errorf("capture ended")
+		}
+		fmt.Printf("%s capture pipeline for %q stopped: %s\n", key.codec, key.device, err)
+
+		if b.health.lastFrameAt().After(started) { // it worked for a while, so start over
+			backoff, failures = r.minBackoff, 0
+		}
+
+		failures++
+		state := pipelineRestarting
+		if failures >= pipelineFailedAfter {
+			state = pipelineFailed
+		}
+		r.setState(b, key, state, err)
+
+		select {
+		case <-stop:
+			r.setState(b, key, pipelineStopped, nil)
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > pipelineMaxBackoff {
+			backoff = pipelineMaxBackoff
+		}
+
+		if b.viewerCount() == 0 {
+			r.setState(b, key, pipelineStopped, nil)
+			return
+		}
+	}
+}
+
+// attempt runs the pipeline once, watching for its first frame and for it
+// going quiet. A stalled pipeline is stopped so it can be restarted.
+func (r *broadcasterRegistry) attempt(b *videoBroadcaster, key pipelineKey, uArgs userArguments, stop <-chan struct{}) error {
+	attemptStop := make(chan struct{})
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	started := time.Now()
+
+	go func() {
+		tick := time.NewTicker(r.stallTimeout / 10)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-stop:
+				close(attemptStop)
+				return
+			case <-tick.C:
+			}
+
+			last := b.health.lastFrameAt()
+			if last.After(started) {
+				r.setState(b, key, pipelineRunning, nil)
+			} else {
+				last = started
+			}
+
+			if quiet := time.Since(last); quiet > r.stallTimeout {
+				interrupted <- fmt.Errorf("no frames for %s", quiet.Round(time.Second))
+				close(attemptStop)
+				return
+			}
+		}
+	}()
+
+	err := r.run(b, uArgs, attemptStop)
+	close(done)
+
+	select {
+	case err = <-interrupted:
+	default:
+	}
+
+	return err
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// notify sets the function told about every pipeline state change
+func (r *broadcasterRegistry) notify(onState func(pipelineInfo)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onState = onState
+}
+
+func (r *broadcasterRegistry) list() []pipelineInfo {
+	r.mu.Lock()
+	pipelines := map[pipelineKey]*videoBroadcaster{}
+	for key, b := range r.byPipeline {
+		pipelines[key] = b
+	}
+	r.mu.Unlock()
+
+	infos := []pipelineInfo{}
+	for key, b := range pipelines {
+		infos = append(infos, b.info(key, true))
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Device != infos[j].Device {
+			return infos[i].Device < infos[j].Device
+		}
+		if infos[i].Codec != infos[j].Codec {
+			return infos[i].Codec < infos[j].Codec
+		}
+		return infos[i].Layer < infos[j].Layer
+	})
+
+	return infos
+}
+
+// pipelinesHandler serves GET /api/pipelines, every capture pipeline's state
+// and the tail of its ffmpeg log
+func pipelinesHandler(r *broadcasterRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, r.list())
+	}
+}
+
+// registerPipelineHandlers serves pipeline health and pushes every state
+// change to connected clients
+func registerPipelineHandlers(r *broadcasterRegistry, hub *eventHub) {
+	r.notify(func(info pipelineInfo) {
+		if err := hub.publish(pipelineEvent, info, ""); err != nil {
+			fmt.Printf("pipeline event error: %s\n", err)
+		}
+	})
+
+	http.HandleFunc("/api/pipelines", pipelinesHandler(r))
+}
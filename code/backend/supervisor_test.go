@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+func TestPipelineLog(t *testing.T) {
+	log := newPipelineLog("test")
+
+	fmt.Fprint(log, "Input #0, video4linux2,v4l2, from '/dev/video2':\n")
+	fmt.Fprint(log, "frame=   10 fps=0.0 q=0.0 size=       0kB\rframe=   20 fps= 20 q=0.0 size=  12kB\r")
+	fmt.Fprint(log, "[video4linux2,v4l2 @ 0x55] ioctl(VIDIOC_DQBUF): No such ")
+	fmt.Fprint(log, "device\n")
+
+	lines := log.tail()
+	if len(lines) != 2 || lines[1].Line != "[video4linux2,v4l2 @ 0x55] ioctl(VIDIOC_DQBUF): No such device" {
+		t.Errorf("unexpected log %+v", lines)
+	}
+
+	for i := 0; i < pipelineLogLines*2; i++ {
+		fmt.Fprintf(log, "line %d\n", i)
+	}
+
+	if lines = log.tail(); len(lines) != pipelineLogLines || lines[len(lines)-1].Line != fmt.Sprintf("line %d", pipelineLogLines*2-1) {
+		t.Errorf("log kept %d lines, ending %+v", len(lines), lines[len(lines)-1])
+	}
+}
+
+// watchStates collects every state change the registry reports
+func watchStates(r *broadcasterRegistry) chan pipelineState {
+	states := make(chan pipelineState, 100)
+	r.notify(func(info pipelineInfo) { states <- info.State })
+
+	return states
+}
+
+func waitForState(t *testing.T, states chan pipelineState, want pipelineState) {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case state := <-states:
+			if state == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("pipeline never became %s", want)
+		}
+	}
+}
+
+func TestSupervisorRestartsExitedPipeline(t *testing.T) {
+	registry := newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+		b.WriteSample(media.Sample{Data: []byte{0x00}})
+		time.Sleep(20 * time.Millisecond) // long enough to be seen running
+		return fmt.Errorf("capture card unplugged")
+	})
+	registry.minBackoff = time.Millisecond
+	registry.stallTimeout = 50 * time.Millisecond
+	registry.idleTimeout = time.Millisecond
+	states := watchStates(registry)
+
+	b := registry.join(userArguments{inputVideoPath: "device"})
+	id := b.addTrack(countingVideoTrack{samples: new(int)})
+
+	waitForState(t, states, pipelineRunning)
+	waitForState(t, states, pipelineRestarting)
+	waitForState(t, states, pipelineRunning)
+
+	if info := b.info(pipelineKey{device: "device"}, false); info.LastError != "capture card unplugged" || info.Restarts == 0 {
+		t.Errorf("unexpected health %+v", info)
+	}
+
+	registry.leave(b, id)
+	waitForState(t, states, pipelineStopped)
+}
+
+func TestSupervisorRestartsStalledPipeline(t *testing.T) {
+	registry := newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+		<-stop // never sends a frame
+		return nil
+	})
+	registry.minBackoff = time.Millisecond
+	registry.stallTimeout = 30 * time.Millisecond
+	states := watchStates(registry)
+
+	b := registry.join(userArguments{inputVideoPath: "device"})
+	id := b.addTrack(countingVideoTrack{samples: new(int)})
+	defer registry.leave(b, id)
+
+	waitForState(t, states, pipelineRestarting)
+	if info := b.info(pipelineKey{}, false); !strings.HasPrefix(info.LastError, "no frames for") {
+		t.Errorf("stall wasn't reported: %+v", info)
+	}
+
+	waitForState(t, states, pipelineFailed)
+}
+
+func TestSupervisorLetsUnwatchedPipelineStop(t *testing.T) {
+	starts := 0
+	registry := newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+		starts++
+		return fmt.Errorf("no such device")
+	})
+	registry.minBackoff = time.Millisecond
+	states := watchStates(registry)
+
+	registry.join(userArguments{inputVideoPath: "device"})
+	waitForState(t, states, pipelineStopped)
+
+	if starts != 1 {
+		t.Errorf("a pipeline nobody watched was started %d times", starts)
+	}
+}
+
+func TestPipelinesHandler(t *testing.T) {
+	registry := newBroadcasterRegistry(func(b *videoBroadcaster, uArgs userArguments, stop <-chan struct{}) error {
+		fmt.Fprintln(uArgs.ffmpegStderr, "Input #0, video4linux2,v4l2, from 'device':")
+		b.WriteSample(media.Sample{Data: []byte{0x00}})
+		<-stop
+		return nil
+	})
+	registry.stallTimeout = time.Second
+	registry.idleTimeout = time.Millisecond
+	states := watchStates(registry)
+
+	b := registry.join(userArguments{inputVideoPath: "device", videoCodec: "VP8"})
+	id := b.addTrack(countingVideoTrack{samples: new(int)})
+	waitForState(t, states, pipelineRunning)
+
+	w := httptest.NewRecorder()
+	pipelinesHandler(registry)(w, httptest.NewRequest("GET", "/api/pipelines", nil))
+
+	var infos []pipelineInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("listing pipelines returned %d %s (%v)", w.Code, w.Body.String(), err)
+	}
+
+	if len(infos) != 1 || infos[0].State != pipelineRunning || infos[0].Viewers != 1 || infos[0].LastFrame == nil || len(infos[0].Log) != 1 {
+		t.Errorf("unexpected pipelines %+v", infos)
+	}
+
+	registry.leave(b, id)
+	waitForState(t, states, pipelineStopped)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+const (
+	talkbackEvent        = "talkback"
+	talkbackStream       = "talkback" // the forwarded track's stream, so pages play it apart from the video
+	talkbackFloorTimeout = time.Second
+)
+
+// rtpReader is the part of a remote Track the talkback loop reads from
+type rtpReader interface {
+	ReadRTP() (*rtp.Packet, error)
+}
+
+// talker is a viewer sending their microphone back
+type talker struct {
+	Session  string `json:"session"`
+	Name     string `json:"name,omitempty"`
+	Muted    bool   `json:"muted"`    // by a presenter
+	Speaking bool   `json:"speaking"` // has the floor, so other viewers hear them
+
+	session *viewerSession
+	player  *oggOpusWriter // nil without a local output
+	started time.Time
+}
+
+// info is what is shown of t; ts.mu must be held
+func (t *talker) info(speaking bool) talker {
+	return talker{Session: t.Session, Name: t.Name, Muted: t.Muted, Speaking: speaking}
+}
+
+// talkbackService takes the audio viewers send back. Each talker is played on
+// the local output by their own ffmpeg, so the sound system mixes them. Only
+// one talker at a time is forwarded to other viewers, since mixing Opus would
+// mean decoding it: whoever starts speaking has the floor until they have been
+// quiet for talkbackFloorTimeout.
+type talkbackService struct {
+	mu        sync.Mutex
+	talkers   map[string]*talker         // by session id
+	listeners map[string]videoMediaTrack // sessions' talkback tracks, by session id
+	floor     string                     // the session other viewers hear
+	floorAt   time.Time                  // its last packet
+	hub       *eventHub
+	play      func(outputDevice, platform string) (io.WriteCloser, error)
+}
+
+func newTalkbackService(hub *eventHub) *talkbackService {
+	return &talkbackService{
+		talkers:   map[string]*talker{},
+		listeners: map[string]videoMediaTrack{},
+		hub:       hub,
+		play:      startTalkbackPlayer,
+	}
+}
+
+var talkbacks = newTalkbackService(events)
+
+// composeTalkbackCommand plays Ogg Opus from stdin on outputDevice
+func composeTalkbackCommand(outputDevice, platform string) (*exec.Cmd, error) {
+	input := []string{"-loglevel", "error", "-fflags", "nobuffer", "-f", "ogg", "-i", "pipe:0"}
+
+	switch platform {
+	case osLinux:
+		return exec.Command("ffmpeg", append(input, "-f", "alsa", outputDevice)...), nil
+	case osMac:
+		return exec.Command("ffmpeg", append(input, "-f", "audiotoolbox", "-audio_device_index", outputDevice, "-")...), nil
+
+	default:
+		return nil, fmt.Errorf("playing talkback on %s not supported", platform)
+	}
+}
+
+// talkbackPlayer closes ffmpeg's stdin and waits for it to finish playing
+type talkbackPlayer struct {
+	io.WriteCloser
+	execStream *exec.Cmd
+}
+
+func (p talkbackPlayer) Close() error {
+	p.WriteCloser.Close()
+	return p.execStream.Wait()
+}
+
+func startTalkbackPlayer(outputDevice, platform string) (io.WriteCloser, error) {
+	execStream, err := composeTalkbackCommand(outputDevice, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := execStream.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg stdin error: %s", err)
+	}
+
+	if err = execStream.Start(); err != nil {
+		return nil, fmt.Errorf("ffmpeg start error: %s", err)
+	}
+
+	return talkbackPlayer{WriteCloser: stdin, execStream: execStream}, nil
+}
+
+// addListener forwards talkback to a session's track
+func (ts *talkbackService) addListener(sessionID string, track videoMediaTrack) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.listeners[sessionID] = track
+}
+
+// leave stops forwarding talkback to a session, when it closes. Its talker
+// goes when its track stops being readable.
+func (ts *talkbackService) leave(sessionID string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	delete(ts.listeners, sessionID)
+}
+
+// listen takes the audio s sends on track until the track closes. Viewers
+// below a consultant aren't heard, and are told so.
+func (ts *talkbackService) listen(s *viewerSession, track rtpReader) {
+	if s.args.viewerRole < roleConsultant {
+		s.notice("warning", "Only consultants and presenters can talk back, so nobody can hear your microphone")
+		return
+	}
+
+	t := ts.join(s)
+	defer ts.hangUp(t)
+
+	for {
+		packet, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		ts.receive(t, packet.Payload, time.Now())
+	}
+}
+
+// join adds s as a talker, starting its local player if there is an output
+func (ts *talkbackService) join(s *viewerSession) *talker {
+	t := &talker{Session: s.id, Name: s.args.viewerName, session: s, started: time.Now()}
+
+	if s.args.talkbackOutput != "" {
+		out, err := ts.play(s.args.talkbackOutput, s.args.operatingSys)
+		if err == nil {
+			t.player, err = newOggOpusWriter(out)
+		}
+
+		if err != nil {
+			fmt.Printf("session %s talkback output error: %s\n", s.id, err)
+		}
+	}
+
+	ts.mu.Lock()
+	ts.talkers[t.Session] = t
+	ts.mu.Unlock()
+
+	ts.changed()
+
+	return t
+}
+
+// hangUp removes t once its track has closed
+func (ts *talkbackService) hangUp(t *talker) {
+	ts.mu.Lock()
+	delete(ts.talkers, t.Session)
+	if ts.floor == t.Session {
+		ts.floor = ""
+	}
+	ts.mu.Unlock()
+
+	if t.player != nil {
+		if err := t.player.Close(); err != nil {
+			fmt.Printf("session %s talkback output error: %s\n", t.Session, err)
+		}
+	}
+
+	ts.changed()
+}
+
+// receive plays one packet from t and, if t has the floor, forwards it to
+// every other viewer
+func (ts *talkbackService) receive(t *talker, packet []byte, now time.Time) {
+	ts.mu.Lock()
+	if t.Muted {
+		ts.mu.Unlock()
+		return
+	}
+
+	took := false
+	if ts.floor != t.Session && (ts.floor == "" || now.Sub(ts.floorAt) > talkbackFloorTimeout) {
+		ts.floor, took = t.Session, true
+	}
+
+	var forward []videoMediaTrack
+	if ts.floor == t.Session {
+		ts.floorAt = now
+		for id, track := range ts.listeners {
+			if id != t.Session { // nobody wants to hear themselves
+				forward = append(forward, track)
+			}
+		}
+	}
+	ts.mu.Unlock()
+
+	if took {
+		ts.changed()
+	}
+
+	if t.player != nil {
+		granule := uint64(now.Sub(t.started) * opusSampleRate / time.Second)
+		if err := t.player.writePacket(packet, granule); err != nil {
+			fmt.Printf("session %s talkback output stopped: %s\n", t.Session, err)
+			t.player.Close()
+			t.player = nil // only this talker's listen loop uses it
+		}
+	}
+
+	for _, track := range forward {
+		_ = track.WriteSample(media.Sample{Data: packet, Samples: opusSamples(packet)})
+	}
+}
+
+// list returns every talker, by name
+func (ts *talkbackService) list(now time.Time) []talker {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	talkers := []talker{}
+	for id, t := range ts.talkers {
+		speaking := ts.floor == id && now.Sub(ts.floorAt) <= talkbackFloorTimeout
+		talkers = append(talkers, t.info(speaking))
+	}
+
+	sort.Slice(talkers, func(i, j int) bool { return talkers[i].Name < talkers[j].Name })
+
+	return talkers
+}
+
+// changed tells every viewer who is talking
+func (ts *talkbackService) changed() {
+	if err := ts.hub.publish(talkbackEvent, ts.list(time.Now()), ""); err != nil {
+		fmt.Printf("talkback event error: %s\n", err)
+	}
+}
+
+type muteRequest struct {
+	Session string `json:"session"` // only in hub messages; the path says which over HTTP
+	Muted   bool   `json:"muted"`
+}
+
+// setMuted mutes or unmutes a talker, telling them so
+func (ts *talkbackService) setMuted(sessionID string, muted bool) (talker, error) {
+	ts.mu.Lock()
+	t, ok := ts.talkers[sessionID]
+	if !ok {
+		ts.mu.Unlock()
+		return talker{}, notFoundError{what: "talker " + sessionID}
+	}
+
+	t.Muted = muted
+	if muted && ts.floor == sessionID {
+		ts.floor = ""
+	}
+	info := t.info(ts.floor == sessionID && time.Since(ts.floorAt) <= talkbackFloorTimeout)
+	ts.mu.Unlock()
+
+	if muted {
+		t.session.notice("info", "A presenter muted your microphone")
+	} else {
+		t.session.notice("info", "A presenter unmuted your microphone")
+	}
+
+	ts.changed()
+
+	return info, nil
+}
+
+func (ts *talkbackService) handleEvent(from *hubClient, data json.RawMessage) error {
+	var req muteRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+
+	_, err := ts.setMuted(req.Session, req.Muted)
+
+	return err
+}
+
+// talkbackHandler serves GET /api/talkback, listing talkers, and PUT
+// /api/talkback/{session}, which mutes or unmutes one
+func talkbackHandler(ts *talkbackService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		segments := pathSegments(r.URL.Path, "/api/talkback")
+
+		switch {
+		case len(segments) == 0 && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, ts.list(time.Now()))
+		case len(segments) == 1 && r.Method == http.MethodPut:
+			var req muteRequest
+			if err := readJSON(r, &req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			t, err := ts.setMuted(segments[0], req.Muted)
+			if err != nil {
+				writeJSONError(w, errorStatus(err), err)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, t)
+		case len(segments) > 1:
+			writeJSONError(w, http.StatusNotFound, notFoundError{what: r.URL.Path})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		}
+	}
+}
+
+// addTalkback lets the session's viewer talk back and hear other viewers who
+// do. The microphone comes in on the page's first audio section, which the
+// narration track already receives on when there is one.
+func (s *viewerSession) addTalkback(mediaEngine webrtc.MediaEngine, ts *talkbackService) error {
+	opus := opusCodec(mediaEngine)
+	if opus == nil || (s.args.talkbackOutput == "" && !s.args.talkbackForward) {
+		return nil
+	}
+
+	if s.args.talkbackForward {
+		track, err := s.pc.NewTrack(opus.PayloadType, rand.Uint32(), talkbackStream, talkbackStream)
+		if err != nil {
+			return err
+		}
+
+		if _, err = s.pc.AddTrack(track); err != nil {
+			return err
+		}
+
+		ts.addListener(s.id, track)
+	} else if s.audio == nil {
+		// nothing else is there to receive the microphone on
+		if _, err := s.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return err
+		}
+	}
+
+	s.pc.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			ts.listen(s, track)
+		}
+	})
+
+	return nil
+}
+
+func registerTalkbackHandlers(ts *talkbackService) {
+	ts.hub.on(talkbackEvent, ts.handleEvent)
+	ts.hub.restrict(talkbackEvent, rolePresenter)
+	http.HandleFunc("/api/talkback", talkbackHandler(ts))
+	http.HandleFunc("/api/talkback/", talkbackHandler(ts))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// fakeRTPReader returns its packets and then EOF
+type fakeRTPReader struct {
+	payloads [][]byte
+}
+
+func (f *fakeRTPReader) ReadRTP() (*rtp.Packet, error) {
+	if len(f.payloads) == 0 {
+		return nil, io.EOF
+	}
+
+	packet := &rtp.Packet{Payload: f.payloads[0]}
+	f.payloads = f.payloads[1:]
+
+	return packet, nil
+}
+
+func talkbackTestSession(id string, r role) *viewerSession {
+	s := newViewerSession(nil)
+	s.id = id
+	s.args.viewerRole = r
+	s.args.viewerName = id
+
+	return s
+}
+
+func TestTalkbackFloor(t *testing.T) {
+	ts := newTalkbackService(newEventHub())
+	heard := map[string]*int{}
+	for _, id := range []string{"consultant", "presenter", "viewer"} {
+		samples := 0
+		heard[id] = &samples
+		ts.addListener(id, countingVideoTrack{samples: &samples})
+	}
+
+	consultant := ts.join(talkbackTestSession("consultant", roleConsultant))
+	presenter := ts.join(talkbackTestSession("presenter", rolePresenter))
+
+	now := time.Now()
+	ts.receive(consultant, []byte{0xf8}, now)
+	ts.receive(presenter, []byte{0xf8}, now.Add(20*time.Millisecond)) // talking over the consultant
+
+	if *heard["consultant"] != 0 || *heard["presenter"] != 1 || *heard["viewer"] != 1 {
+		t.Errorf("only the consultant, who has the floor, should be forwarded, to everyone else: %d %d %d",
+			*heard["consultant"], *heard["presenter"], *heard["viewer"])
+	}
+
+	ts.receive(presenter, []byte{0xf8}, now.Add(talkbackFloorTimeout+time.Second))
+	if *heard["consultant"] != 1 || *heard["viewer"] != 2 {
+		t.Error("the presenter should get the floor once the consultant goes quiet")
+	}
+
+	if talkers := ts.list(now.Add(talkbackFloorTimeout + time.Second)); len(talkers) != 2 || talkers[1].Name != "presenter" || !talkers[1].Speaking || talkers[0].Speaking {
+		t.Errorf("list is wrong: %+v", talkers)
+	}
+
+	if _, err := ts.setMuted("presenter", true); err != nil {
+		t.Fatalf("setMuted failed with %s", err)
+	}
+
+	ts.receive(presenter, []byte{0xf8}, now.Add(talkbackFloorTimeout+2*time.Second))
+	if *heard["viewer"] != 2 {
+		t.Error("a muted talker shouldn't be forwarded")
+	}
+
+	ts.leave("viewer")
+	ts.receive(consultant, []byte{0xf8}, now.Add(talkbackFloorTimeout+3*time.Second))
+	if *heard["viewer"] != 2 || *heard["presenter"] != 2 {
+		t.Error("talkback should go to everyone still listening and nobody who left")
+	}
+}
+
+func TestTalkbackListen(t *testing.T) {
+	ts := newTalkbackService(newEventHub())
+	samples := 0
+	ts.addListener("room", countingVideoTrack{samples: &samples})
+
+	ts.listen(talkbackTestSession("resident", roleViewer), &fakeRTPReader{payloads: [][]byte{{0xf8}}})
+	if samples != 0 || len(ts.list(time.Now())) != 0 {
+		t.Error("a viewer shouldn't be heard")
+	}
+
+	ts.listen(talkbackTestSession("fellow", roleConsultant), &fakeRTPReader{payloads: [][]byte{{0xf8}, {0xf8}}})
+	if samples != 2 {
+		t.Errorf("the consultant's %d packets should be forwarded", samples)
+	}
+
+	if len(ts.list(time.Now())) != 0 || ts.floor != "" {
+		t.Error("a talker whose track closed should be gone")
+	}
+}
+
+func TestTalkbackHandler(t *testing.T) {
+	ts := newTalkbackService(newEventHub())
+	ts.join(talkbackTestSession("fellow", roleConsultant))
+
+	w := httptest.NewRecorder()
+	talkbackHandler(ts)(w, httptest.NewRequest(http.MethodPut, "/api/talkback/fellow", strings.NewReader(`{"muted": true}`)))
+
+	var got talker
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || w.Code != http.StatusOK || !got.Muted {
+		t.Errorf("muting returned %d %+v, %v", w.Code, got, err)
+	}
+
+	for path, status := range map[string]int{
+		"/api/talkback/missing":    http.StatusNotFound,
+		"/api/talkback/fellow/mic": http.StatusNotFound,
+	} {
+		w = httptest.NewRecorder()
+		talkbackHandler(ts)(w, httptest.NewRequest(http.MethodPut, path, strings.NewReader(`{"muted": true}`)))
+		if w.Code != status {
+			t.Errorf("%s returned %d, should be %d", path, w.Code, status)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	talkbackHandler(ts)(w, httptest.NewRequest(http.MethodGet, "/api/talkback", nil))
+
+	var talkers []talker
+	if err := json.NewDecoder(w.Body).Decode(&talkers); err != nil || len(talkers) != 1 || !talkers[0].Muted {
+		t.Errorf("list returned %+v, %v", talkers, err)
+	}
+}
+
+func TestComposeTalkbackCommand(t *testing.T) {
+	execStream, err := composeTalkbackCommand("default", osLinux)
+	if err != nil || !strings.HasSuffix(strings.Join(execStream.Args, " "), "-i pipe:0 -f alsa default") {
+		t.Errorf("linux command is wrong: %v, %v", execStream, err)
+	}
+
+	if _, err = composeTalkbackCommand("0", osWindows); err == nil {
+		t.Error("windows has no output device ffmpeg can play to")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	selfSignedCertFile  = "self-signed-cert.pem"
+	selfSignedKeyFile   = "self-signed-key.pem"
+	selfSignedValidFor  = 365 * 24 * time.Hour
+	certPollInterval    = 5 * time.Second
+	defaultHTTPSPort    = "443"
+	redirectReadTimeout = 10 * time.Second
+)
+
+// tlsSettings turn on HTTPS. Setting selfSigned without cert and key paths
+// uses self-signed-*.pem in the working directory.
+type tlsSettings struct {
+	CertFile     string `json:"certFile,omitempty"`
+	KeyFile      string `json:"keyFile,omitempty"`
+	SelfSigned   bool   `json:"selfSigned,omitempty"`
+	RedirectHTTP string `json:"redirectHTTP,omitempty"` // address to redirect plain HTTP from, like ":80"
+}
+
+func (t tlsSettings) enabled() bool {
+	return t.SelfSigned || (t.CertFile != "" && t.KeyFile != "")
+}
+
+func (t tlsSettings) paths() (string, string) {
+	if t.CertFile == "" && t.KeyFile == "" && t.SelfSigned {
+		return selfSignedCertFile, selfSignedKeyFile
+	}
+
+	return t.CertFile, t.KeyFile
+}
+
+// localHosts are the names a LAN browser might use to reach this machine
+func localHosts() []string {
+	hosts := []string{"localhost"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			hosts = append(hosts, ipNet.IP.String())
+		}
+	}
+
+	return hosts
+}
+
+// generateSelfSigned writes a certificate for hosts and its key. Browsers
+// will warn about it, but it is enough to get HTTPS on a hospital LAN.
+func generateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"atn self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certReloader serves the certificate in certFile, reloading it when the
+// files change or on SIGHUP so renewed certificates don't need a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls certificate error: %s", err)
+	}
+
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+	r.modTime = info.ModTime()
+
+	return nil
+}
+
+// changed reports whether either file is newer than the loaded certificate
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, path := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(r.modTime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch reloads on SIGHUP and whenever the files change. A failed reload
+// keeps serving the old certificate.
+func (r *certReloader) watch() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	poll := time.NewTicker(certPollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-hangup:
+		case <-poll.C:
+			if !r.changed() {
+				continue
+			}
+		}
+
+		if err := r.reload(); err != nil {
+			fmt.Printf("%s, keeping the current certificate\n", err)
+		} else {
+			fmt.Printf("reloaded tls certificate %s\n", r.certFile)
+		}
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// loadTLS prepares the certificate, generating a self-signed one if asked to
+// and none exists yet
+func loadTLS(settings tlsSettings) (*certReloader, error) {
+	certFile, keyFile := settings.paths()
+
+	if settings.SelfSigned {
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			fmt.Printf("generating self-signed certificate %s\n", certFile)
+			if err = generateSelfSigned(certFile, keyFile, localHosts()); err != nil {
+				return nil, fmt.Errorf("self-signed certificate error: %s", err)
+			}
+		}
+	}
+
+	return newCertReloader(certFile, keyFile)
+}
+
+// httpsRedirect sends plain HTTP requests to the same path over HTTPS on the
+// port the server listens on
+func httpsRedirect(httpsAddr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != defaultHTTPSPort {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
+
+// serve runs handler over HTTPS when TLS is configured, otherwise HTTP
+func serve(uArgs userArguments, handler http.Handler) error {
+	if !uArgs.tls.enabled() {
+		return http.ListenAndServe(uArgs.serveOn, handler)
+	}
+
+	certs, err := loadTLS(uArgs.tls)
+	if err != nil {
+		return err
+	}
+	go certs.watch()
+
+	if uArgs.tls.RedirectHTTP != "" {
+		redirect := &http.Server{
+			Addr:        uArgs.tls.RedirectHTTP,
+			Handler:     httpsRedirect(uArgs.serveOn),
+			ReadTimeout: redirectReadTimeout,
+		}
+
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil {
+				fmt.Printf("http redirect error: %s\n", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:      uArgs.serveOn,
+		Handler:   handler,
+		TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate},
+	}
+
+	return server.ListenAndServeTLS("", "")
+}
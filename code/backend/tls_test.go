@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempCertPaths(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), func() { os.RemoveAll(dir) }
+}
+
+func TestLoadTLSGeneratesSelfSigned(t *testing.T) {
+	certFile, keyFile, cleanup := tempCertPaths(t)
+	defer cleanup()
+
+	certs, err := loadTLS(tlsSettings{CertFile: certFile, KeyFile: keyFile, SelfSigned: true})
+	if err != nil {
+		t.Fatalf("loadTLS failed with %s", err)
+	}
+
+	cert, _ := certs.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("generated certificate doesn't parse: %s", err)
+	}
+
+	if err = leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("generated certificate isn't valid for localhost: %s", err)
+	}
+
+	if err = leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("generated certificate isn't valid for 127.0.0.1: %s", err)
+	}
+
+	// an existing certificate is kept rather than regenerated
+	again, err := loadTLS(tlsSettings{CertFile: certFile, KeyFile: keyFile, SelfSigned: true})
+	if err != nil {
+		t.Fatalf("loadTLS failed with %s", err)
+	}
+
+	if cert2, _ := again.GetCertificate(nil); string(cert2.Certificate[0]) != string(cert.Certificate[0]) {
+		t.Error("self-signed certificate was regenerated")
+	}
+}
+
+func TestCertReloaderPicksUpNewCertificate(t *testing.T) {
+	certFile, keyFile, cleanup := tempCertPaths(t)
+	defer cleanup()
+
+	if err := generateSelfSigned(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed with %s", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{GetCertificate: certs.GetCertificate}
+	server.StartTLS()
+	defer server.Close()
+
+	servedSerial := func() string {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("tls dial failed with %s", err)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+	}
+
+	before := servedSerial()
+
+	if certs.changed() {
+		t.Error("certificate reported changed before it was")
+	}
+
+	if err = generateSelfSigned(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatalf("error in setup: %s", err)
+	}
+	later := time.Now().Add(time.Second) // coarse filesystem timestamps
+	os.Chtimes(certFile, later, later)
+
+	if !certs.changed() {
+		t.Fatal("rewritten certificate wasn't noticed")
+	}
+
+	if err = certs.reload(); err != nil {
+		t.Fatalf("reload failed with %s", err)
+	}
+
+	if servedSerial() == before {
+		t.Error("server still serves the old certificate")
+	}
+
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0644)
+	if err = certs.reload(); err == nil {
+		t.Error("reload accepted a broken certificate")
+	}
+
+	if servedSerial() == before {
+		t.Error("a failed reload dropped the current certificate")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	cases := []struct {
+		listen   string
+		host     string
+		location string
+	}{
+		{":3000", "surgery.local", "https://surgery.local:3000/procedures?x=1"},
+		{":443", "surgery.local:80", "https://surgery.local/procedures?x=1"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://"+c.host+"/procedures?x=1", nil)
+		httpsRedirect(c.listen)(w, r)
+
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != c.location {
+			t.Errorf("%s: redirected %d to %s, should be %s", c.listen, w.Code, w.Header().Get("Location"), c.location)
+		}
+	}
+}
@@ -2,7 +2,7 @@ import { configure, mount } from "enzyme";
 import Adapter from "enzyme-adapter-react-16";
 import React from "react";
 import sinon from "sinon";
-import Atn, { Coord, UserAction } from "../src/components/Atn";
+import Atn, { Coord, UserAction, eventsUrl } from "../src/components/Atn";
 
 configure({ adapter: new Adapter() });
 
@@ -125,6 +125,7 @@ it("Atn.js - componentDidMount()", () => {
 
 	const keyPressStub = sandbox.stub(Atn.prototype, "keyPress");
 	const createIntervalStub = sandbox.stub(Atn.prototype, "createInterval");
+	const connectEventsStub = sandbox.stub(Atn.prototype, "connectEvents");
 
 	component.createPeerConnection = sandbox.stub().returns("--pc--");
 
@@ -132,6 +133,7 @@ it("Atn.js - componentDidMount()", () => {
 
 	expect(keyPressStub.called).toBe(true);
 	expect(createIntervalStub.called).toBe(true);
+	expect(connectEventsStub.called).toBe(true);
 	expect(component.canvas.width).toEqual(component.state.videoWidth);
 	expect(component.canvas.height).toEqual(component.state.videoHeight);
 
@@ -218,11 +220,92 @@ it("Atn.js - handleClick()", () => {
 	expect(component.state.icon).toBe(true);
 });
 
+it("Atn.js - toggleSound()", () => {
+	const video = { current: { muted: true } };
+	component.state.video = video;
+
+	component.toggleSound();
+	expect(video.current.muted).toBe(false);
+	expect(component.state.muted).toBe(false);
+
+	component.toggleSound();
+	expect(video.current.muted).toBe(true);
+	expect(component.state.muted).toBe(true);
+});
+
+it("Atn.js - toggleTalking()", async () => {
+	const track = { stop: sandbox.stub() };
+	const stream = {
+		getTracks: () => [track],
+		getAudioTracks: () => [track],
+	};
+	const microphone = { sender: { replaceTrack: sandbox.stub().resolves() } };
+	component.state.microphone = microphone;
+
+	await component.toggleTalking(sandbox.stub().resolves(stream));
+	expect(microphone.sender.replaceTrack.calledWith(track)).toBe(true);
+	expect(component.state.talking).toBe(stream);
+
+	await component.toggleTalking();
+	expect(microphone.sender.replaceTrack.calledWith(null)).toBe(true);
+	expect(track.stop.called).toBe(true);
+	expect(component.state.talking).toBe(null);
+});
+
+it("Atn.js - replay()", async () => {
+	const fetchStub = sandbox.stub();
+	fetchStub.onFirstCall().resolves({ ok: true, json: async () => ({ live: false }) });
+	fetchStub.onSecondCall().resolves({ ok: true, json: async () => ({ live: true }) });
+	component.state.sessionId = "abc";
+
+	await component.replay(30, fetchStub);
+	const [url, options] = fetchStub.firstCall.args;
+	expect(url).toEqual("/api/sessions/abc/feeds/0/replay");
+	expect(options.method).toEqual("PUT");
+	expect(JSON.parse(options.body)).toEqual({ secondsAgo: 30 });
+	expect(component.state.replaying).toBe(true);
+
+	await component.replay(0, fetchStub);
+	expect(fetchStub.secondCall.args[1].method).toEqual("DELETE");
+	expect(component.state.replaying).toBe(false);
+});
+
+it("Atn.js - onTrack()", () => {
+	const talkback = { id: "talkback" };
+	component.talkbackAudio = { current: {} };
+	component.getRemoteVideo = sandbox.stub();
+
+	component.onTrack({ streams: [talkback] });
+	expect(component.talkbackAudio.current.srcObject).toBe(talkback);
+	expect(component.getRemoteVideo.called).toBe(false);
+
+	component.onTrack({ streams: [{ id: "pion" }] });
+	expect(component.getRemoteVideo.calledOnce).toBe(true);
+});
+
 it("Atn.js - onIceCandidate", () => {
 	let tmp = component.onIceCandidate({}, null);
 	expect(tmp).toBe(undefined);
 });
 
+it("Atn.js - onIceCandidate trickles candidates", () => {
+	const candidate = (n) => ({ candidate: { toJSON: () => ({ candidate: n }) } });
+	const postCandidate = sandbox.stub().resolves();
+
+	// before the server answers, candidates wait for the session
+	component.exchanger = { postCandidate };
+	component.onIceCandidate({}, candidate("a"));
+	expect(component.pendingCandidates).toEqual([{ candidate: "a" }]);
+	expect(postCandidate.called).toBe(false);
+
+	component.exchanger.sessionId = "abc";
+	component.onIceCandidate({}, candidate("b"));
+	expect(postCandidate.calledWith({ candidate: "b" })).toBe(true);
+
+	component.onIceCandidate({}, { candidate: null });
+	expect(postCandidate.calledOnce).toBe(true);
+});
+
 it("Atn.js - Key tests", () => {
 	component.keyCode2ch({});
 	expect(component.state.keys).toEqual(undefined);
@@ -233,3 +316,72 @@ it("Atn.js - Key tests", () => {
 	component.isKeySymbol("key");
 	expect(component.state.keys).toEqual(undefined);
 });
+
+it("Atn.js - eventsUrl()", () => {
+	expect(eventsUrl({ protocol: "https:", host: "or.example.com" })).toEqual(
+		"wss://or.example.com/api/events"
+	);
+	expect(eventsUrl({ protocol: "http:", host: "localhost:3000" })).toEqual(
+		"ws://localhost:3000/api/events"
+	);
+});
+
+it("Atn.js - followPresentation()", () => {
+	component.playPauseVideo = sandbox.stub();
+	component.state.video = { current: {} };
+	component.state.videoStatus = "Playing";
+
+	component.followPresentation({ mode: "frozen", version: 2 });
+	expect(component.playPauseVideo.calledOnce).toBe(true);
+	expect(component.state.presentationVersion).toBe(2);
+
+	// an older change arriving late is ignored
+	component.followPresentation({ mode: "live", version: 1 });
+	expect(component.playPauseVideo.calledOnce).toBe(true);
+
+	component.followPresentation({ mode: "reviewing", snapshot: "abc", version: 3 });
+	expect(component.state.snapshotImage).toEqual("/api/snapshots/abc/image");
+});
+
+it("Atn.js - sharePresentation()", async () => {
+	const fetchStub = sandbox.stub().resolves({ ok: true });
+	component.state.clientId = "client";
+
+	await component.sharePresentation("frozen", fetchStub);
+
+	const [url, options] = fetchStub.firstCall.args;
+	expect(url).toEqual("/api/presentation");
+	expect(options.method).toEqual("PUT");
+	expect(options.headers["X-Client-ID"]).toEqual("client");
+	expect(JSON.parse(options.body)).toEqual({ mode: "frozen" });
+});
+
+it("Atn.js - onEvent()", () => {
+	const channel = { send: sandbox.stub() };
+	component.followPresentation = sandbox.stub();
+
+	component.onEvent('{"v": 1, "type": "welcome", "data": {"clientId": "abc"}}', channel);
+	expect(component.state.clientId).toEqual("abc");
+
+	component.onEvent('{"v": 1, "type": "presentation", "data": {"mode": "live"}}', channel);
+	expect(component.followPresentation.calledWith({ mode: "live" })).toBe(true);
+
+	// pings are answered with the same data so the server can time them
+	component.onEvent('{"v": 1, "type": "ping", "data": {"sentAt": 5}}', channel);
+	expect(JSON.parse(channel.send.firstCall.args[0])).toEqual({
+		v: 1,
+		type: "pong",
+		data: { sentAt: 5 },
+	});
+});
+
+it("Atn.js - useControlChannel()", () => {
+	const socket = { close: sandbox.stub() };
+	const control = {};
+	component.state.events = socket;
+
+	component.useControlChannel(control);
+
+	expect(socket.close.called).toBe(true);
+	expect(component.state.events).toBe(control);
+});
@@ -28,7 +28,7 @@ it("ExchangeSdp -- postSdp posts", () => {
 	class resolvableObject {
 		async json() {
 			console.log("inside json()");
-			return { ServerSdp: "junk filled" };
+			return { ServerSdp: "junk filled", SessionID: "abc" };
 		}
 	}
 
@@ -39,5 +39,74 @@ it("ExchangeSdp -- postSdp posts", () => {
 	const exchanger = new ExchangeSdp(pcStub, port);
 	return exchanger.postSdp(mockFetch).then((recievedSdp) => {
 		expect(recievedSdp).toEqual(atob("junk filled"));
+		expect(exchanger.sessionId).toEqual("abc");
 	});
 });
+
+it("ExchangeSdp -- postSdp asks to trickle", () => {
+	let body;
+	let mockFetch = (urlPath, opts) => {
+		body = JSON.parse(opts.body);
+		return { ok: true, json: async () => ({ ServerSdp: "", SessionID: "abc" }) };
+	};
+
+	const exchanger = new ExchangeSdp(pcStub, port, true);
+	return exchanger.postSdp(mockFetch).then(() => {
+		expect(body.Trickle).toBe(true);
+	});
+});
+
+it("ExchangeSdp -- postCandidate posts to the session", async () => {
+	let path, body;
+	let mockFetch = (urlPath, opts) => {
+		path = urlPath;
+		body = JSON.parse(opts.body);
+		return { ok: true };
+	};
+
+	const exchanger = new ExchangeSdp(pcStub, port, true);
+	exchanger.sessionId = "abc";
+	await exchanger.postCandidate({ candidate: "candidate:0", sdpMid: "0" }, mockFetch);
+
+	expect(path).toEqual("/api/sessions/abc/candidates");
+	expect(body).toEqual({ candidate: "candidate:0", sdpMid: "0" });
+});
+
+it("ExchangeSdp -- pollCandidates adds the server's until it is done", async () => {
+	const batches = [
+		{ candidates: [{ candidate: "a" }], done: false },
+		{ candidates: [], done: false },
+		{ candidates: [{ candidate: "b" }], done: true },
+	];
+	let mockFetch = (urlPath) => {
+		expect(urlPath).toEqual("/api/sessions/abc/candidates");
+		const batch = batches.shift();
+		return { ok: true, json: async () => batch };
+	};
+
+	const added = [];
+	const pc = { addIceCandidate: async (candidate) => added.push(candidate) };
+
+	const exchanger = new ExchangeSdp(pcStub, port, true);
+	exchanger.sessionId = "abc";
+	await exchanger.pollCandidates(pc, mockFetch);
+
+	expect(added).toEqual([{ candidate: "a" }, { candidate: "b" }]);
+	expect(batches.length).toEqual(0);
+});
+
+it("ExchangeSdp -- postSdp throws the server's error", () => {
+	let mockFetch = (urlPath, opts) => {
+		return {
+			ok: false,
+			async json() {
+				return { Error: "offer does not support VP8", Category: "codec" };
+			},
+		};
+	};
+
+	const exchanger = new ExchangeSdp(pcStub, port);
+	return expect(exchanger.postSdp(mockFetch)).rejects.toThrow(
+		"codec error: offer does not support VP8"
+	);
+});
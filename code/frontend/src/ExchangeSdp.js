@@ -1,7 +1,8 @@
 export class ExchangeSdp {
-	constructor(pc, portNumber) {
+	constructor(pc, portNumber, trickle = false) {
 		this.sdp = btoa(JSON.stringify(pc.localDescription));
 		this.portNum = portNumber;
+		this.trickle = trickle;
 	}
 
 	async postSdp(postFunc = fetch) {
@@ -10,11 +11,54 @@ export class ExchangeSdp {
 			headers: new Headers({
 				"Content-Type": "application/json",
 			}),
-			body: JSON.stringify({ BrowserSdp: this.sdp }),
+			body: JSON.stringify({ BrowserSdp: this.sdp, Trickle: this.trickle }),
 		};
 
 		let remote_sdp = await postFunc("/browsersdp", requestOptions);
 		let json_val = await remote_sdp.json();
+		if (remote_sdp.ok === false) {
+			throw new Error(`${json_val.Category} error: ${json_val.Error}`);
+		}
+		this.sessionId = json_val.SessionID;
 		return atob(json_val.ServerSdp);
 	}
+
+	// postCandidate sends one of the browser's ICE candidates to the server
+	async postCandidate(candidate, postFunc = fetch) {
+		const requestOptions = {
+			method: "POST",
+			headers: new Headers({
+				"Content-Type": "application/json",
+			}),
+			body: JSON.stringify(candidate),
+		};
+
+		const response = await postFunc(
+			`/api/sessions/${this.sessionId}/candidates`,
+			requestOptions
+		);
+		if (response.ok === false) {
+			const json_val = await response.json();
+			throw new Error(`candidate error: ${json_val.error}`);
+		}
+	}
+
+	// pollCandidates adds the server's ICE candidates to pc as it gathers
+	// them, until it says it has finished
+	async pollCandidates(pc, fetchFunc = fetch) {
+		for (let done = false; !done; ) {
+			const response = await fetchFunc(
+				`/api/sessions/${this.sessionId}/candidates`
+			);
+			const batch = await response.json();
+			if (response.ok === false) {
+				throw new Error(`candidate error: ${batch.error}`);
+			}
+
+			for (const candidate of batch.candidates) {
+				await pc.addIceCandidate(candidate);
+			}
+			done = batch.done;
+		}
+	}
 }
@@ -4,8 +4,14 @@ import {
 	Delete,
 	FontDownload,
 	History,
+	LiveTv,
+	Mic,
+	MicOff,
 	Pause,
 	PlayArrow,
+	Replay,
+	VolumeOff,
+	VolumeUp,
 } from "@material-ui/icons";
 import React, { Component } from "react";
 import { ExchangeSdp } from "../ExchangeSdp.js";
@@ -122,8 +128,26 @@ export class UserAction {
 	}
 }
 
+const PROTOCOL_VERSION = 1;
+
+const REPLAY_SECONDS = 30;
+
 const PC_CONFIG = { iceServers: [{ urls: ["stun:stun.l.google.com:19302"] }] };
 
+// fetchIceConfig gets the server's ICE servers, so TURN credentials live in one
+// place; PC_CONFIG is the fallback for servers that don't provide them
+function fetchIceConfig(fetchFunc = fetch) {
+	return fetchFunc("/api/ice-config")
+		.then((response) => (response.ok ? response.json() : PC_CONFIG))
+		.catch(() => PC_CONFIG);
+}
+
+// eventsUrl is the server's event stream, on the same host as the page
+export function eventsUrl(location = document.location) {
+	const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+	return `${scheme}//${location.host}/api/events`;
+}
+
 class Atn extends Component {
 	constructor(props) {
 		super(props);
@@ -141,12 +165,25 @@ class Atn extends Component {
 			canvas_font_size: 30,
 			canvas_font: "Arial",
 			user_actions: [],
+			events: null,
+			clientId: "",
+			presentationVersion: 0,
+			snapshotImage: null,
+			muted: true,
+			microphone: null,
+			talking: null,
+			talkers: [],
+			sessionId: "",
+			replaying: false,
 		};
 		this.canvas = React.createRef();
+		this.talkbackAudio = React.createRef();
+		// candidates gathered before the server has made the session
+		this.pendingCandidates = [];
 	}
 
-	createPeerConnection() {
-		const peerConnection = new RTCPeerConnection(PC_CONFIG);
+	createPeerConnection(config = PC_CONFIG) {
+		const peerConnection = new RTCPeerConnection(config);
 		peerConnection.onicecandidate = (event) =>
 			this.onIceCandidate(peerConnection, event);
 		peerConnection.oniceconnectionstatechange = () => {
@@ -159,8 +196,24 @@ class Atn extends Component {
 				return peerConnection.setLocalDescription(offer);
 			});
 		};
-		peerConnection.ontrack = (event) => this.getRemoteVideo(event);
+		peerConnection.ontrack = (event) => this.onTrack(event);
+		// negotiated with the server rather than announced, so it has a fixed id
+		const control = peerConnection.createDataChannel("control", {
+			negotiated: true,
+			id: 0,
+			protocol: "atn-events",
+		});
+		control.onopen = () => this.useControlChannel(control);
+		control.onmessage = (event) => this.onEvent(event.data, control);
 		peerConnection.addTransceiver("video", { direction: "sendrecv" });
+		// the surgeon's narration comes down the first audio section, and a
+		// consultant talking back goes up it
+		const microphone = peerConnection.addTransceiver("audio", {
+			direction: "sendrecv",
+		});
+		// other viewers talking back
+		peerConnection.addTransceiver("audio", { direction: "sendrecv" });
+		this.setState({ microphone });
 		peerConnection
 			.createOffer()
 			.then((desc) => {
@@ -171,42 +224,147 @@ class Atn extends Component {
 				}
 			})
 			.then(async () => {
+				// the offer goes straight away, and candidates follow it as
+				// each side gathers them
 				const exchanger = new ExchangeSdp(
 					peerConnection,
-					document.location.port
+					document.location.port,
+					true
 				);
+				this.exchanger = exchanger;
 				const returnedSdp = await exchanger.postSdp();
 
 				this.setState({
 					remoteSessionDescription: returnedSdp,
+					sessionId: exchanger.sessionId,
 				});
 
-				this.start();
-			});
+				await this.start();
+
+				this.pendingCandidates
+					.splice(0)
+					.forEach((candidate) => this.sendCandidate(candidate));
+				exchanger
+					.pollCandidates(peerConnection)
+					.catch((e) => console.log(e));
+			})
+			.catch((e) => alert(e.message));
 
 		return peerConnection;
 	}
 
 	componentDidMount() {
-		let { pc } = this.state;
-
 		this.keyPress();
 		this.createInterval();
+		this.connectEvents();
 
-		pc = this.createPeerConnection();
+		fetchIceConfig().then((config) => {
+			this.setState({ pc: this.createPeerConnection(config) });
+		});
 
 		this.canvas.current.width = this.state.videoWidth;
 		this.canvas.current.height = this.state.videoHeight;
 
 		this.setState({
 			video: React.createRef(),
-			pc,
 			videoStatus: "Playing",
 		});
 	}
 
 	componentWillUnmount() {
 		clearInterval(this.state.intervalId);
+		if (this.state.events) {
+			this.state.events.close();
+		}
+	}
+
+	// connectEvents follows the presentation state the presenter sets, so
+	// everyone watching freezes and resumes together
+	connectEvents(SocketType = window.WebSocket) {
+		if (!SocketType) {
+			return;
+		}
+
+		const events = new SocketType(eventsUrl());
+		events.onmessage = (event) => this.onEvent(event.data, events);
+		this.setState({ events });
+	}
+
+	// useControlChannel switches to the peer connection's data channel, which
+	// carries the same events as the WebSocket and is pinged by the server
+	useControlChannel(control) {
+		if (this.state.events) {
+			this.state.events.close();
+		}
+		this.setState({ events: control });
+	}
+
+	onEvent(data, channel) {
+		const message = JSON.parse(data);
+		if (message.v > PROTOCOL_VERSION) {
+			console.log("Event from a newer server:", message.type);
+		}
+
+		switch (message.type) {
+			case "welcome":
+				this.setState({ clientId: message.data.clientId });
+				break;
+			case "presentation":
+				this.followPresentation(message.data);
+				break;
+			case "ping":
+				channel.send(
+					JSON.stringify({ v: PROTOCOL_VERSION, type: "pong", data: message.data })
+				);
+				break;
+			case "talkback":
+				this.setState({ talkers: message.data });
+				break;
+			case "notice":
+				console.log(`Notice (${message.data.level}): ${message.data.text}`);
+				break;
+			default:
+		}
+	}
+
+	followPresentation(presentation) {
+		if (presentation.version <= this.state.presentationVersion) {
+			return;
+		}
+
+		this.setState({
+			presentationVersion: presentation.version,
+			snapshotImage:
+				presentation.mode === "reviewing"
+					? `/api/snapshots/${presentation.snapshot}/image`
+					: null,
+		});
+
+		const { video, videoStatus } = this.state;
+		const paused = videoStatus === "Paused";
+		if (!video || !video.current || paused === (presentation.mode !== "live")) {
+			return;
+		}
+
+		this.playPauseVideo();
+		this.handleClick();
+	}
+
+	// sharePresentation asks the server to move every other viewer to mode;
+	// it is refused for viewers, who only follow
+	sharePresentation(mode, fetchFunc = window.fetch) {
+		if (!fetchFunc) {
+			return Promise.resolve();
+		}
+
+		return fetchFunc("/api/presentation", {
+			method: "PUT",
+			headers: {
+				"Content-Type": "application/json",
+				"X-Client-ID": this.state.clientId,
+			},
+			body: JSON.stringify({ mode }),
+		}).catch(() => {});
 	}
 
 	canvasUndo() {
@@ -425,6 +583,69 @@ class Atn extends Component {
 		}
 	}
 
+	// the video starts muted so browsers let it autoplay
+	toggleSound() {
+		const { video, muted } = this.state;
+		video.current.muted = !muted;
+		if (this.talkbackAudio.current) {
+			this.talkbackAudio.current.muted = !muted;
+		}
+		this.setState({ muted: !muted });
+	}
+
+	// sends the microphone up the narration's audio section, which needs no
+	// renegotiation; the server only listens to consultants and presenters
+	async toggleTalking(
+		getUserMedia = (constraints) =>
+			navigator.mediaDevices.getUserMedia(constraints)
+	) {
+		const { microphone, talking } = this.state;
+		if (talking) {
+			talking.getTracks().forEach((track) => track.stop());
+			await microphone.sender.replaceTrack(null);
+			this.setState({ talking: null });
+			return;
+		}
+
+		const stream = await getUserMedia({ audio: true });
+		await microphone.sender.replaceTrack(stream.getAudioTracks()[0]);
+		this.setState({ talking: stream });
+	}
+
+	// replay plays the video from secondsAgo on this viewer's own track, or
+	// goes back to live without; nobody else's video changes
+	replay(secondsAgo, fetchFunc = window.fetch) {
+		const { sessionId } = this.state;
+		if (!fetchFunc || !sessionId) {
+			return Promise.resolve();
+		}
+
+		const options = secondsAgo
+			? {
+					method: "PUT",
+					headers: { "Content-Type": "application/json" },
+					body: JSON.stringify({ secondsAgo }),
+			  }
+			: { method: "DELETE" };
+
+		return fetchFunc(`/api/sessions/${sessionId}/feeds/0/replay`, options)
+			.then((response) => (response.ok ? response.json() : Promise.reject()))
+			.then((status) => this.setState({ replaying: !status.live }))
+			.catch(() => {});
+	}
+
+	// other viewers talking back arrive in their own stream, so they don't
+	// replace the video
+	onTrack(event) {
+		const stream = event.streams[0];
+		if (stream && stream.id === "talkback") {
+			this.talkbackAudio.current.srcObject = stream;
+			return;
+		}
+
+		this.getRemoteVideo(event);
+	}
+
 	handleClick() {
 		const { icon } = this.state;
 		this.setState({ icon: !icon });
@@ -442,32 +663,54 @@ class Atn extends Component {
 		});
 	};
 
+	// onIceCandidate trickles each candidate to the server as it is gathered;
+	// the last event has none
 	onIceCandidate = (pc, event) => {
-		if (event !== null) {
+		if (!event || !event.candidate) {
 			return;
 		}
 
-		const l = btoa(JSON.stringify(pc.localDescription));
-		this.setState({ localSessionDescription: l });
+		const candidate = event.candidate.toJSON();
+		if (!this.exchanger || !this.exchanger.sessionId) {
+			this.pendingCandidates.push(candidate);
+			return;
+		}
+
+		this.sendCandidate(candidate);
 	};
 
+	sendCandidate(candidate) {
+		this.exchanger.postCandidate(candidate).catch((e) => console.log(e));
+	}
+
 	start() {
 		let { remoteSessionDescription, pc } = this.state;
 		if (remoteSessionDescription === "") {
 			return alert("Remote Session Description must not be empty");
 		}
-		pc.createOffer()
-			.then(() => {
+		const answered = pc
+			.createOffer()
+			.then(() =>
 				pc.setRemoteDescription(
 					new RTCSessionDescription(JSON.parse(remoteSessionDescription))
-				);
-			})
+				)
+			)
 			.catch((e) => console.log(e));
 		this.setState({ pc });
+		return answered;
 	}
 
 	render() {
-		const { video, playPauseText, icon } = this.state;
+		const {
+			video,
+			playPauseText,
+			icon,
+			muted,
+			talking,
+			talkers,
+			replaying,
+		} = this.state;
+		const speaking = talkers.find((talker) => talker.speaking);
 
 		return (
 			<Grid container spacing={3}>
@@ -485,6 +728,13 @@ class Atn extends Component {
 								/>
 							</div>
 							<div id="video">
+								{this.state.snapshotImage && (
+									<img
+										id="snapshot_image"
+										alt="snapshot under review"
+										src={this.state.snapshotImage}
+									/>
+								)}
 								<video
 									id="video-element"
 									className="video"
@@ -493,6 +743,12 @@ class Atn extends Component {
 									muted
 									src="https://media.giphy.com/media/Ph0oIVQeuvh0k/giphy.mp4"
 								/>
+								<audio
+									id="talkback_audio"
+									ref={this.talkbackAudio}
+									autoPlay
+									muted
+								/>
 							</div>
 						</div>
 					</Grid>
@@ -587,6 +843,9 @@ class Atn extends Component {
 							id="pause_button"
 							className="playPauseButton"
 							onClick={() => {
+								this.sharePresentation(
+									this.state.videoStatus === "Playing" ? "frozen" : "live"
+								);
 								this.playPauseVideo();
 								this.handleClick();
 							}}
@@ -594,6 +853,41 @@ class Atn extends Component {
 							{playPauseText}
 							{icon ? <PlayArrow /> : <Pause />}
 						</Button>
+						<Button
+							variant="contained"
+							color="primary"
+							id="sound_button"
+							className="soundButton"
+							onClick={() => this.toggleSound()}
+						>
+							{muted ? "Sound" : "Mute"}
+							{muted ? <VolumeUp /> : <VolumeOff />}
+						</Button>
+						<Button
+							variant="contained"
+							color="primary"
+							id="talk_button"
+							className="talkButton"
+							onClick={() => this.toggleTalking()}
+						>
+							{talking ? "Stop Talking" : "Talk"}
+							{talking ? <MicOff /> : <Mic />}
+						</Button>
+						<Button
+							variant="contained"
+							color="primary"
+							id="replay_button"
+							className="replayButton"
+							onClick={() => this.replay(replaying ? 0 : REPLAY_SECONDS)}
+						>
+							{replaying ? "Live" : `Replay ${REPLAY_SECONDS}s`}
+							{replaying ? <LiveTv /> : <Replay />}
+						</Button>
+						{speaking && (
+							<div id="talkback_speaking">
+								{speaking.name || "A consultant"} is talking
+							</div>
+						)}
 					</Grid>
 				</div>
 			</Grid>